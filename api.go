@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 var errRunning = errors.New("machine running")
@@ -19,10 +20,12 @@ func (name NoSuchOpError) Error() string {
 }
 
 // New creates a new stack machine with a given program loaded. The prog byte
-// array is a sequence of varint encoded unsigned integers (after fixed encoded
-// options).
+// array is either a sectioned program container (see Program and
+// DecodeProgram), or a legacy program: a sequence of varint encoded unsigned
+// integers after fixed encoded options.
 //
-// The first fixed byte is a version number, which must currently be 0x00.
+// The first fixed byte of a legacy program is a version number, which must
+// currently be 0x00 or 0x01.
 //
 // The next two bytes encode a 16-bit unsigned stacksize. That much space will
 // be reserved in memory for the Parameter Stack (PS) and Control Stack (CS);
@@ -46,48 +49,126 @@ func (name NoSuchOpError) Error() string {
 // of popping a value from the parameter stack. Most control flow operations
 // use their immediate argument as an IP offset, however they will consume an
 // IP offset from the parameter stack if no immediate is given.
+//
+// Under version 0x00, all immediates are plain unsigned varints, and immediate
+// offsets are relative to the end of their operation. Under version 0x01,
+// value and offset immediates are zigzag encoded, so that small negative
+// values stay short, and immediate offsets are relative to the start of their
+// operation. Offsets consumed from the parameter stack are always relative to
+// the end of the operation.
 func New(prog []byte) (*Mach, error) {
-	p := prog
-	if len(p) < 4 {
-		return nil, errors.New("program too short, need at least 4 bytes")
-	}
-
-	if p[0] != _machVersionCode {
-		return nil, fmt.Errorf("unsupported stackvm program version %02x", p[0])
+	p, err := DecodeProgram(prog)
+	if err != nil {
+		return nil, err
 	}
-	p = p[1:]
+	return Load(p)
+}
 
-	stackSize := binary.BigEndian.Uint16(p)
+// Load creates a new stack machine with a decoded program loaded: its code is
+// loaded right after the stack space, with IP pointing at its entry offset,
+// and then its data segments are loaded (see New).
+func Load(prog *Program) (*Mach, error) {
+	stackSize := prog.StackSize
 	if stackSize%_pageSize != 0 {
 		return nil, fmt.Errorf(
 			"invalid stacksize %#02x, not a %#02x-multiple",
 			stackSize, _pageSize)
 	}
-	p = p[2:]
+	if len(prog.Code) == 0 {
+		return nil, errNoCode
+	}
+	if prog.Entry >= uint32(len(prog.Code)) {
+		return nil, fmt.Errorf("entry offset %#04x out of code range", prog.Entry)
+	}
+	for _, ds := range prog.Data {
+		if ds.Addr < uint32(stackSize) {
+			return nil, fmt.Errorf("data segment @%#04x overlaps stack space", ds.Addr)
+		}
+	}
 
 	m := Mach{
-		ctx: defaultContext,
-		opc: makeOpCache(len(p)),
-		pbp: 0,
-		psp: _pspInit,
-		cbp: uint32(stackSize) - 4,
-		csp: uint32(stackSize) - 4,
-		ip:  uint32(stackSize),
+		ctx:      defaultContext,
+		opc:      makeOpCache(len(prog.Code)),
+		pbp:      0,
+		psp:      _pspInit,
+		cbp:      uint32(stackSize) - 4,
+		csp:      uint32(stackSize) - 4,
+		ip:       uint32(stackSize),
+		maxPages: prog.MaxPages,
+		maxAddr:  prog.MaxAddr,
+		stats:    &RunStats{},
+	}
+	m.prog = &image{
+		version: prog.Version,
+		base:    m.ip,
+		end:     m.ip + uint32(len(prog.Code)),
+		syms:    prog.Symbols,
+		halts:   prog.HaltNames,
+	}
+
+	if err := m.storeBytes(m.ip, prog.Code); err != nil {
+		return nil, fmt.Errorf("unable to load code: %v", err)
+	}
+	for _, ds := range prog.Data {
+		if err := m.storeBytes(ds.Addr, ds.Data); err != nil {
+			return nil, fmt.Errorf("unable to load data segment @%#04x: %v", ds.Addr, err)
+		}
 	}
-
-	m.storeBytes(m.ip, p)
-	// TODO mark code segment, update data
+	m.ip += prog.Entry
 
 	return &m, nil
 }
 
+// Symbols returns any symbols that came with the machine's program.
+func (m *Mach) Symbols() Symbols {
+	if m.prog == nil {
+		return nil
+	}
+	return m.prog.syms
+}
+
+// CodeRange returns the address range, [start, end), of the machine's loaded
+// code.
+func (m *Mach) CodeRange() (start, end uint32) {
+	if m.prog == nil {
+		return 0, 0
+	}
+	return m.prog.base, m.prog.end
+}
+
+// ReadOp decodes the operation at addr, returning it and the address of the
+// operation after it. Just like the ops passed to a Tracer, any offset
+// argument is relative to addr under the current program version.
+func (m *Mach) ReadOp(addr uint32) (Op, uint32, error) {
+	end, code, arg, err := m.read(addr)
+	if err != nil {
+		return Op{}, end, err
+	}
+	return Op{code.code(), arg, code.hasImm()}, end, nil
+}
+
+// PageCount returns how many pages of memory the machine has allocated.
+func (m *Mach) PageCount() int { return int(m.npages) }
+
+// HaltName returns the name given to a halt code by the machine's program.
+func (m *Mach) HaltName(code uint32) (string, bool) {
+	if m.prog == nil {
+		return "", false
+	}
+	name, ok := m.prog.halts[code]
+	return name, ok
+}
+
 func (m *Mach) String() string {
 	var buf bytes.Buffer
 	buf.WriteString("Mach")
 	if m.err != nil {
 		if code, halted := m.halted(); halted {
-			// TODO: symbolicate
-			fmt.Fprintf(&buf, " HALT:%v", code)
+			if name, ok := m.HaltName(code); ok {
+				fmt.Fprintf(&buf, " HALT:%v(%s)", code, name)
+			} else {
+				fmt.Fprintf(&buf, " HALT:%v", code)
+			}
 		} else {
 			fmt.Fprintf(&buf, " ERR:%v", m.err)
 		}
@@ -103,14 +184,9 @@ func (m *Mach) String() string {
 // EachPage calls a function with each allocated section of memory; it MUST NOT
 // mutate the memory, and should copy out any data that it needs to retain.
 func (m *Mach) EachPage(f func(addr uint32, p [64]byte) error) error {
-	for i, pg := range m.pages {
-		if pg != nil {
-			if err := f(uint32(i*_pageSize), pg.d); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+	return m.pages.each(func(i uint32, pg *page) error {
+		return f(i*_pageSize, pg.d)
+	})
 }
 
 var zeroPageData [_pageSize]byte
@@ -118,18 +194,20 @@ var zeroPageData [_pageSize]byte
 // WriteTo writes all machine memory to the given io.Writer, returning the
 // number of bytes written.
 func (m *Mach) WriteTo(w io.Writer) (n int64, err error) {
-	for _, pg := range m.pages {
-		var wn int
-		if pg == nil {
-			wn, err = w.Write(zeroPageData[:])
-		} else {
-			wn, err = w.Write(pg.d[:])
+	next := uint32(0)
+	err = m.pages.each(func(i uint32, pg *page) error {
+		for ; next < i; next++ {
+			wn, err := w.Write(zeroPageData[:])
+			n += int64(wn)
+			if err != nil {
+				return err
+			}
 		}
+		next++
+		wn, err := w.Write(pg.d[:])
 		n += int64(wn)
-		if err != nil {
-			break
-		}
-	}
+		return err
+	})
 	return
 }
 
@@ -205,35 +283,59 @@ func (m *Mach) Stacks() ([]uint32, []uint32, error) {
 	return ps, cs, nil
 }
 
+// Fetch returns the word at the given, 4-byte aligned, address.
+func (m *Mach) Fetch(addr uint32) (uint32, error) {
+	return m.fetch(addr)
+}
+
+// Push pushes values onto the parameter stack, e.g. to prime a machine with
+// inputs before running it.
+func (m *Mach) Push(vals ...uint32) error {
+	for _, val := range vals {
+		if err := m.push(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // MemCopy copies bytes from memory into the given buffer, returning
 // the number of bytes copied.
 func (m *Mach) MemCopy(addr uint32, bs []byte) int {
 	return m.fetchBytes(addr, bs)
 }
 
-// Tracer is the interface taken by (*Mach).Trace to observe machine
-// execution: Begin() and End() are called when a machine starts and finishes
-// respectively; Before() and After() are around each machine operation;
-// Queue() is called when a machine creates a copy of itself; Handle() is
-// called after an ended machine has been passed to any result handling
-// function.
+// Observer is the interface taken by (*Mach).Observe to observe the lifecycle
+// of machines: Begin() and End() are called when a machine starts and
+// finishes respectively; Queue() is called when a machine creates a copy of
+// itself; Handle() is called after an ended machine has been passed to any
+// result handling function.
 //
 // Contextual information may be made available by implementing the Context()
-// method: if a tracer wants defines a value for some key, it should return
-// that value and a true boolean. Tracers, and other code, may then use
-// (*Mach).Tracer().Context() to access contextual information from other
-// tracers.
-type Tracer interface {
+// method: if an observer wants defines a value for some key, it should return
+// that value and a true boolean. Observers, and other code, may then use
+// (*Mach).Observer().Context() to access contextual information from other
+// observers.
+type Observer interface {
 	Context(m *Mach, key string) (interface{}, bool)
 	Begin(m *Mach)
-	Before(m *Mach, ip uint32, op Op)
-	After(m *Mach, ip uint32, op Op)
 	Queue(m, n *Mach)
 	End(m *Mach)
 	Handle(m *Mach, err error)
 }
 
-// Op is used within Tracer to pass along decoded machine operations.
+// Tracer is the interface taken by (*Mach).Trace to observe machine
+// execution: it is an Observer that is additionally called Before() and
+// After() each machine operation.
+type Tracer interface {
+	Observer
+	Before(m *Mach, ip uint32, op Op)
+	After(m *Mach, ip uint32, op Op)
+}
+
+// Op is used within Tracer to pass along decoded machine operations. Under
+// the current program version, the Arg of an offset op is relative to the
+// address of the op itself (see New).
 type Op struct {
 	Code byte
 	Arg  uint32
@@ -254,13 +356,21 @@ func (o Op) Name() string {
 	return ops[o.Code].name
 }
 
-// MachOptions represents options for a machine, currently just stack size (see
-// New).
+// MachOptions represents options for a machine: its stack size (see New), and
+// any memory limits.
+//
+// MaxPages limits how many pages of memory a machine may allocate, while
+// MaxAddr is the highest address that it may store to; either is unlimited
+// when zero. Crossing either limit faults the machine with ErrOutOfMemory.
 type MachOptions struct {
 	StackSize uint16
+	MaxPages  uint32
+	MaxAddr   uint32
 }
 
-// EncodeInto encodes machine optios for the header of a program.
+// EncodeInto encodes machine optios for the header of a legacy program; it
+// always encodes the current program version. Memory limits can only be
+// encoded by a program container (see Program).
 func (opts MachOptions) EncodeInto(p []byte) int {
 	p[0] = _machVersionCode
 	binary.BigEndian.PutUint16(p[1:], opts.StackSize)
@@ -275,7 +385,7 @@ func (o Op) EncodeInto(p []byte) int {
 	i--
 	ep[i] = o.Code
 	if o.Have {
-		v := o.Arg
+		v := o.encodedArg()
 		for {
 			i--
 			if i < 0 {
@@ -298,7 +408,18 @@ func (o Op) EncodeInto(p []byte) int {
 
 // NeededSize returns the number of bytes needed to encode op.
 func (o Op) NeededSize() int {
-	return int(varOpLength(o.Arg))
+	if !o.Have {
+		return 1
+	}
+	return int(varOpLength(o.encodedArg()))
+}
+
+func (o Op) encodedArg() uint32 {
+	switch ops[o.Code].imm.kind() {
+	case opImmVal, opImmOffset:
+		return zigzag(o.Arg)
+	}
+	return o.Arg
 }
 
 // AcceptsRef return true only if the argument can resolve another op reference
@@ -311,21 +432,19 @@ func (o Op) AcceptsRef() bool {
 	return false
 }
 
+// AcceptsAddr return true only if the argument is an absolute address, rather
+// than an offset from the op's location; such an argument resolves to the
+// target address itself (see ResolveRefArg).
+func (o Op) AcceptsAddr() bool {
+	return ops[o.Code].imm.kind() == opImmAddr
+}
+
 // ResolveRefArg fills in the argument of a control op relative to another op's
 // encoded location, and the current op's.
 func (o Op) ResolveRefArg(myIP, targIP uint32) Op {
 	switch ops[o.Code].imm.kind() {
 	case opImmOffset:
-		// need to skip the arg and the code...
-		d := targIP - myIP
-		n := varOpLength(d)
-		d -= n
-		if id := int32(d); id < 0 && varOpLength(uint32(id)) != n {
-			// ...arg off by one, now that we know its value.
-			id--
-			d = uint32(id)
-		}
-		o.Arg = d
+		o.Arg = targIP - myIP
 
 	case opImmAddr:
 		o.Arg = targIP
@@ -344,30 +463,42 @@ func (o Op) String() string {
 	case opImmAddr:
 		return fmt.Sprintf("@%#04x %s", o.Arg, def.name)
 	case opImmOffset:
-		return fmt.Sprintf("%+#04x %s", o.Arg, def.name)
+		return fmt.Sprintf("%+#04x %s", int32(o.Arg), def.name)
 	}
 	return fmt.Sprintf("INVALID(%#x %x %q)", o.Arg, o.Code, def.name)
 }
 
+// Observer returns the current Observer that the machine is running under, if
+// any; this includes any Tracer.
+func (m *Mach) Observer() Observer {
+	if oc, ok := m.ctx.(observedContext); ok {
+		return oc.o
+	}
+	return nil
+}
+
 // Tracer returns the current Tracer that the machine is running under, if any.
 func (m *Mach) Tracer() Tracer {
-	if tc, ok := m.ctx.(tracedContext); ok {
-		return tc.t
+	if oc, ok := m.ctx.(observedContext); ok {
+		if t, ok := oc.o.(Tracer); ok {
+			return t
+		}
 	}
 	return nil
 }
 
-type tracedContext struct {
+type observedContext struct {
 	context
-	t Tracer
+	o Observer
+	t Tracer // non-nil only under Trace
 	m *Mach
 }
 
-func tracify(ctx context, t Tracer, m *Mach) context {
-	for tc, ok := ctx.(tracedContext); ok; tc, ok = ctx.(tracedContext) {
-		ctx = tc.context
+func observify(ctx context, o Observer, t Tracer, m *Mach) context {
+	for oc, ok := ctx.(observedContext); ok; oc, ok = ctx.(observedContext) {
+		ctx = oc.context
 	}
-	return tracedContext{ctx, t, m}
+	return observedContext{ctx, o, t, m}
 }
 
 // SetHandler allocates a pending queue and sets a result handling
@@ -378,26 +509,96 @@ func (m *Mach) SetHandler(queueSize int, h Handler) {
 	m.ctx = newRunq(h, queueSize)
 }
 
-func (tc tracedContext) queue(n *Mach) error {
-	tc.t.Queue(tc.m, n)
-	n.ctx = tracify(n.ctx, tc.t, n)
-	return tc.context.queue(n)
+// SetOverflowPolicy sets what happens when the pending queue allocated by
+// SetHandler is full; without one, OverflowFail is the default.
+func (m *Mach) SetOverflowPolicy(p OverflowPolicy) error {
+	ctx := m.ctx
+	if oc, ok := ctx.(observedContext); ok {
+		ctx = oc.context
+	}
+	if rc, ok := ctx.(*replayContext); ok {
+		ctx = rc.context
+	}
+	rq, ok := ctx.(*runq)
+	if !ok {
+		return errNoQueue
+	}
+	rq.policy = p
+	return nil
 }
 
-// Trace implements the same logic as (*Mach).run, but calls a Tracer
-// at the appropriate times.
-func (m *Mach) Trace(t Tracer) error {
-	// the code below is essentially an
-	// instrumented copy of Mach.Run (with mach.run
-	// inlined)
-	orig := m
+// SetStepLimit limits how many operations a run may execute in total, across
+// all of the machines that it spawns; zero, the default, means no limit. The
+// machine that reaches the limit faults with ErrStepLimit, as then does every
+// machine still pending.
+func (m *Mach) SetStepLimit(n uint64) {
+	m.maxOps = n
+}
 
-	m.ctx = tracify(m.ctx, t, m)
+// opLimit returns the op count, shared by all machines in the run, at which
+// the machine must stop.
+func (m *Mach) opLimit() uint64 {
+	if m.maxOps == 0 {
+		return ^uint64(0)
+	}
+	return m.maxOps
+}
 
-repeat:
-	// live
-	t.Begin(m)
+func (oc observedContext) queue(n *Mach) error {
+	if rc, ok := oc.context.(*replayContext); ok && rc.replaying() {
+		// the copy will be discarded, or taken over, rather than queued, so
+		// no observer ever hears of it
+		return rc.queue(n)
+	}
+	oc.o.Queue(oc.m, n)
+	n.ctx = observify(n.ctx, oc.o, oc.t, n)
+	return oc.context.queue(n)
+}
+
+// Observe implements the same logic as (*Mach).Run, but calls an Observer at
+// the appropriate times. Unlike Trace, no additional work is done per
+// operation.
+func (m *Mach) Observe(o Observer) error {
+	m.ctx = observify(m.ctx, o, nil, m)
+	return m.Run()
+}
+
+// Trace implements the same logic as (*Mach).Run, but calls a Tracer at the
+// appropriate times, including before and after every operation.
+func (m *Mach) Trace(t Tracer) error {
+	m.ctx = observify(m.ctx, t, t, m)
+	return m.Run()
+}
+
+// live runs the machine until it ends, and then passes it to its handler,
+// calling any Observer or Tracer that it's running under along the way.
+func (m *Mach) live() error {
+	oc, ok := m.ctx.(observedContext)
+	if !ok {
+		m.exec()
+		m.stats.Handled++
+		return m.ctx.Handle(m)
+	}
+	oc.o.Begin(m)
+	if oc.t != nil {
+		m.traceExec(oc.t)
+	} else {
+		m.exec()
+	}
+	oc.o.End(m)
+	m.stats.Handled++
+	err := m.ctx.Handle(m)
+	oc.o.Handle(m, err)
+	return err
+}
+
+func (m *Mach) traceExec(t Tracer) {
+	limit := m.opLimit()
 	for m.err == nil {
+		if m.stats.Ops >= limit {
+			m.err = ErrStepLimit
+			break
+		}
 		var readOp Op
 		if _, code, arg, err := m.read(m.ip); err != nil {
 			m.err = err
@@ -406,36 +607,31 @@ repeat:
 			readOp = Op{code.code(), arg, code.hasImm()}
 		}
 		t.Before(m, m.ip, readOp)
+		m.stats.Ops++
 		m.step()
 		if m.err != nil {
 			break
 		}
 		t.After(m, m.ip, readOp)
 	}
-	t.End(m)
-
-	// win or die
-	err := m.ctx.Handle(m)
-	t.Handle(m, err)
-	if err == nil {
-		if n := m.ctx.next(); n != nil {
-			m.free()
-			m = n
-			// die
-			goto repeat
-		}
-	}
+}
 
-	// win?
-	if m != orig {
-		*orig = *m
-	}
-	return err
+// Compile predecodes the machine's code segment into threaded code: a handler
+// function for each operation, which Run and Observe then dispatch through
+// directly, rather than decoding and switching on every operation. The
+// threaded code is shared by all copies of the machine, so a program must not
+// modify its own code after being compiled.
+func (m *Mach) Compile() {
+	m.prog.compile(m)
 }
 
 // Run runs the machine until termination, returning any error.
 func (m *Mach) Run() error {
+	stats := &RunStats{}
+	m.stats = stats
+	start := time.Now()
 	n, err := m.run()
+	stats.Elapsed = time.Since(start)
 	if n != m {
 		*m = *n
 	}
@@ -505,6 +701,9 @@ func (me MachError) Cause() error { return me.err }
 
 func (me MachError) Error() string { return fmt.Sprintf("@0x%04x: %v", me.addr, me.err) }
 
+func zigzag(n uint32) uint32   { return (n << 1) ^ uint32(int32(n)>>31) }
+func unzigzag(n uint32) uint32 { return (n >> 1) ^ -(n & 1) }
+
 func varOpLength(n uint32) (m uint32) {
 	for v := n; v != 0; v >>= 7 {
 		m++
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jcorbin/stackvm"
+	xstackvm "github.com/jcorbin/stackvm/x"
+)
+
+// outFile is a file to be written, or checked, by the asm command.
+type outFile struct {
+	path string
+	data []byte
+}
+
+func asmCommand(args []string) int {
+	var (
+		fs       = flag.NewFlagSet("asm", flag.ExitOnError)
+		out      string
+		listPath string
+		symPath  string
+		optimize bool
+		check    bool
+	)
+	fs.StringVar(&out, "o", "", "write the program to this file; defaults to the source path with a .bin extension")
+	fs.StringVar(&listPath, "list", "", "also write a listing of addresses, encoded bytes, ops, and labels to this file")
+	fs.StringVar(&symPath, "sym", "", "also write the program's symbols, one address and name per line, to this file")
+	fs.BoolVar(&optimize, "O", false, "run the peephole optimizer over the program")
+	fs.BoolVar(&check, "check", false, "don't write anything, only check that any output files are up to date")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: stackvm asm [options] source\n\n"+
+			"Assembles a textual assembly source file into a binary program.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	src := fs.Arg(0)
+	if out == "" {
+		out = strings.TrimSuffix(src, filepath.Ext(src)) + ".bin"
+	}
+
+	buf, err := assembleFile(src, optimize)
+	if err != nil {
+		log.Printf("stackvm asm: %v", err)
+		return 1
+	}
+	files := []outFile{{out, buf}}
+	if listPath != "" || symPath != "" {
+		prog, err := stackvm.DecodeProgram(buf)
+		if err != nil {
+			log.Printf("stackvm asm: %v", err)
+			return 1
+		}
+		if listPath != "" {
+			lst, err := listProgram(prog)
+			if err != nil {
+				log.Printf("stackvm asm: %v", err)
+				return 1
+			}
+			files = append(files, outFile{listPath, lst})
+		}
+		if symPath != "" {
+			files = append(files, outFile{symPath, symbolFile(prog.Symbols)})
+		}
+	}
+
+	status := 0
+	for _, f := range files {
+		if !check {
+			if err := ioutil.WriteFile(f.path, f.data, 0644); err != nil {
+				log.Printf("stackvm asm: %v", err)
+				return 1
+			}
+			continue
+		}
+		if have, err := ioutil.ReadFile(f.path); err != nil {
+			log.Printf("stackvm asm: %v", err)
+			status = 1
+		} else if !bytes.Equal(have, f.data) {
+			log.Printf("stackvm asm: %s is out of date", f.path)
+			status = 1
+		}
+	}
+	return status
+}
+
+func assembleFile(path string, optimize bool) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	toks, err := xstackvm.ParseSource(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	assemble := xstackvm.Assemble
+	if optimize {
+		assemble = xstackvm.AssembleOptimized
+	}
+	buf, err := assemble(toks...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return buf, nil
+}
+
+// listProgram returns a listing of the program's code: a line for each label,
+// and for each op its address, encoded bytes, and disassembly; ops that refer
+// to a labeled address are annotated with the label.
+func listProgram(prog *stackvm.Program) ([]byte, error) {
+	m, err := stackvm.Load(prog)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# version %d, stack size %#04x\n", prog.Version, prog.StackSize)
+	syms := prog.Symbols
+	start, end := m.CodeRange()
+	enc := make([]byte, 0, 16)
+	for ip := start; ip < end; {
+		for _, sym := range syms {
+			if sym.Addr == ip {
+				fmt.Fprintf(&buf, "%s:\n", sym.Name)
+			}
+		}
+		op, next, err := m.ReadOp(ip)
+		if err != nil {
+			return nil, err
+		}
+		enc = enc[:next-ip]
+		m.MemCopy(ip, enc)
+		fmt.Fprintf(&buf, "\t%#04x  %-14s  %v", ip, fmt.Sprintf("% x", enc), op)
+		if targ, ok := refTarget(prog.Version, ip, next, op); ok {
+			if sym, ok := syms.Lookup(targ); ok && sym.Addr == targ {
+				fmt.Fprintf(&buf, "  # %s", sym.Name)
+			}
+		}
+		buf.WriteByte('\n')
+		ip = next
+	}
+	return buf.Bytes(), nil
+}
+
+// refTarget returns the address that an op's immediate refers to, if it takes
+// a ref (see stackvm.Op.AcceptsRef).
+func refTarget(version byte, ip, next uint32, op stackvm.Op) (uint32, bool) {
+	if !op.Have || !op.AcceptsRef() {
+		return 0, false
+	}
+	if op.AcceptsAddr() {
+		return op.Arg, true
+	}
+	if version == 0 {
+		return next + op.Arg, true
+	}
+	return ip + op.Arg, true
+}
+
+// symbolFile returns one line for each symbol: its address and name.
+func symbolFile(syms stackvm.Symbols) []byte {
+	var buf bytes.Buffer
+	for _, sym := range syms {
+		fmt.Fprintf(&buf, "%#04x %s\n", sym.Addr, sym.Name)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsmCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stackvm-asm")
+	require.NoError(t, err, "unexpected tempdir error")
+	defer os.RemoveAll(dir)
+
+	var (
+		out  = filepath.Join(dir, "countdown.bin")
+		lst  = filepath.Join(dir, "countdown.lst")
+		sym  = filepath.Join(dir, "countdown.sym")
+		args = []string{"-o", out, "-list", lst, "-sym", sym, filepath.Join("testdata", "countdown.svm")}
+	)
+
+	assert.Equal(t, 1, asmCommand(append([]string{"-check"}, args...)), "expected check to fail before assembling")
+	require.Equal(t, 0, asmCommand(args), "expected assembly to succeed")
+
+	readFile := func(path string) string {
+		buf, err := ioutil.ReadFile(path)
+		require.NoError(t, err, "unexpected read error")
+		return string(buf)
+	}
+	assert.Equal(t, ""+
+		"# version 1, stack size 0x0040\n"+
+		"\t0x0040  86 00           3 push\n"+
+		"loop:\n"+
+		"\t0x0042  c9 36           @0x0049 call  # dec\n"+
+		"\t0x0044  02              dup\n"+
+		"\t0x0045  85 31           -0x003 jnz  # loop\n"+
+		"\t0x0047  80 7f           0 halt\n"+
+		"dec:\n"+
+		"\t0x0049  81 10           4294967295 add\n"+
+		"\t0x004b  37              ret\n",
+		readFile(lst), "expected listing")
+	assert.Equal(t, ""+
+		"0x0042 loop\n"+
+		"0x0049 dec\n",
+		readFile(sym), "expected symbols")
+
+	assert.Equal(t, 0, asmCommand(append([]string{"-check"}, args...)), "expected check to pass once assembled")
+	require.NoError(t, ioutil.WriteFile(sym, []byte("0x0042 loop\n"), 0644), "unexpected write error")
+	assert.Equal(t, 1, asmCommand(append([]string{"-check"}, args...)), "expected check to fail once out of date")
+}
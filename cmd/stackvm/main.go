@@ -0,0 +1,71 @@
+// Command stackvm assembles and runs stackvm programs.
+//
+// Usage:
+//
+//	stackvm asm [options] source
+//	stackvm run [options] program [input...]
+//
+// Programs may be assembled binaries, or textual assembly source files, with
+// a ".svm" extension, as parsed by xstackvm.ParseSource.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jcorbin/stackvm"
+	xstackvm "github.com/jcorbin/stackvm/x"
+)
+
+// commands maps subcommand names to their implementations; each gets its
+// arguments after the subcommand name, and returns an exit status.
+var commands = map[string]func(args []string) int{
+	"asm": asmCommand,
+	"run": runCommand,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "stackvm: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd(os.Args[2:]))
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: stackvm <command> [arguments]\n\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "\t%s\n", name)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun \"stackvm <command> -h\" for command usage\n")
+}
+
+// loadProgram reads and decodes a program, assembling it first if it's a
+// source file.
+func loadProgram(path string) (*stackvm.Program, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == ".svm" {
+		if buf, err = xstackvm.AssembleSource(bytes.NewReader(buf)); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return stackvm.DecodeProgram(buf)
+}
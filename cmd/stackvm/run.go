@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+// runTracers are the tracers that may be selected by name with -trace; all of
+// them write to stderr.
+var runTracers = map[string]func(tl *log.Logger) stackvm.Tracer{
+	"log":     func(tl *log.Logger) stackvm.Tracer { return tracer.NewLogTracer(tl.Printf) },
+	"memdiff": func(tl *log.Logger) stackvm.Tracer { return tracer.NewMemDiffTracer(tl.Printf) },
+	"json":    func(*log.Logger) stackvm.Tracer { return tracer.NewJSONTracer(os.Stderr) },
+}
+
+// runResult is a finished machine, as printed by the run command.
+type runResult struct {
+	ID     string     `json:"id"`
+	Values [][]uint32 `json:"values,omitempty"`
+	Halt   *uint32    `json:"halt,omitempty"` // non-zero halt code
+	Name   string     `json:"name,omitempty"` // name of the halt code, if any
+	Err    string     `json:"err,omitempty"`  // any other machine error
+}
+
+func (rr runResult) String() string {
+	switch {
+	case rr.Err != "":
+		return fmt.Sprintf("%s error=%q", rr.ID, rr.Err)
+	case rr.Halt != nil && rr.Name != "":
+		return fmt.Sprintf("%s halt=%d(%s)", rr.ID, *rr.Halt, rr.Name)
+	case rr.Halt != nil:
+		return fmt.Sprintf("%s halt=%d", rr.ID, *rr.Halt)
+	default:
+		return fmt.Sprintf("%s values=%v", rr.ID, rr.Values)
+	}
+}
+
+func runCommand(args []string) int {
+	var (
+		fs        = flag.NewFlagSet("run", flag.ExitOnError)
+		queueSize int
+		maxPages  uint
+		maxAddr   uint
+		maxSteps  uint64
+		compile   bool
+		traces    string
+		asJSON    bool
+	)
+	fs.IntVar(&queueSize, "queue", 100, "pending machine queue size")
+	fs.UintVar(&maxPages, "maxPages", 0, "limit how many memory pages each machine may allocate, overriding the program")
+	fs.UintVar(&maxAddr, "maxAddr", 0, "limit the highest address that machines may store to, overriding the program")
+	fs.Uint64Var(&maxSteps, "maxSteps", 0, "limit how many operations the run may execute, across all machines")
+	fs.BoolVar(&compile, "compile", false, "compile the program to threaded code before running it; ignored when tracing")
+	fs.StringVar(&traces, "trace", "", "comma-separated tracers to run with, writing to stderr: json, log, or memdiff")
+	fs.BoolVar(&asJSON, "json", false, "print results as JSON objects, one per line")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: stackvm run [options] program [input...]\n\n"+
+			"Runs a program, after pushing any integer inputs onto its parameter stack,\n"+
+			"printing the values or halt code of every machine that it runs. Exits\n"+
+			"non-zero if any machine faults, rather than halting.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	ts := []stackvm.Observer{tracer.NewIDTracer()}
+	if traces != "" {
+		ts = append(ts, tracer.NewCountTracer())
+		tl := log.New(os.Stderr, "", 0)
+		for _, name := range strings.Split(traces, ",") {
+			newTracer, ok := runTracers[name]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "stackvm run: unknown tracer %q\n", name)
+				return 2
+			}
+			ts = append(ts, newTracer(tl))
+		}
+	}
+
+	inputs := make([]uint32, 0, fs.NArg()-1)
+	for _, arg := range fs.Args()[1:] {
+		n, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil || n < -1<<31 || n > 1<<32-1 {
+			fmt.Fprintf(os.Stderr, "stackvm run: invalid input %q\n", arg)
+			return 2
+		}
+		inputs = append(inputs, uint32(n))
+	}
+
+	prog, err := loadProgram(fs.Arg(0))
+	if err != nil {
+		log.Printf("stackvm run: %v", err)
+		return 1
+	}
+	if maxPages != 0 {
+		prog.MaxPages = uint32(maxPages)
+	}
+	if maxAddr != 0 {
+		prog.MaxAddr = uint32(maxAddr)
+	}
+	m, err := stackvm.Load(prog)
+	if err != nil {
+		log.Printf("stackvm run: %v", err)
+		return 1
+	}
+	if err := m.Push(inputs...); err != nil {
+		log.Printf("stackvm run: unable to push inputs: %v", err)
+		return 1
+	}
+	m.SetStepLimit(maxSteps)
+	if compile && traces == "" {
+		m.Compile()
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	faulted := false
+	m.SetHandler(queueSize, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+		var (
+			rr  runResult
+			err error
+		)
+		mid, _ := m.Observer().Context(m, "id")
+		if id, ok := mid.(tracer.MachID); ok {
+			rr.ID = id.String()
+		}
+		if code, halted := m.HaltCode(); !halted {
+			rr.Err = m.Err().Error()
+			faulted = true
+		} else if code != 0 {
+			rr.Halt = &code
+			rr.Name, _ = m.HaltName(code)
+		} else if rr.Values, err = m.Values(); err != nil {
+			rr.Err = err.Error()
+			faulted = true
+		}
+		if asJSON {
+			return enc.Encode(rr)
+		}
+		_, err = fmt.Println(rr)
+		return err
+	}))
+
+	if err := tracer.Run(m, tracer.Multi(ts...)); err != nil {
+		log.Printf("stackvm run: %v", err)
+		return 1
+	}
+	if faulted {
+		return 1
+	}
+	return 0
+}
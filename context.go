@@ -22,26 +22,54 @@ type context interface {
 	next() *Mach
 }
 
-// runq implements a capped lifo queue
+// runq implements a capped lifo queue; what happens once it's full is up to
+// its overflow policy.
 type runq struct {
 	Handler
-	q []*Mach
+	q      []*Mach
+	max    int
+	policy OverflowPolicy
+	spill  *spillStack // machines spilled out from under q, if any
+
+	inlined int // how deeply machines are being run inline
 }
 
 func newRunq(h Handler, n int) *runq {
-	return &runq{h, make([]*Mach, 0, n)}
+	return &runq{Handler: h, q: make([]*Mach, 0, n), max: n}
 }
 
 func (rq *runq) queue(m *Mach) error {
-	if len(rq.q) == cap(rq.q) {
-		return errRunQFull
+	if len(rq.q) >= rq.max {
+		if rq.policy == nil {
+			return errRunQFull
+		}
+		return rq.policy.overflow(rq, m)
 	}
 	rq.q = append(rq.q, m)
+	rq.noteDepth(m)
 	return nil
 }
 
+func (rq *runq) noteDepth(m *Mach) {
+	d := len(rq.q)
+	if rq.spill != nil {
+		d += len(rq.spill.ms)
+	}
+	if d > m.stats.MaxQueueDepth {
+		m.stats.MaxQueueDepth = d
+	}
+}
+
 func (rq *runq) next() *Mach {
 	if len(rq.q) == 0 {
+		if rq.spill != nil {
+			m := rq.spill.pop()
+			if rq.spill.empty() {
+				rq.spill.close()
+				rq.spill = nil
+			}
+			return m
+		}
 		return nil
 	}
 	i := len(rq.q) - 1
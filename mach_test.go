@@ -7,18 +7,17 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func buildFilledPages(n int) []*page {
-	r := make([]*page, n)
+func buildFilledPages(n int) (pt pageTable) {
 	v := 0
 	for i := 0; i < n; i++ {
 		pg := &page{r: 1}
-		r[i] = pg
+		pt.set(uint32(i), pg)
 		for i := 0; i < len(pg.d); i++ {
 			pg.d[i] = byte(1 + v%255)
 			v++
 		}
 	}
-	return r
+	return pt
 }
 
 func TestMach_fetchBytes(t *testing.T) {
@@ -31,7 +30,7 @@ func TestMach_fetchBytes(t *testing.T) {
 				expected[i] = byte(1 + v%255)
 				v++
 			}
-			for addr, n := 0, len(m.pages)*_pageSize; addr < n; addr += stride {
+			for addr, n := 0, 3*_pageSize; addr < n; addr += stride {
 				buf := make([]byte, stride)
 				actual := buf[:m.fetchBytes(uint32(addr), buf)]
 				assert.Equal(t, []byte(expected), actual, "fetchBytes(%04x, %d)", addr, len(buf))
@@ -47,3 +46,63 @@ func TestMach_fetchBytes(t *testing.T) {
 		})
 	}
 }
+
+func TestPageTable(t *testing.T) {
+	var pt pageTable
+	idxs := []uint32{0, 1, 17, 19, 0x3ffffff, 0x100}
+	for _, i := range idxs {
+		pt.set(i, &page{r: 1, d: [_pageSize]byte{byte(i)}})
+	}
+	for _, i := range idxs {
+		if pg := pt.get(i); assert.NotNil(t, pg, "expected page %#x", i) {
+			assert.Equal(t, byte(i), pg.d[0], "expected page %#x data", i)
+		}
+	}
+	assert.Nil(t, pt.get(2), "expected no page")
+	assert.Nil(t, pt.get(0x3fffffe), "expected no page")
+
+	var seen []uint32
+	assert.NoError(t, pt.each(func(i uint32, pg *page) error {
+		seen = append(seen, i)
+		return nil
+	}))
+	assert.Equal(t, []uint32{0, 1, 17, 19, 0x100, 0x3ffffff}, seen, "expected ordered pages")
+
+	cp := pt.copy()
+	assert.Equal(t, int32(2), pt.root.r, "expected shared root")
+	assert.True(t, cp.get(17) == pt.get(17), "expected shared page")
+	cp.set(17, &page{r: 1, d: [_pageSize]byte{42}})
+	assert.Equal(t, int32(1), pt.root.r, "expected unshared root")
+	assert.Equal(t, byte(17), pt.get(17).d[0], "expected original page unchanged")
+	assert.Equal(t, byte(42), cp.get(17).d[0], "expected copy page changed")
+	assert.True(t, cp.get(0x100) == pt.get(0x100), "expected other pages still shared")
+	assert.Equal(t, int32(2), pt.get(19).r, "expected shared leaf page refs")
+
+	var diffed []uint32
+	pt.diff(cp, func(i uint32, a, b *page) {
+		diffed = append(diffed, i)
+	})
+	assert.Equal(t, []uint32{17}, diffed, "expected only the written page to differ")
+
+	var short pageTable
+	short.set(1, pt.get(1))
+	short.set(2, &page{r: 1})
+	diffed = diffed[:0]
+	pt.diff(short, func(i uint32, a, b *page) {
+		diffed = append(diffed, i)
+	})
+	assert.Equal(t, []uint32{0, 2, 17, 19, 0x100, 0x3ffffff}, diffed, "expected diff across heights")
+	cp.free()
+	assert.Equal(t, int32(1), pt.get(19).r, "expected unshared leaf page refs")
+}
+
+func TestMach_fetchBytes_sparse(t *testing.T) {
+	var m Mach
+	m.pages.set(0, &page{r: 1, d: [_pageSize]byte{_pageSize - 1: 1}})
+	m.pages.set(2, &page{r: 1, d: [_pageSize]byte{0: 2}})
+	buf := make([]byte, _pageSize+2)
+	assert.Equal(t, len(buf), m.fetchBytes(_pageSize-1, buf))
+	expected := make([]byte, len(buf))
+	expected[0], expected[len(expected)-1] = 1, 2
+	assert.Equal(t, expected, buf)
+}
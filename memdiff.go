@@ -0,0 +1,69 @@
+package stackvm
+
+import "unsafe"
+
+// WordDiff is a memory word that differs between two machines, or between a
+// machine and an earlier snapshot of its memory.
+type WordDiff struct {
+	Addr uint32
+	A, B uint32
+}
+
+// MemDiff returns every memory word that differs between two machines, in
+// address order; unallocated memory reads as zero. Pages that the machines
+// still share copy-on-write, e.g. between a machine and its fresh copy, are
+// skipped without comparing them.
+func MemDiff(a, b *Mach) []WordDiff {
+	return diffPages(a.pages, b.pages)
+}
+
+// MemSnapshot is a snapshot of a machine's memory. Since it just holds a
+// reference to the machine's page table, it's cheap to take, but will cause
+// the machine to copy any page that it then writes to while the snapshot is
+// held. Such copies are counted by the machine's PageCopies stat like any
+// other, but since they replace a page rather than allocating one, they don't
+// count against its page limit.
+type MemSnapshot struct {
+	pages pageTable
+}
+
+// MemSnapshot takes a snapshot of the machine's memory; it should be released
+// once no longer needed.
+func (m *Mach) MemSnapshot() *MemSnapshot {
+	return &MemSnapshot{m.pages.copy()}
+}
+
+// Diff returns every memory word that differs between the snapshot and the
+// machine, like MemDiff; A values are from the snapshot.
+func (s *MemSnapshot) Diff(m *Mach) []WordDiff {
+	return diffPages(s.pages, m.pages)
+}
+
+// Release releases the snapshot's hold on any shared pages.
+func (s *MemSnapshot) Release() {
+	s.pages.free()
+}
+
+func diffPages(a, b pageTable) []WordDiff {
+	var diffs []WordDiff
+	a.diff(b, func(i uint32, pa, pb *page) {
+		da, db := &zeroPageData, &zeroPageData
+		if pa != nil {
+			da = &pa.d
+		}
+		if pb != nil {
+			db = &pb.d
+		}
+		if *da == *db {
+			return
+		}
+		for off := 0; off < _pageSize; off += 4 {
+			wa := *(*uint32)(unsafe.Pointer(&da[off]))
+			wb := *(*uint32)(unsafe.Pointer(&db[off]))
+			if wa != wb {
+				diffs = append(diffs, WordDiff{i*_pageSize + uint32(off), wa, wb})
+			}
+		}
+	})
+	return diffs
+}
@@ -0,0 +1,165 @@
+package stackvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// maxInlineDepth bounds how deeply OverflowInline may nest machines, each
+// running within an op of the one before it.
+const maxInlineDepth = 1024
+
+var errInlineTooDeep = errors.New("run queue full, and inline overflow too deep")
+
+// OverflowPolicy determines what happens when a machine forks, or branches,
+// while its pending queue is full; see SetOverflowPolicy.
+type OverflowPolicy interface {
+	overflow(rq *runq, m *Mach) error
+}
+
+var (
+	// OverflowFail fails the forking machine with a "run queue full" error.
+	OverflowFail OverflowPolicy = failPolicy{}
+
+	// OverflowGrow grows the pending queue without bound.
+	OverflowGrow OverflowPolicy = growPolicy{}
+
+	// OverflowInline runs the new machine right away, depth-first, to
+	// completion; the forking machine then continues, unless handling the
+	// new machine returned an error, which fails the forking machine. Since
+	// each inlined machine runs within the forking machine's op, they may
+	// only nest 1024 deep; past that, the forking machine fails.
+	OverflowInline OverflowPolicy = inlinePolicy{}
+)
+
+// OverflowGrowTo grows the pending queue up to n machines, failing the forking
+// machine with a "run queue full" error after that.
+func OverflowGrowTo(n int) OverflowPolicy { return growPolicy{n} }
+
+// OverflowSpill spills the oldest half of the pending queue out to an
+// anonymous temporary file within dir, or the default temporary directory if
+// dir is empty. Spilled machines are reloaded, in order, once the in-memory
+// queue has been drained.
+func OverflowSpill(dir string) OverflowPolicy { return spillPolicy{dir} }
+
+type failPolicy struct{}
+
+func (failPolicy) overflow(rq *runq, m *Mach) error { return errRunQFull }
+
+type growPolicy struct{ max int }
+
+func (gp growPolicy) overflow(rq *runq, m *Mach) error {
+	if gp.max > 0 && len(rq.q) >= gp.max {
+		return errRunQFull
+	}
+	rq.q = append(rq.q, m)
+	rq.noteDepth(m)
+	return nil
+}
+
+type inlinePolicy struct{}
+
+func (inlinePolicy) overflow(rq *runq, m *Mach) error {
+	if rq.inlined >= maxInlineDepth {
+		return errInlineTooDeep
+	}
+	rq.inlined++
+	err := m.live()
+	rq.inlined--
+	m.free()
+	return err
+}
+
+type spillPolicy struct{ dir string }
+
+func (sp spillPolicy) overflow(rq *runq, m *Mach) error {
+	if rq.spill == nil {
+		f, err := ioutil.TempFile(sp.dir, "stackvm-spill")
+		if err != nil {
+			return err
+		}
+		// unlinked, so that the space is reclaimed once closed, no matter
+		// how the run ends
+		_ = os.Remove(f.Name())
+		rq.spill = &spillStack{f: f}
+	}
+	k := (len(rq.q) + 1) / 2
+	for _, sm := range rq.q[:k] {
+		if err := rq.spill.push(sm); err != nil {
+			return err
+		}
+	}
+	n := copy(rq.q, rq.q[k:])
+	for i := n; i < len(rq.q); i++ {
+		rq.q[i] = nil
+	}
+	rq.q = append(rq.q[:n], m)
+	rq.noteDepth(m)
+	return nil
+}
+
+// spillStack is a stack of machines whose pages have been written out to a
+// file; since it's a stack, the file is one too, being truncated as machines
+// are popped.
+type spillStack struct {
+	f   *os.File
+	end int64
+	ms  []spilled
+}
+
+type spilled struct {
+	m   *Mach
+	off int64
+}
+
+const spillRecSize = 4 + _pageSize
+
+func (ss *spillStack) empty() bool { return len(ss.ms) == 0 }
+
+func (ss *spillStack) close() { _ = ss.f.Close() }
+
+func (ss *spillStack) push(m *Mach) error {
+	var buf []byte
+	_ = m.pages.each(func(i uint32, pg *page) error {
+		var rec [spillRecSize]byte
+		binary.BigEndian.PutUint32(rec[:], i)
+		copy(rec[4:], pg.d[:])
+		buf = append(buf, rec[:]...)
+		return nil
+	})
+	if _, err := ss.f.WriteAt(buf, ss.end); err != nil {
+		return err
+	}
+	ss.ms = append(ss.ms, spilled{m, ss.end})
+	ss.end += int64(len(buf))
+	m.pages.free()
+	return nil
+}
+
+func (ss *spillStack) pop() *Mach {
+	i := len(ss.ms) - 1
+	sm := ss.ms[i]
+	ss.ms = ss.ms[:i]
+	m := sm.m
+
+	buf := make([]byte, ss.end-sm.off)
+	if _, err := ss.f.ReadAt(buf, sm.off); err != nil {
+		m.err = err
+		return m
+	}
+	ss.end = sm.off
+	if err := ss.f.Truncate(ss.end); err != nil {
+		m.err = err
+		return m
+	}
+
+	for ; len(buf) >= spillRecSize; buf = buf[spillRecSize:] {
+		pg := pagePool.Get().(*page)
+		pg.r = 1
+		copy(pg.d[:], buf[4:spillRecSize])
+		m.pages.set(binary.BigEndian.Uint32(buf), pg)
+	}
+	return m
+}
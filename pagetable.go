@@ -0,0 +1,251 @@
+package stackvm
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	_ptBits   = 4
+	_ptFanout = 1 << _ptBits
+	_ptMask   = _ptFanout - 1
+)
+
+var ptNodePool = sync.Pool{New: func() interface{} { return &ptNode{} }}
+
+// pageTable is a sparse radix tree mapping page numbers to pages. Its height
+// grows as needed to cover the highest page number set, so small machines
+// only pay for a single node, while the full 32-bit address space is still
+// usable.
+//
+// Tables are persistent: nodes are reference counted, so that copying a table
+// just shares its root, and any shared nodes along a path are copied before
+// it is written through (see slot). Pages are likewise shared by any leaf
+// nodes that reference them, and must be copied before being written to if
+// their own reference count is above one.
+type pageTable struct {
+	root   *ptNode
+	height uint // number of interior levels above the leaves
+}
+
+// ptNode is either an interior node, using only kids, or a leaf node, using
+// only pages.
+type ptNode struct {
+	r     int32
+	kids  [_ptFanout]*ptNode
+	pages [_ptFanout]*page
+}
+
+func newPTNode() *ptNode {
+	n := ptNodePool.Get().(*ptNode)
+	n.r = 1
+	return n
+}
+
+func (pt pageTable) covers(i uint32) bool {
+	return i>>(_ptBits*(pt.height+1)) == 0
+}
+
+func (pt pageTable) get(i uint32) *page {
+	n := pt.root
+	if n == nil || !pt.covers(i) {
+		return nil
+	}
+	for h := pt.height; h > 0; h-- {
+		n = n.kids[(i>>(_ptBits*h))&_ptMask]
+		if n == nil {
+			return nil
+		}
+	}
+	return n.pages[i&_ptMask]
+}
+
+func (pt *pageTable) set(i uint32, pg *page) {
+	*pt.slot(i) = pg
+}
+
+// slot returns a pointer to the leaf entry for page i, growing the table and
+// copying any shared nodes along the path to it as necessary, so that the
+// entry may be written. Any page already there may still be shared.
+func (pt *pageTable) slot(i uint32) **page {
+	// fast path for small, already owned, tables
+	if n := pt.root; n != nil && pt.height == 0 && i < _ptFanout && atomic.LoadInt32(&n.r) == 1 {
+		return &n.pages[i]
+	}
+	return pt.slowSlot(i)
+}
+
+func (pt *pageTable) slowSlot(i uint32) **page {
+	if pt.root == nil {
+		pt.root = newPTNode()
+		pt.height = 0
+	}
+	for !pt.covers(i) {
+		n := newPTNode()
+		n.kids[0] = pt.root
+		pt.root = n
+		pt.height++
+	}
+	n := ownPTNode(&pt.root, pt.height)
+	for h := pt.height; h > 0; h-- {
+		kid := &n.kids[(i>>(_ptBits*h))&_ptMask]
+		if *kid == nil {
+			*kid = newPTNode()
+		}
+		n = ownPTNode(kid, h-1)
+	}
+	return &n.pages[i&_ptMask]
+}
+
+// ownPTNode replaces the node pointed to by np with a copy of itself if it is
+// shared, returning the, now exclusively owned, node.
+func ownPTNode(np **ptNode, h uint) *ptNode {
+	n := *np
+	if atomic.LoadInt32(&n.r) <= 1 {
+		return n
+	}
+	c := newPTNode()
+	if h == 0 {
+		c.pages = n.pages
+		for _, pg := range c.pages {
+			if pg != nil {
+				atomic.AddInt32(&pg.r, 1)
+			}
+		}
+	} else {
+		c.kids = n.kids
+		for _, kid := range c.kids {
+			if kid != nil {
+				atomic.AddInt32(&kid.r, 1)
+			}
+		}
+	}
+	n.release(h)
+	*np = c
+	return c
+}
+
+// each calls f with every non-nil page, in page number order.
+func (pt pageTable) each(f func(i uint32, pg *page) error) error {
+	if pt.root == nil {
+		return nil
+	}
+	return pt.root.each(0, pt.height, f)
+}
+
+func (n *ptNode) each(prefix uint32, h uint, f func(i uint32, pg *page) error) error {
+	if h == 0 {
+		for j, pg := range n.pages {
+			if pg != nil {
+				if err := f(prefix<<_ptBits|uint32(j), pg); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for j, kid := range n.kids {
+		if kid != nil {
+			if err := kid.each(prefix<<_ptBits|uint32(j), h-1, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// diff calls f with every page number whose page differs, by pointer,
+// between the two tables, in page number order; either page may be nil.
+// Nodes shared by both tables are skipped without visiting their pages.
+func (pt pageTable) diff(other pageTable, f func(i uint32, a, b *page)) {
+	a, b, h := pt.root, other.root, pt.height
+	for ; h < other.height; h++ {
+		a = liftPTNode(a)
+	}
+	for hb := other.height; hb < h; hb++ {
+		b = liftPTNode(b)
+	}
+	diffPTNodes(a, b, 0, h, f)
+}
+
+// liftPTNode returns a temporary interior node over n, so that tables of
+// different heights may be walked together.
+func liftPTNode(n *ptNode) *ptNode {
+	if n == nil {
+		return nil
+	}
+	return &ptNode{kids: [_ptFanout]*ptNode{n}}
+}
+
+func diffPTNodes(a, b *ptNode, prefix uint32, h uint, f func(i uint32, a, b *page)) {
+	if a == b {
+		return
+	}
+	for j := 0; j < _ptFanout; j++ {
+		i := prefix<<_ptBits | uint32(j)
+		if h == 0 {
+			var pa, pb *page
+			if a != nil {
+				pa = a.pages[j]
+			}
+			if b != nil {
+				pb = b.pages[j]
+			}
+			if pa != pb {
+				f(i, pa, pb)
+			}
+			continue
+		}
+		var ka, kb *ptNode
+		if a != nil {
+			ka = a.kids[j]
+		}
+		if b != nil {
+			kb = b.kids[j]
+		}
+		diffPTNodes(ka, kb, i, h-1, f)
+	}
+}
+
+// copy returns a copy of the table, sharing its root node.
+func (pt pageTable) copy() pageTable {
+	if pt.root != nil {
+		atomic.AddInt32(&pt.root.r, 1)
+	}
+	return pt
+}
+
+// free releases the table's root node, leaving it empty; nodes and pages are
+// only actually freed once they're no longer shared.
+func (pt *pageTable) free() {
+	if pt.root != nil {
+		pt.root.release(pt.height)
+	}
+	*pt = pageTable{}
+}
+
+func (n *ptNode) release(h uint) {
+	if atomic.AddInt32(&n.r, -1) > 0 {
+		return
+	}
+	if h == 0 {
+		for _, pg := range n.pages {
+			if pg != nil {
+				if atomic.AddInt32(&pg.r, -1) <= 0 {
+					// pooled pages must be zero, since they back fresh
+					// allocations
+					pg.d = zeroPageData
+					pagePool.Put(pg)
+				}
+			}
+		}
+	} else {
+		for _, kid := range n.kids {
+			if kid != nil {
+				kid.release(h - 1)
+			}
+		}
+	}
+	*n = ptNode{}
+	ptNodePool.Put(n)
+}
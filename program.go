@@ -0,0 +1,373 @@
+package stackvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// ProgramMagic starts every sectioned program container; its first byte can
+// never be mistaken for a legacy header version byte.
+const ProgramMagic = "\x89SVM"
+
+const _containerVersion = 0x01
+
+// CodeVersion is the current code encoding version (see New).
+const CodeVersion = _machVersionCode
+
+// Section types within a program container; each section is encoded as its
+// type byte, a uvarint payload length, and then that many payload bytes.
+// Unknown section types are skipped when decoding.
+const (
+	sectionOptions  = 0x01 // version byte, stack size, entry offset, max pages, max addr
+	sectionCode     = 0x02 // code bytes
+	sectionData     = 0x03 // (addr, length, bytes)*
+	sectionSymbols  = 0x04 // (addr, name)*
+	sectionHalts    = 0x05 // (code, name)*
+	sectionMeta     = 0x06 // (key, value)*
+	sectionChecksum = 0x7f // CRC-32 (IEEE) of all prior bytes, must be last
+)
+
+var (
+	errNoCode          = errors.New("program has no code section")
+	errNoOptions       = errors.New("program has no options section")
+	errChecksumNotLast = errors.New("program checksum section must be last")
+)
+
+// Program is a decoded stackvm program: machine options, code, initialized
+// data, and any symbolic information that came along with them.
+type Program struct {
+	MachOptions
+
+	// Version is the encoding version of Code (see New).
+	Version byte
+
+	// Entry is the offset within Code of the first operation to run.
+	Entry uint32
+
+	// Code is loaded into memory right after the stack space.
+	Code []byte
+
+	// Data is loaded into memory, at each segment's address, after Code.
+	Data []DataSegment
+
+	// Symbols names memory addresses, e.g. assembler labels.
+	Symbols Symbols
+
+	// HaltNames names domain specific halt codes.
+	HaltNames map[uint32]string
+
+	// Meta holds arbitrary key/value metadata, like the name of the tool
+	// that built the program.
+	Meta map[string]string
+}
+
+// DataSegment is a range of initialized memory.
+type DataSegment struct {
+	Addr uint32
+	Data []byte
+}
+
+// Symbol names a memory address.
+type Symbol struct {
+	Addr uint32
+	Name string
+}
+
+// Symbols is a list of symbols, sorted by address.
+type Symbols []Symbol
+
+func (ss Symbols) Len() int           { return len(ss) }
+func (ss Symbols) Less(i, j int) bool { return ss[i].Addr < ss[j].Addr }
+func (ss Symbols) Swap(i, j int)      { ss[i], ss[j] = ss[j], ss[i] }
+
+// Lookup returns the symbol at or closest before the given address; the
+// returned boolean is false if no such symbol exists.
+func (ss Symbols) Lookup(addr uint32) (Symbol, bool) {
+	i := sort.Search(len(ss), func(i int) bool { return ss[i].Addr > addr })
+	if i == 0 {
+		return Symbol{}, false
+	}
+	return ss[i-1], true
+}
+
+// Addr returns the address of the named symbol.
+func (ss Symbols) Addr(name string) (uint32, bool) {
+	for _, s := range ss {
+		if s.Name == name {
+			return s.Addr, true
+		}
+	}
+	return 0, false
+}
+
+// DecodeProgram decodes either a sectioned program container, or a legacy
+// program whose three byte header holds just a version and stack size.
+func DecodeProgram(buf []byte) (*Program, error) {
+	if bytes.HasPrefix(buf, []byte(ProgramMagic)) {
+		return decodeContainer(buf)
+	}
+	return decodeLegacy(buf)
+}
+
+func decodeLegacy(p []byte) (*Program, error) {
+	if len(p) < 4 {
+		return nil, errors.New("program too short, need at least 4 bytes")
+	}
+	if p[0] > _machVersionCode {
+		return nil, fmt.Errorf("unsupported stackvm program version %02x", p[0])
+	}
+	return &Program{
+		MachOptions: MachOptions{StackSize: binary.BigEndian.Uint16(p[1:])},
+		Version:     p[0],
+		Code:        p[3:],
+	}, nil
+}
+
+func decodeContainer(buf []byte) (*Program, error) {
+	p := buf[len(ProgramMagic):]
+	if len(p) < 1 {
+		return nil, errors.New("program container too short")
+	}
+	if p[0] != _containerVersion {
+		return nil, fmt.Errorf("unsupported stackvm container version %02x", p[0])
+	}
+	p = p[1:]
+
+	var (
+		prog        Program
+		haveOptions bool
+		haveCode    bool
+	)
+	for len(p) > 0 {
+		start := len(buf) - len(p)
+		typ := p[0]
+		n, k := binary.Uvarint(p[1:])
+		if k <= 0 || uint64(len(p)-1-k) < n {
+			return nil, fmt.Errorf("truncated program section %#02x", typ)
+		}
+		sec := secReader{p: p[1+k : 1+k+int(n)]}
+		p = p[1+k+int(n):]
+
+		switch typ {
+		case sectionOptions:
+			prog.Version = sec.byte()
+			prog.StackSize = uint16(sec.uint(16))
+			prog.Entry = uint32(sec.uint(32))
+			if sec.more() {
+				prog.MaxPages = uint32(sec.uint(32))
+				prog.MaxAddr = uint32(sec.uint(32))
+			}
+			haveOptions = true
+
+		case sectionCode:
+			prog.Code = sec.p
+			sec.p = nil
+			haveCode = true
+
+		case sectionData:
+			for sec.more() {
+				addr := uint32(sec.uint(32))
+				data := sec.bytes()
+				prog.Data = append(prog.Data, DataSegment{addr, data})
+			}
+
+		case sectionSymbols:
+			for sec.more() {
+				addr := uint32(sec.uint(32))
+				name := sec.string()
+				prog.Symbols = append(prog.Symbols, Symbol{addr, name})
+			}
+			sort.Stable(prog.Symbols)
+
+		case sectionHalts:
+			prog.HaltNames = make(map[uint32]string)
+			for sec.more() {
+				code := uint32(sec.uint(32))
+				prog.HaltNames[code] = sec.string()
+			}
+
+		case sectionMeta:
+			prog.Meta = make(map[string]string)
+			for sec.more() {
+				key := sec.string()
+				prog.Meta[key] = sec.string()
+			}
+
+		case sectionChecksum:
+			if len(p) > 0 {
+				return nil, errChecksumNotLast
+			}
+			if len(sec.p) != 4 {
+				return nil, fmt.Errorf("invalid program checksum length %d", len(sec.p))
+			}
+			want := binary.BigEndian.Uint32(sec.p)
+			if got := crc32.ChecksumIEEE(buf[:start]); got != want {
+				return nil, fmt.Errorf("program checksum mismatch: %#08x != %#08x", got, want)
+			}
+			sec.p = nil
+		}
+
+		if sec.err != nil {
+			return nil, fmt.Errorf("invalid program section %#02x: %v", typ, sec.err)
+		}
+	}
+
+	if !haveOptions {
+		return nil, errNoOptions
+	}
+	if !haveCode {
+		return nil, errNoCode
+	}
+	if prog.Version > _machVersionCode {
+		return nil, fmt.Errorf("unsupported stackvm program version %02x", prog.Version)
+	}
+	return &prog, nil
+}
+
+type secReader struct {
+	p   []byte
+	err error
+}
+
+func (sr *secReader) more() bool { return sr.err == nil && len(sr.p) > 0 }
+
+func (sr *secReader) byte() byte {
+	if sr.err != nil {
+		return 0
+	}
+	if len(sr.p) < 1 {
+		sr.err = errors.New("truncated")
+		return 0
+	}
+	b := sr.p[0]
+	sr.p = sr.p[1:]
+	return b
+}
+
+func (sr *secReader) uvarint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	n, k := binary.Uvarint(sr.p)
+	if k <= 0 {
+		sr.err = errors.New("invalid varint")
+		return 0
+	}
+	sr.p = sr.p[k:]
+	return n
+}
+
+// uint reads a uvarint that must fit in the given number of bits.
+func (sr *secReader) uint(bits uint) uint64 {
+	n := sr.uvarint()
+	if sr.err == nil && n>>bits != 0 {
+		sr.err = fmt.Errorf("value %d overflows %d bits", n, bits)
+		return 0
+	}
+	return n
+}
+
+func (sr *secReader) bytes() []byte {
+	n := sr.uvarint()
+	if sr.err != nil {
+		return nil
+	}
+	if uint64(len(sr.p)) < n {
+		sr.err = errors.New("truncated")
+		return nil
+	}
+	b := sr.p[:n]
+	sr.p = sr.p[n:]
+	return b
+}
+
+func (sr *secReader) string() string { return string(sr.bytes()) }
+
+// Encode encodes the program as a sectioned container, ending with a
+// checksum section.
+func (prog *Program) Encode() []byte {
+	var buf, sec bytes.Buffer
+	buf.WriteString(ProgramMagic)
+	buf.WriteByte(_containerVersion)
+
+	section := func(typ byte) {
+		buf.WriteByte(typ)
+		putBytes(&buf, sec.Bytes())
+		sec.Reset()
+	}
+
+	sec.WriteByte(prog.Version)
+	putUvarint(&sec, uint64(prog.StackSize))
+	putUvarint(&sec, uint64(prog.Entry))
+	if prog.MaxPages != 0 || prog.MaxAddr != 0 {
+		putUvarint(&sec, uint64(prog.MaxPages))
+		putUvarint(&sec, uint64(prog.MaxAddr))
+	}
+	section(sectionOptions)
+
+	sec.Write(prog.Code)
+	section(sectionCode)
+
+	if len(prog.Data) > 0 {
+		for _, ds := range prog.Data {
+			putUvarint(&sec, uint64(ds.Addr))
+			putBytes(&sec, ds.Data)
+		}
+		section(sectionData)
+	}
+
+	if len(prog.Symbols) > 0 {
+		for _, s := range prog.Symbols {
+			putUvarint(&sec, uint64(s.Addr))
+			putBytes(&sec, []byte(s.Name))
+		}
+		section(sectionSymbols)
+	}
+
+	if len(prog.HaltNames) > 0 {
+		codes := make([]int, 0, len(prog.HaltNames))
+		for code := range prog.HaltNames {
+			codes = append(codes, int(code))
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			putUvarint(&sec, uint64(code))
+			putBytes(&sec, []byte(prog.HaltNames[uint32(code)]))
+		}
+		section(sectionHalts)
+	}
+
+	if len(prog.Meta) > 0 {
+		keys := make([]string, 0, len(prog.Meta))
+		for key := range prog.Meta {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			putBytes(&sec, []byte(key))
+			putBytes(&sec, []byte(prog.Meta[key]))
+		}
+		section(sectionMeta)
+	}
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf.Bytes()))
+	sec.Write(sum[:])
+	section(sectionChecksum)
+
+	return buf.Bytes()
+}
+
+func putUvarint(buf *bytes.Buffer, n uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], n)])
+}
+
+func putBytes(buf *bytes.Buffer, p []byte) {
+	putUvarint(buf, uint64(len(p)))
+	buf.Write(p)
+}
@@ -0,0 +1,132 @@
+package stackvm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errFollowCopy = errors.New("replay follows copy")
+
+// ForkPath records the fork decisions along a machine's lineage: for every
+// copy made by the machine, or by one of its ancestors before the lineage
+// split off, whether the lineage continued as the original machine (false),
+// or as its copy (true). Forks, branches, and their conditional variants all
+// count as copies.
+type ForkPath []bool
+
+// String returns a compact form of the path, which ParseForkPath reads: a
+// "p" for each step that continued as the original (parent) machine, and a
+// "c" for each that continued as the copy (child); runs of the same step are
+// prefixed with their length, so "3pc2p" is the same as "pppcpp".
+func (fp ForkPath) String() string {
+	var sb strings.Builder
+	for i := 0; i < len(fp); {
+		j := i + 1
+		for j < len(fp) && fp[j] == fp[i] {
+			j++
+		}
+		if n := j - i; n > 1 {
+			sb.WriteString(strconv.Itoa(n))
+		}
+		if fp[i] {
+			sb.WriteByte('c')
+		} else {
+			sb.WriteByte('p')
+		}
+		i = j
+	}
+	return sb.String()
+}
+
+// maxForkPathCount bounds the count of any one run of steps in a parsed
+// fork path.
+const maxForkPathCount = 1 << 20
+
+// ParseForkPath parses the string form of a ForkPath.
+func ParseForkPath(s string) (ForkPath, error) {
+	var fp ForkPath
+	n, digits := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case '0' <= c && c <= '9':
+			n, digits = 10*n+int(c-'0'), true
+			if n > maxForkPathCount {
+				return nil, fmt.Errorf("count too large in fork path %q", s)
+			}
+		case c == 'p', c == 'c':
+			if !digits {
+				n = 1
+			} else if n == 0 {
+				return nil, fmt.Errorf("invalid zero count in fork path %q", s)
+			}
+			for ; n > 0; n-- {
+				fp = append(fp, c == 'c')
+			}
+			digits = false
+		default:
+			return nil, fmt.Errorf("invalid character %q in fork path %q", c, s)
+		}
+	}
+	if digits {
+		return nil, fmt.Errorf("trailing count in fork path %q", s)
+	}
+	return fp, nil
+}
+
+// SetReplay sets the machine to follow only the given path when run: at each
+// copy along the path, the side that isn't followed is discarded rather than
+// queued. Once the path runs out, copies are queued as normal, so replaying a
+// prefix of a path explores everything under it. Since it wraps any pending
+// queue, SetReplay should be called after SetHandler.
+func (m *Mach) SetReplay(path ForkPath) {
+	ctx := m.ctx
+	if oc, ok := ctx.(observedContext); ok {
+		ctx = oc.context
+	}
+	rc := &replayContext{context: ctx, path: path}
+	if oc, ok := m.ctx.(observedContext); ok {
+		oc.context = rc
+		m.ctx = oc
+	} else {
+		m.ctx = rc
+	}
+}
+
+// replayContext follows a ForkPath, deciding which side of each copy lives on.
+type replayContext struct {
+	context
+	path ForkPath
+	i    int
+}
+
+// replaying returns true while the path still has decisions to make, i.e.
+// while copies are not being queued.
+func (rc *replayContext) replaying() bool { return rc.i < len(rc.path) }
+
+func (rc *replayContext) queue(n *Mach) error {
+	if !rc.replaying() {
+		return rc.context.queue(n)
+	}
+	follow := rc.path[rc.i]
+	rc.i++
+	if follow {
+		return errFollowCopy
+	}
+	n.free()
+	return nil
+}
+
+// queue passes a copy of the machine to its context; under replay, the
+// machine may instead continue as the copy, in which case it reports true.
+func (m *Mach) queue(n *Mach) (bool, error) {
+	if err := m.ctx.queue(n); err != errFollowCopy {
+		return false, err
+	}
+	ctx := m.ctx
+	*m, *n = *n, *m
+	m.ctx = ctx
+	n.free()
+	return true, nil
+}
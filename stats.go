@@ -0,0 +1,26 @@
+package stackvm
+
+import "time"
+
+// RunStats counts the work done by a run, across all of the machines that it
+// spawned; see (*Mach).Stats.
+type RunStats struct {
+	Ops           uint64        // operations executed
+	Forks         uint64        // machines queued by fork operations
+	Branches      uint64        // machines queued by branch operations
+	Handled       uint64        // machines passed to the result handler
+	MaxQueueDepth int           // most machines ever pending at once
+	PagesAlloced  uint64        // fresh pages allocated
+	PageCopies    uint64        // shared pages copied before being written (see MemSnapshot)
+	Elapsed       time.Duration // wall time spent in Run
+}
+
+// Stats returns statistics about the machine's most recent run, which are
+// shared by all copies made during it. Before any run, it counts only any
+// pages allocated while loading.
+func (m *Mach) Stats() RunStats {
+	if m.stats == nil {
+		return RunStats{}
+	}
+	return *m.stats
+}
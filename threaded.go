@@ -0,0 +1,687 @@
+package stackvm
+
+// threadedOp is a predecoded operation: ip is the address of the next
+// operation, and fn implements the operation with its immediate argument, if
+// any, already bound.
+type threadedOp struct {
+	ip uint32
+	fn op
+}
+
+func (prog *image) compile(m *Mach) {
+	tc := make([]threadedOp, prog.end-prog.base)
+	for ip := prog.base; ip < prog.end; {
+		oc, err := m.decode(ip)
+		if err != nil {
+			// leave any undecodable bytes to step, so that they fail
+			// only if actually executed
+			ip++
+			continue
+		}
+		if dec := opDecoders[oc.code.code()]; dec != nil {
+			tc[ip-prog.base] = threadedOp{oc.ip, dec(oc.arg, oc.code.hasImm())}
+		}
+		ip = oc.ip
+	}
+	prog.tc = tc
+}
+
+func (m *Mach) execThreaded(tc []threadedOp) {
+	base, n := m.prog.base, uint32(len(tc))
+	stats, limit := m.stats, m.opLimit()
+	for m.err == nil {
+		if stats.Ops >= limit {
+			m.err = ErrStepLimit
+			break
+		}
+		stats.Ops++
+		if k := m.ip - base; k < n {
+			if to := &tc[k]; to.fn != nil {
+				m.ip = to.ip
+				if err := to.fn(m); err != nil {
+					m.err = err
+				}
+				continue
+			}
+		}
+		m.step()
+	}
+}
+
+var opDecoders [128]opDecoder
+
+func init() {
+	for code, dec := range map[opCode]opDecoder{
+		opCodePush:    decodePush,
+		opCodePop:     decodePop,
+		opCodeDup:     decodeDup,
+		opCodeSwap:    decodeSwap,
+		opCodeFetch:   decodeFetch,
+		opCodeStore:   decodeStore,
+		opCodeStoreTo: decodeStoreTo,
+		opCodeAdd:     decodeAdd,
+		opCodeSub:     decodeSub,
+		opCodeMul:     decodeMul,
+		opCodeDiv:     decodeDiv,
+		opCodeMod:     decodeMod,
+		opCodeDivmod:  decodeDivmod,
+		opCodeNeg:     decodeNeg,
+		opCodeLt:      decodeLt,
+		opCodeLte:     decodeLte,
+		opCodeGt:      decodeGt,
+		opCodeGte:     decodeGte,
+		opCodeEq:      decodeEq,
+		opCodeNeq:     decodeNeq,
+		opCodeNot:     decodeNot,
+		opCodeAnd:     decodeAnd,
+		opCodeOr:      decodeOr,
+		opCodeCpush:   decodeCpush,
+		opCodeCpop:    decodeCpop,
+		opCodeP2c:     decodeP2c,
+		opCodeC2p:     decodeC2p,
+		opCodeMark:    decodeMark,
+		opCodeJump:    decodeJump,
+		opCodeJnz:     decodeCondJump(true),
+		opCodeJz:      decodeCondJump(false),
+		opCodeLoop:    decodeLoop,
+		opCodeLnz:     decodeCondLoop(true),
+		opCodeLz:      decodeCondLoop(false),
+		opCodeCall:    decodeCall,
+		opCodeRet:     decodeRet,
+		opCodeFork:    decodeFork,
+		opCodeFnz:     decodeCondFork(true),
+		opCodeFz:      decodeCondFork(false),
+		opCodeBranch:  decodeBranch,
+		opCodeBnz:     decodeCondBranch(true),
+		opCodeBz:      decodeCondBranch(false),
+		opCodeHalt:    decodeHalt,
+		opCodeHnz:     decodeCondHalt(true),
+		opCodeHz:      decodeCondHalt(false),
+	} {
+		opDecoders[code] = dec
+	}
+}
+
+func opNop(m *Mach) error { return nil }
+
+func decodePush(arg uint32, have bool) op {
+	if !have {
+		return opNop
+	}
+	return func(m *Mach) error { return m.push(arg) }
+}
+
+func decodePop(arg uint32, have bool) op {
+	if !have || arg == 1 {
+		return func(m *Mach) error { return m.drop() }
+	}
+	return func(m *Mach) error {
+		for i := uint32(0); i < arg; i++ {
+			if err := m.drop(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func decodeDup(arg uint32, have bool) op {
+	if !have || arg == 1 {
+		return func(m *Mach) error { return m.push(m.pa) }
+	}
+	return func(m *Mach) error {
+		p, err := m.pRef(arg)
+		if err == nil {
+			err = m.push(*p)
+		}
+		return err
+	}
+}
+
+func decodeSwap(arg uint32, have bool) op {
+	i := uint32(2)
+	if have {
+		i = 1 + arg
+	}
+	return func(m *Mach) error {
+		if m.psp == _pspInit {
+			return stackRangeError{"param", "under"}
+		}
+		p, err := m.pRef(i)
+		if err == nil {
+			m.pa, *p = *p, m.pa
+		}
+		return err
+	}
+}
+
+func decodeFetch(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			val, err := m.fetch(arg)
+			if err == nil {
+				err = m.push(val)
+			}
+			return err
+		}
+	}
+	return func(m *Mach) error {
+		addr, err := m.pop()
+		if err == nil {
+			var val uint32
+			val, err = m.fetch(addr)
+			if err == nil {
+				err = m.push(val)
+			}
+		}
+		return err
+	}
+}
+
+func decodeStore(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			addr, err := m.pop()
+			if err == nil {
+				err = m.store(addr, arg)
+			}
+			return err
+		}
+	}
+	return func(m *Mach) error {
+		val, err := m.pop()
+		if err == nil {
+			var addr uint32
+			addr, err = m.pop()
+			if err == nil {
+				err = m.store(addr, val)
+			}
+		}
+		return err
+	}
+}
+
+func decodeStoreTo(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			val, err := m.pop()
+			if err == nil {
+				err = m.store(arg, val)
+			}
+			return err
+		}
+	}
+	return func(m *Mach) error {
+		addr, err := m.pop()
+		if err == nil {
+			var val uint32
+			val, err = m.pop()
+			if err == nil {
+				err = m.store(addr, val)
+			}
+		}
+		return err
+	}
+}
+
+func decodeAdd(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa += arg
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa += b
+		}
+		return err
+	}
+}
+
+func decodeSub(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa -= arg
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa -= b
+		}
+		return err
+	}
+}
+
+func decodeMul(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa *= arg
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa *= b
+		}
+		return err
+	}
+}
+
+func decodeDiv(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa /= arg
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa /= b
+		}
+		return err
+	}
+}
+
+func decodeMod(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa = uint32(rem(int32(m.pa), int32(arg)))
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = uint32(rem(int32(m.pa), int32(b)))
+		}
+		return err
+	}
+}
+
+func decodeLt(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa = bool2uint32(m.pa < arg)
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = bool2uint32(m.pa < b)
+		}
+		return err
+	}
+}
+
+func decodeLte(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa = bool2uint32(m.pa <= arg)
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = bool2uint32(m.pa <= b)
+		}
+		return err
+	}
+}
+
+func decodeGt(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa = bool2uint32(m.pa > arg)
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = bool2uint32(m.pa > b)
+		}
+		return err
+	}
+}
+
+func decodeGte(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa = bool2uint32(m.pa >= arg)
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = bool2uint32(m.pa >= b)
+		}
+		return err
+	}
+}
+
+func decodeEq(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa = bool2uint32(m.pa == arg)
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = bool2uint32(m.pa == b)
+		}
+		return err
+	}
+}
+
+func decodeNeq(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			m.pa = bool2uint32(m.pa != arg)
+			return nil
+		}
+	}
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = bool2uint32(m.pa != b)
+		}
+		return err
+	}
+}
+
+func decodeDivmod(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error {
+			v := m.pa
+			m.pa = v / arg
+			return m.push(uint32(rem(int32(v), int32(arg))))
+		}
+	}
+	return func(m *Mach) error {
+		bp, err := m.pRef(2)
+		if err == nil {
+			b := *bp
+			v := m.pa
+			m.pa = v / b
+			*bp = uint32(rem(int32(v), int32(b)))
+		}
+		return err
+	}
+}
+
+func decodeNeg(arg uint32, have bool) op {
+	return func(m *Mach) error {
+		m.pa = -m.pa
+		return nil
+	}
+}
+
+func decodeNot(arg uint32, have bool) op {
+	return func(m *Mach) error {
+		m.pa = bool2uint32(m.pa == 0)
+		return nil
+	}
+}
+
+func decodeAnd(arg uint32, have bool) op {
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = bool2uint32((m.pa != 0) && (b != 0))
+		}
+		return err
+	}
+}
+
+func decodeOr(arg uint32, have bool) op {
+	return func(m *Mach) error {
+		b, err := m.pop()
+		if err == nil {
+			m.pa = bool2uint32((m.pa != 0) || (b != 0))
+		}
+		return err
+	}
+}
+
+func decodeCpush(arg uint32, have bool) op {
+	if !have {
+		return opNop
+	}
+	return func(m *Mach) error { return m.cpush(arg) }
+}
+
+func decodeCpop(arg uint32, have bool) op {
+	if !have {
+		return func(m *Mach) error {
+			_, err := m.cpop()
+			return err
+		}
+	}
+	return func(m *Mach) error {
+		for i := uint32(0); i < arg; i++ {
+			if _, err := m.cpop(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func decodeP2c(arg uint32, have bool) op {
+	if !have {
+		arg = 1
+	}
+	return func(m *Mach) error {
+		for i := uint32(0); i < arg; i++ {
+			val, err := m.pop()
+			if err == nil {
+				err = m.cpush(val)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func decodeC2p(arg uint32, have bool) op {
+	if !have {
+		arg = 1
+	}
+	return func(m *Mach) error {
+		for i := uint32(0); i < arg; i++ {
+			val, err := m.cpop()
+			if err == nil {
+				err = m.push(val)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func decodeMark(arg uint32, have bool) op {
+	return func(m *Mach) error { return m.cpush(m.ip) }
+}
+
+func decodeJump(arg uint32, have bool) op {
+	if have {
+		off := int32(arg)
+		return func(m *Mach) error { return m.jump(off) }
+	}
+	return func(m *Mach) error {
+		val, err := m.pop()
+		if err == nil {
+			err = m.jump(int32(val))
+		}
+		return err
+	}
+}
+
+func decodeCondJump(nz bool) opDecoder {
+	return func(arg uint32, have bool) op {
+		if have {
+			off := int32(arg)
+			return func(m *Mach) error {
+				val, err := m.pop()
+				if err == nil && (val != 0) == nz {
+					err = m.jump(off)
+				}
+				return err
+			}
+		}
+		return func(m *Mach) error {
+			val, err := m.pop()
+			if err == nil && (val != 0) == nz {
+				err = m.cjump()
+			}
+			return err
+		}
+	}
+}
+
+func decodeLoop(arg uint32, have bool) op {
+	return func(m *Mach) error { return m.loop() }
+}
+
+func decodeCondLoop(nz bool) opDecoder {
+	return func(arg uint32, have bool) op {
+		return func(m *Mach) error {
+			p, err := m.cRef(0)
+			if err != nil {
+				return err
+			}
+			val, err := m.pop()
+			if err != nil {
+				return err
+			}
+			if (val != 0) == nz {
+				return m.jumpTo(*p)
+			}
+			return m.cdrop()
+		}
+	}
+}
+
+func decodeCall(arg uint32, have bool) op {
+	if have {
+		return func(m *Mach) error { return m.call(arg) }
+	}
+	return func(m *Mach) error {
+		val, err := m.pop()
+		if err == nil {
+			err = m.call(val)
+		}
+		return err
+	}
+}
+
+func decodeRet(arg uint32, have bool) op {
+	return func(m *Mach) error { return m.ret() }
+}
+
+func decodeFork(arg uint32, have bool) op {
+	if have {
+		off := int32(arg)
+		return func(m *Mach) error { return m.fork(off) }
+	}
+	return func(m *Mach) error {
+		val, err := m.pop()
+		if err == nil {
+			err = m.fork(int32(val))
+		}
+		return err
+	}
+}
+
+func decodeCondFork(nz bool) opDecoder {
+	return func(arg uint32, have bool) op {
+		if have {
+			off := int32(arg)
+			return func(m *Mach) error {
+				val, err := m.pop()
+				if err == nil && (val != 0) == nz {
+					err = m.fork(off)
+				}
+				return err
+			}
+		}
+		return func(m *Mach) error {
+			val, err := m.pop()
+			if err == nil && (val != 0) == nz {
+				err = m.cfork()
+			}
+			return err
+		}
+	}
+}
+
+func decodeBranch(arg uint32, have bool) op {
+	if have {
+		off := int32(arg)
+		return func(m *Mach) error { return m.branch(off) }
+	}
+	return func(m *Mach) error {
+		val, err := m.pop()
+		if err == nil {
+			err = m.branch(int32(val))
+		}
+		return err
+	}
+}
+
+func decodeCondBranch(nz bool) opDecoder {
+	return func(arg uint32, have bool) op {
+		if have {
+			off := int32(arg)
+			return func(m *Mach) error {
+				val, err := m.pop()
+				if err == nil && (val != 0) == nz {
+					err = m.branch(off)
+				}
+				return err
+			}
+		}
+		return func(m *Mach) error {
+			val, err := m.pop()
+			if err == nil && (val != 0) == nz {
+				err = m.cbranch()
+			}
+			return err
+		}
+	}
+}
+
+func decodeHalt(arg uint32, have bool) op {
+	return func(m *Mach) error {
+		m.pa = arg
+		return errHalted
+	}
+}
+
+func decodeCondHalt(nz bool) opDecoder {
+	return func(arg uint32, have bool) op {
+		return func(m *Mach) error {
+			val, err := m.pop()
+			if err == nil && (val != 0) == nz {
+				m.pa = arg
+				err = errHalted
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/jcorbin/stackvm/x/dap"
+)
+
+func main() {
+	log.SetOutput(os.Stderr)
+	if err := dap.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+		log.Fatal(err)
+	}
+}
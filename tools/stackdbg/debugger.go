@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/action"
+	"github.com/jcorbin/stackvm/x/dumper"
+)
+
+type runMode int
+
+const (
+	modeStep = runMode(iota)
+	modeNext
+	modeContinue
+)
+
+type breakpoint struct {
+	spec string
+	pred action.Predicate
+}
+
+// debugger is a tracer that pauses the run to read commands, either when a
+// breakpoint matches, or when stepping the focused machine.
+type debugger struct {
+	in   *bufio.Scanner
+	out  io.Writer
+	syms stackvm.Symbols
+
+	nextID  int
+	ids     map[*stackvm.Mach]int
+	pending []*stackvm.Mach // queued, and not yet begun
+	breaks  []breakpoint
+
+	mode   runMode
+	nextIP uint32        // where a "next" should stop
+	focus  *stackvm.Mach // machine to step, or nil for whichever runs next
+	cur    *stackvm.Mach // machine being looked at
+	last   string        // last command, repeated by an empty line
+	quit   bool
+}
+
+func newDebugger(in io.Reader, out io.Writer) *debugger {
+	return &debugger{
+		in:  bufio.NewScanner(in),
+		out: out,
+		ids: make(map[*stackvm.Mach]int),
+	}
+}
+
+func (d *debugger) printf(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, format, args...)
+}
+
+func (d *debugger) id(m *stackvm.Mach) int {
+	id, def := d.ids[m]
+	if !def {
+		d.nextID++
+		id = d.nextID
+		d.ids[m] = id
+	}
+	return id
+}
+
+func (d *debugger) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	if key != "id" {
+		return nil, false
+	}
+	return d.id(m), true
+}
+
+func (d *debugger) Begin(m *stackvm.Mach) {
+	if d.syms == nil {
+		d.syms = m.Symbols()
+	}
+	for i, pm := range d.pending {
+		if pm == m {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			break
+		}
+	}
+	d.check(action.TraceBegin, m, m.IP(), stackvm.Op{})
+}
+
+func (d *debugger) Queue(m, n *stackvm.Mach) {
+	delete(d.ids, n)
+	d.id(n)
+	d.pending = append(d.pending, n)
+	if !d.quit && d.mode != modeContinue && m == d.focus {
+		d.printf("machine %d forked machine %d @%s\n", d.id(m), d.id(n), d.where(n.IP()))
+	}
+	d.check(action.TraceQueue, m, m.IP(), stackvm.Op{})
+}
+
+func (d *debugger) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	if d.quit {
+		return
+	}
+	if d.check(action.TraceBefore, m, ip, op) {
+		return
+	}
+	switch {
+	case d.mode == modeStep && (d.focus == nil || d.focus == m),
+		d.mode == modeNext && d.focus == m && ip == d.nextIP:
+		d.pause(m, "")
+	}
+}
+
+func (d *debugger) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	d.check(action.TraceAfter, m, ip, op)
+}
+
+func (d *debugger) End(m *stackvm.Mach) {
+	if d.quit || d.check(action.TraceEnd, m, m.IP(), stackvm.Op{}) {
+		return
+	}
+	if d.mode != modeContinue && d.focus == m {
+		d.pause(m, "ended")
+	}
+}
+
+func (d *debugger) Handle(m *stackvm.Mach, err error) {
+	d.check(action.TraceHandle, m, m.IP(), stackvm.Op{})
+	if d.focus == m {
+		d.focus = nil
+	}
+	if d.cur == m {
+		d.cur = nil
+	}
+	delete(d.ids, m)
+}
+
+// check pauses, and returns true, if any breakpoint matches.
+func (d *debugger) check(act action.TraceAction, m *stackvm.Mach, ip uint32, op stackvm.Op) bool {
+	if d.quit {
+		return false
+	}
+	for i, bp := range d.breaks {
+		if bp.pred.Test(m, act, ip, op) {
+			d.pause(m, fmt.Sprintf("breakpoint %d (%s) on %v", i+1, bp.spec, act))
+			return true
+		}
+	}
+	return false
+}
+
+func (d *debugger) pause(m *stackvm.Mach, why string) {
+	d.focus, d.cur = m, m
+	if why != "" {
+		d.printf("machine %d %s\n", d.id(m), why)
+	}
+	d.printCurrent()
+	d.repl()
+}
+
+// repl reads and runs commands until one resumes the run.
+func (d *debugger) repl() {
+	for {
+		d.printf("(stackdbg) ")
+		if !d.in.Scan() {
+			d.printf("\n")
+			d.quit = true
+			return
+		}
+		line := strings.TrimSpace(d.in.Text())
+		if line == "" {
+			line = d.last
+		}
+		d.last = line
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		resume, err := d.command(fields[0], fields[1:])
+		if err != nil {
+			d.printf("error: %v\n", err)
+		}
+		if resume {
+			return
+		}
+	}
+}
+
+func (d *debugger) command(name string, args []string) (resume bool, err error) {
+	switch name {
+	case "s", "step":
+		d.mode = modeStep
+		return true, nil
+
+	case "n", "next":
+		return d.next()
+
+	case "c", "continue":
+		d.mode = modeContinue
+		return true, nil
+
+	case "b", "break":
+		return false, d.addBreak(args)
+
+	case "d", "delete":
+		return false, d.deleteBreak(args)
+
+	case "breaks":
+		for i, bp := range d.breaks {
+			d.printf("%d: %s\n", i+1, bp.spec)
+		}
+
+	case "st", "stacks":
+		return false, d.printStacks()
+
+	case "x", "mem":
+		if d.cur == nil {
+			return false, errNoMachine
+		}
+		return false, dumper.Dump(d.cur, func(format string, args ...interface{}) {
+			d.printf(format+"\n", args...)
+		})
+
+	case "l", "list":
+		return false, d.list(args)
+
+	case "i", "info":
+		if d.cur == nil {
+			return false, errNoMachine
+		}
+		d.printf("machine %d: %v\n", d.id(d.cur), d.cur)
+
+	case "qu", "queue":
+		for _, m := range d.pending {
+			d.printf("machine %d @%s\n", d.id(m), d.where(m.IP()))
+		}
+
+	case "m", "machine":
+		return false, d.switchTo(args)
+
+	case "q", "quit", "exit":
+		d.quit = true
+		return true, nil
+
+	case "h", "help":
+		d.printf("%s", helpText)
+
+	default:
+		return false, fmt.Errorf("unknown command %q, try help", name)
+	}
+	return false, nil
+}
+
+const helpText = `commands:
+  s, step            run one operation of the current machine
+  n, next            like step, but steps over calls
+  c, continue        run until a breakpoint
+  b, break SPEC      break at a label, an address like @0x42, or any predicate
+  d, delete [N]      delete breakpoint N, or all of them
+  breaks             list breakpoints
+  st, stacks         print the current machine's stacks
+  x, mem             dump the current machine's memory
+  l, list [N]        disassemble N operations from the current machine's ip
+  i, info            print the current machine
+  qu, queue          list pending machines
+  m, machine ID      switch to another machine; stepping follows it
+  q, quit            stop debugging, and run to completion
+`
+
+var errNoMachine = errors.New("no current machine")
+
+func (d *debugger) next() (bool, error) {
+	if d.cur == nil {
+		return false, errNoMachine
+	}
+	op, end, err := d.cur.ReadOp(d.cur.IP())
+	if err != nil {
+		return false, err
+	}
+	if op.Name() == "call" {
+		d.mode, d.nextIP = modeNext, end
+	} else {
+		d.mode = modeStep
+	}
+	return true, nil
+}
+
+func (d *debugger) addBreak(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing breakpoint spec")
+	}
+	spec := strings.Join(args, " ")
+	pspec := spec
+	if addr, ok := d.syms.Addr(spec); ok {
+		pspec = fmt.Sprintf("before@%#x", addr)
+	} else if strings.HasPrefix(spec, "@") || strings.HasPrefix(spec, ":") {
+		pspec = "before" + spec
+	}
+	pred, err := action.ParsePredicate(pspec)
+	if err != nil {
+		return fmt.Errorf("invalid breakpoint %q: %v", spec, err)
+	}
+	d.breaks = append(d.breaks, breakpoint{spec, pred})
+	d.printf("breakpoint %d: %s\n", len(d.breaks), spec)
+	return nil
+}
+
+func (d *debugger) deleteBreak(args []string) error {
+	if len(args) == 0 {
+		d.breaks = nil
+		return nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > len(d.breaks) {
+		return fmt.Errorf("no breakpoint %d", n)
+	}
+	d.breaks = append(d.breaks[:n-1], d.breaks[n:]...)
+	return nil
+}
+
+func (d *debugger) switchTo(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing machine id")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	for m, mid := range d.ids {
+		if mid == id {
+			d.focus, d.cur = m, m
+			d.printCurrent()
+			return nil
+		}
+	}
+	return fmt.Errorf("no machine %d", id)
+}
+
+func (d *debugger) printCurrent() {
+	m := d.cur
+	if err := m.Err(); err != nil {
+		d.printf("machine %d %v\n", d.id(m), err)
+		return
+	}
+	op, _, err := m.ReadOp(m.IP())
+	if err != nil {
+		d.printf("machine %d @%s: ?? %v\n", d.id(m), d.where(m.IP()), err)
+		return
+	}
+	d.printf("machine %d @%s: %v\n", d.id(m), d.where(m.IP()), op)
+}
+
+func (d *debugger) printStacks() error {
+	if d.cur == nil {
+		return errNoMachine
+	}
+	ps, cs, err := d.cur.Stacks()
+	if err != nil {
+		return err
+	}
+	d.printf("params:  %v\ncontrol: %v\n", ps, cs)
+	return nil
+}
+
+func (d *debugger) list(args []string) error {
+	if d.cur == nil {
+		return errNoMachine
+	}
+	n := 10
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil {
+			return err
+		}
+	}
+	_, end := d.cur.CodeRange()
+	ip := d.cur.IP()
+	for i := 0; i < n && ip < end; i++ {
+		for _, sym := range d.syms {
+			if sym.Addr == ip {
+				d.printf("%s:\n", sym.Name)
+			}
+		}
+		mark := "  "
+		if ip == d.cur.IP() {
+			mark = "=>"
+		}
+		op, next, err := d.cur.ReadOp(ip)
+		if err != nil {
+			d.printf("%s @%#04x  ?? %v\n", mark, ip, err)
+			break
+		}
+		d.printf("%s @%#04x  %v\n", mark, ip, op)
+		ip = next
+	}
+	return nil
+}
+
+// where formats an address, along with its nearest label if any.
+func (d *debugger) where(ip uint32) string {
+	if sym, ok := d.syms.Lookup(ip); ok {
+		if off := ip - sym.Addr; off > 0 {
+			return fmt.Sprintf("%#04x <%s+%d>", ip, sym.Name, off)
+		}
+		return fmt.Sprintf("%#04x <%s>", ip, sym.Name)
+	}
+	return fmt.Sprintf("%#04x", ip)
+}
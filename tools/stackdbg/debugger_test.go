@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+)
+
+var debugProg = MustAssemble(
+	0x40,
+	":b", "fork",
+	1, "push",
+	"a:",
+	2, "push",
+	0, "halt",
+	"b:",
+	3, "push",
+	0, "halt",
+)
+
+func debug(t *testing.T, script ...string) string {
+	m, err := stackvm.New(debugProg)
+	require.NoError(t, err, "unexpected load error")
+	var out bytes.Buffer
+	d := newDebugger(strings.NewReader(strings.Join(script, "\n")+"\n"), &out)
+	m.SetHandler(1, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+	require.NoError(t, m.Trace(d), "unexpected run error")
+	return out.String()
+}
+
+func TestDebugger(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		script   []string
+		expected string
+	}{
+		{"step and stacks", []string{"s", "", "st", "q"}, "" +
+			"machine 1 @0x0040: +0x008 fork\n" +
+			"(stackdbg) machine 1 forked machine 2 @0x0048 <b>\n" +
+			"machine 1 @0x0042: 1 push\n" +
+			"(stackdbg) machine 1 @0x0044 <a>: 2 push\n" +
+			"(stackdbg) params:  [1]\n" +
+			"control: []\n" +
+			"(stackdbg) ",
+		},
+		{"break and continue", []string{"b a", "c", "st", "c"}, "" +
+			"machine 1 @0x0040: +0x008 fork\n" +
+			"(stackdbg) breakpoint 1: a\n" +
+			"(stackdbg) machine 1 breakpoint 1 (a) on before\n" +
+			"machine 1 @0x0044 <a>: 2 push\n" +
+			"(stackdbg) params:  [1]\n" +
+			"control: []\n" +
+			"(stackdbg) ",
+		},
+		{"queue", []string{"s", "qu", "m 2", "s", "s", "st", "q"}, "" +
+			"machine 1 @0x0040: +0x008 fork\n" +
+			"(stackdbg) machine 1 forked machine 2 @0x0048 <b>\n" +
+			"machine 1 @0x0042: 1 push\n" +
+			"(stackdbg) machine 2 @0x0048 <b>\n" +
+			"(stackdbg) machine 2 @0x0048 <b>: 3 push\n" +
+			"(stackdbg) machine 2 @0x0048 <b>: 3 push\n" +
+			"(stackdbg) machine 2 @0x004a <b+2>: 0 halt\n" +
+			"(stackdbg) params:  [3]\n" +
+			"control: []\n" +
+			"(stackdbg) ",
+		},
+		{"unknown command", []string{"nope", "quit"}, "" +
+			"machine 1 @0x0040: +0x008 fork\n" +
+			"(stackdbg) error: unknown command \"nope\", try help\n" +
+			"(stackdbg) ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, debug(t, tc.script...), "expected transcript")
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/jcorbin/stackvm"
+)
+
+func main() {
+	var (
+		queueSize int
+		breaks    []string
+		replay    string
+	)
+	flag.IntVar(&queueSize, "queue", 100, "pending machine queue size")
+	flag.Var((*stringsFlag)(&breaks), "break", "set a breakpoint before starting; may be given more than once")
+	flag.StringVar(&replay, "replay", "", "only follow this fork path, as printed by tracelog -paths")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] program\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	buf, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := stackvm.New(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	path, err := stackvm.ParseForkPath(replay)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d := newDebugger(os.Stdin, os.Stdout)
+	d.syms = m.Symbols()
+	for _, spec := range breaks {
+		if err := d.addBreak([]string{spec}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(breaks) > 0 {
+		d.mode = modeContinue
+	}
+
+	m.SetHandler(queueSize, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+		id := d.id(m)
+		if code, halted := m.HaltCode(); !halted || code != 0 {
+			fmt.Printf("machine %d: %v\n", id, m.Err())
+			return nil
+		}
+		vals, err := m.Values()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("machine %d: values=%v\n", id, vals)
+		return nil
+	}))
+	if replay != "" {
+		m.SetReplay(path)
+	}
+	if err := m.Trace(d); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string     { return fmt.Sprint(*sf) }
+func (sf *stringsFlag) Set(s string) error { *sf = append(*sf, s); return nil }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"sort"
+)
+
+// htmlSession is one session, and its children, as shown by the HTML report.
+type htmlSession struct {
+	ID      string
+	Kind    string // values, halt, or error
+	Code    string // halt code, if Kind is halt
+	Outcome string
+	Path    string
+	Log     []string
+	Kids    []*htmlSession
+}
+
+type htmlOutcome struct {
+	Kind    string
+	Outcome string
+	Count   int
+}
+
+type htmlReport struct {
+	Roots    []*htmlSession
+	Outcomes []htmlOutcome
+	Total    int
+}
+
+// writeHTML writes a self-contained HTML report of all sessions: a summary of
+// outcomes, and a collapsible tree of sessions with their op logs.
+func (ss sessions) writeHTML(w io.Writer) error {
+	var rep htmlReport
+	nodes := make(map[machID]*htmlSession, len(ss))
+	counts := make(map[string]*htmlOutcome)
+	for _, sess := range ss {
+		hs := &htmlSession{
+			ID:      sess.mid.String(),
+			Kind:    "values",
+			Outcome: "values=" + sess.values,
+			Path:    ss.forkPath(sess).String(),
+		}
+		if sess.err != "" {
+			hs.Outcome = sess.err
+			if match := haltPat.FindStringSubmatch(sess.err); match != nil {
+				hs.Kind, hs.Code = "halt", match[1]
+			} else {
+				hs.Kind = "error"
+			}
+		}
+		for _, rec := range sess.recs {
+			hs.Log = append(hs.Log, rec.String())
+		}
+		hs.Log = append(hs.Log, sess.extra...)
+		nodes[sess.mid] = hs
+
+		oc := counts[hs.Outcome]
+		if oc == nil {
+			oc = &htmlOutcome{Kind: hs.Kind, Outcome: hs.Outcome}
+			counts[hs.Outcome] = oc
+		}
+		oc.Count++
+		rep.Total++
+	}
+
+	mids := make([]machID, 0, len(ss))
+	for mid := range ss {
+		mids = append(mids, mid)
+	}
+	sort.Slice(mids, func(i, j int) bool {
+		if mids[i][0] != mids[j][0] {
+			return mids[i][0] < mids[j][0]
+		}
+		return mids[i][2] < mids[j][2]
+	})
+	for _, mid := range mids {
+		hs := nodes[mid]
+		if par := nodes[ss[mid].pid]; par != nil {
+			par.Kids = append(par.Kids, hs)
+		} else {
+			rep.Roots = append(rep.Roots, hs)
+		}
+	}
+
+	for _, oc := range counts {
+		rep.Outcomes = append(rep.Outcomes, *oc)
+	}
+	sort.Slice(rep.Outcomes, func(i, j int) bool {
+		if rep.Outcomes[i].Count != rep.Outcomes[j].Count {
+			return rep.Outcomes[i].Count > rep.Outcomes[j].Count
+		}
+		return rep.Outcomes[i].Outcome < rep.Outcomes[j].Outcome
+	})
+
+	return htmlTemplate.Execute(w, rep)
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>stackvm trace report</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+td.count { text-align: right; }
+details { margin-left: 1.5em; }
+summary { cursor: pointer; font-family: monospace; }
+pre { background: #f6f6f6; padding: 0.5em; overflow-x: auto; }
+.values > summary .outcome { color: #070; }
+.halt > summary .outcome { color: #960; }
+.error > summary .outcome { color: #c00; }
+.path, .kids { color: #888; }
+.hidden { display: none; }
+#filters { margin-bottom: 1em; }
+</style>
+</head>
+<body>
+<h1>stackvm trace report</h1>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Outcome</th><th>Machines</th></tr>
+{{- range .Outcomes}}
+<tr class="{{.Kind}}"><td>{{.Outcome}}</td><td class="count">{{.Count}}</td></tr>
+{{- end}}
+<tr><th>Total</th><td class="count">{{.Total}}</td></tr>
+</table>
+
+<h2>Sessions</h2>
+<div id="filters">
+<label>Outcome <select id="kind">
+<option value="">any</option>
+<option value="values">values</option>
+<option value="halt">halt</option>
+<option value="error">error</option>
+</select></label>
+<label>Halt code <input id="code" size="6"></label>
+</div>
+<div id="sessions">
+{{- range .Roots}}{{template "session" .}}{{end}}
+</div>
+
+<script>
+(function() {
+  var kind = document.getElementById("kind");
+  var code = document.getElementById("code");
+  function matches(el) {
+    if (kind.value && el.dataset.kind !== kind.value) return false;
+    if (code.value && el.dataset.code !== code.value) return false;
+    return true;
+  }
+  function filter() {
+    var els = document.querySelectorAll("#sessions details");
+    for (var i = els.length - 1; i >= 0; i--) {
+      var el = els[i];
+      var shown = matches(el) || el.querySelector("details:not(.hidden)") !== null;
+      el.classList.toggle("hidden", !shown);
+    }
+  }
+  kind.addEventListener("change", filter);
+  code.addEventListener("input", filter);
+})();
+</script>
+</body>
+</html>
+{{define "session"}}
+<details class="{{.Kind}}" data-kind="{{.Kind}}" data-code="{{.Code}}">
+<summary>{{.ID}} <span class="outcome">{{.Outcome}}</span> <span class="path">path={{.Path}}</span>
+{{- if .Kids}} <span class="kids">({{len .Kids}} queued)</span>{{end}}</summary>
+<pre>
+{{- range .Log}}
+{{.}}
+{{- end}}
+</pre>
+{{- range .Kids}}{{template "session" .}}{{end}}
+</details>
+{{- end}}
+`))
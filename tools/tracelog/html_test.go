@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var htmlNestPat = regexp.MustCompile(`<details class="\w+" data-kind="(\w+)" data-code="(\w*)">\n<summary>(\S+)|</details>`)
+
+func TestWriteHTML(t *testing.T) {
+	f, err := os.Open("testdata/fork.trace")
+	require.NoError(t, err, "unexpected open error")
+	defer f.Close()
+	ss, err := parseSessions(f)
+	require.NoError(t, err, "unexpected parse error")
+
+	var buf bytes.Buffer
+	require.NoError(t, ss.writeHTML(&buf), "unexpected render error")
+	out := buf.String()
+
+	assert.Contains(t, out, `<tr class="values"><td>values=[]</td><td class="count">2</td></tr>`, "expected values count")
+	assert.Contains(t, out, `<tr class="halt"><td>HALT(3)</td><td class="count">1</td></tr>`, "expected halt count")
+	assert.Contains(t, out, `<tr><th>Total</th><td class="count">3</td></tr>`, "expected total count")
+
+	var (
+		stack   []string
+		parents = make(map[string]string)
+		codes   = make(map[string]string)
+	)
+	for _, match := range htmlNestPat.FindAllStringSubmatch(out, -1) {
+		if match[0] == "</details>" {
+			require.NotEmpty(t, stack, "unbalanced details")
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		id := match[3]
+		if len(stack) > 0 {
+			parents[id] = stack[len(stack)-1]
+		} else {
+			parents[id] = ""
+		}
+		codes[id] = match[1] + ":" + match[2]
+		stack = append(stack, id)
+	}
+	assert.Empty(t, stack, "unbalanced details")
+	assert.Equal(t, map[string]string{
+		"1(0:1)": "",
+		"1(1:2)": "1(0:1)",
+		"1(2:3)": "1(1:2)",
+	}, parents, "expected session nesting")
+	assert.Equal(t, map[string]string{
+		"1(0:1)": "values:",
+		"1(1:2)": "values:",
+		"1(2:3)": "halt:3",
+	}, codes, "expected data-kind and data-code attributes")
+
+	assert.NotRegexp(t, `(?i)https?:|//[\w.-]+/|\b(src|href)=`, out, "expected a self-contained report")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -12,6 +13,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/tracer"
 )
 
 var (
@@ -52,6 +56,10 @@ const (
 )
 
 func (ss sessions) parseRecord(line []byte) (rec record, kind recordKind) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		return ss.parseJSONRecord(line)
+	}
+
 	match := linePat.FindSubmatch(line)
 	if match == nil {
 		kind = unknownLine
@@ -75,14 +83,7 @@ func (ss sessions) parseRecord(line []byte) (rec record, kind recordKind) {
 		sess.pid[0], _ = strconv.Atoi(amatch[2])
 		sess.pid[1], _ = strconv.Atoi(amatch[3])
 		sess.pid[2], _ = strconv.Atoi(amatch[4])
-		par := ss.session(sess.pid)
-		par.recs = append(par.recs, record{
-			kind:  copyLine,
-			mid:   sess.pid,
-			cid:   rec.mid,
-			count: rec.count,
-			act:   fmt.Sprintf("+++ %*v", 15, fmt.Sprintf("%v copy", rec.mid)),
-		})
+		ss.addCopy(sess, rec)
 
 	case amatch[5] != "": // end
 		rec.kind = endLine
@@ -105,7 +106,95 @@ func (ss sessions) parseRecord(line []byte) (rec record, kind recordKind) {
 	}
 
 	sess.recs = append(sess.recs, rec)
-	return
+	return rec, rec.kind
+}
+
+// parseJSONRecord parses a line written by tracer.NewJSONTracer into the same
+// records as its log tracer equivalent.
+func (ss sessions) parseJSONRecord(line []byte) (rec record, kind recordKind) {
+	var ev tracer.JSONEvent
+	if err := json.Unmarshal(line, &ev); err != nil {
+		return rec, unknownLine
+	}
+
+	rec.mid = machID(ev.ID)
+	rec.count = ev.Count
+	rec.ip = uint64(ev.IP)
+	sess := ss.session(rec.mid)
+
+	stacks := fmt.Sprintf("%v : %v", ev.PS, ev.CS)
+	switch ev.Action {
+	case "queue":
+		rec.kind = copyLine
+		rec.act = fmt.Sprintf("+++ %*v", 15, fmt.Sprintf("%v copy", machID(ev.Parent)))
+		sess.pid = machID(ev.Parent)
+		ss.addCopy(sess, rec)
+
+	case "end":
+		rec.kind = endLine
+		rec.act = "=== End"
+		if ev.Err != "" {
+			sess.err = ev.Err
+			rec.rest = "err=" + ev.Err
+		} else {
+			sess.values = fmt.Sprint(ev.Values)
+			rec.rest = "values=" + sess.values
+		}
+
+	case "handle":
+		rec.kind = hndlLine
+		rec.act = "=== Handle"
+		if ev.Err != "" {
+			rec.act = "!!! Handle"
+			rec.rest = "err=" + ev.Err
+		}
+
+	case "before":
+		rec.kind = genericLine
+		op := ev.Op
+		if ev.Arg != nil {
+			op = fmt.Sprintf("%d %s", *ev.Arg, ev.Op)
+			if o, err := stackvm.ResolveOp(ev.Op, *ev.Arg, true); err == nil {
+				op = o.String()
+			}
+		}
+		rec.act = fmt.Sprintf(">>> %*v", 15, op)
+		rec.rest = stacks
+
+	case "after":
+		rec.kind = genericLine
+		rec.act = "..."
+		rec.rest = stacks
+
+	case "begin":
+		rec.kind = genericLine
+		rec.act = "=== Begin"
+		rec.rest = stacks
+
+	default:
+		return rec, unknownLine
+	}
+
+	sess.recs = append(sess.recs, rec)
+	return rec, rec.kind
+}
+
+// addCopy adds a copy record, for the given child record, to the child's
+// parent session.
+func (ss sessions) addCopy(sess *session, rec record) {
+	par := ss.session(sess.pid)
+	var ip uint64
+	if i := len(par.recs) - 1; i >= 0 {
+		ip = par.recs[i].ip // the op that made the copy
+	}
+	par.recs = append(par.recs, record{
+		kind:  copyLine,
+		mid:   sess.pid,
+		cid:   rec.mid,
+		count: rec.count,
+		ip:    ip,
+		act:   fmt.Sprintf("+++ %*v", 15, fmt.Sprintf("%v copy", rec.mid)),
+	})
 }
 
 type sessions map[machID]*session
@@ -176,6 +265,26 @@ func (ss sessions) fullID(sess *session) string {
 	return buf.String()
 }
 
+// forkPath returns the fork decisions along the session's lineage, so that it
+// may be replayed with (*stackvm.Mach).SetReplay.
+func (ss sessions) forkPath(sess *session) stackvm.ForkPath {
+	var fp stackvm.ForkPath
+	ids := ss.idPath(sess)
+	for i, id := range ids {
+		for _, rec := range ss[id].recs {
+			if rec.kind != copyLine || rec.cid == zeroMachID {
+				continue
+			}
+			if i+1 < len(ids) && rec.cid == ids[i+1] {
+				fp = append(fp, true)
+				break
+			}
+			fp = append(fp, false)
+		}
+	}
+	return fp
+}
+
 func (ss sessions) sessionLog(sess *session, logf func(string, ...interface{})) {
 	ids := ss.idPath(sess)
 	for i, j := 0, 1; j < len(ids); i, j = i+1, j+1 {
@@ -195,6 +304,36 @@ func (ss sessions) sessionLog(sess *session, logf func(string, ...interface{}))
 	}
 }
 
+// graph builds a lineage graph of all sessions.
+func (ss sessions) graph() *tracer.Graph {
+	g := tracer.NewGraph()
+	for _, sess := range ss {
+		node := tracer.GraphNode{
+			ID:      tracer.MachID(sess.mid),
+			Parent:  tracer.MachID(sess.pid),
+			Outcome: sess.err,
+		}
+		if node.Outcome == "" {
+			node.Outcome = "values=" + sess.values
+		}
+		for _, rec := range sess.recs {
+			if strings.HasPrefix(rec.act, ">>>") {
+				node.Ops++
+			}
+		}
+		if sess.pid != zeroMachID {
+			for _, rec := range ss.session(sess.pid).recs {
+				if rec.kind == copyLine && rec.cid == sess.mid {
+					node.ForkIP = uint32(rec.ip)
+					break
+				}
+			}
+		}
+		g.Add(node)
+	}
+	return g
+}
+
 func parseSessions(r io.Reader) (sessions, error) {
 	var tail machID
 	sessions := make(sessions)
@@ -236,11 +375,21 @@ var haltPat = regexp.MustCompile(`HALT\((\d+)\)`)
 func main() {
 	var (
 		terse    bool
+		paths    bool
 		ignCodes = make(intsetFlag)
+		dotFile  string
+		htmlFile string
+		dotDepth int
+		collapse bool
 	)
 
 	flag.BoolVar(&terse, "terse", false, "don't print full session logs")
+	flag.BoolVar(&paths, "paths", false, "also print each session's fork path, which stackdbg -replay can follow")
 	flag.Var(ignCodes, "ignoreHaltCodes", "skip printing logs for session that halted with these non-zero codes")
+	flag.StringVar(&htmlFile, "html", "", "write a self-contained HTML report to this file, rather than printing logs")
+	flag.StringVar(&dotFile, "dot", "", "write the machine lineage as a Graphviz DOT graph to this file, rather than printing logs")
+	flag.IntVar(&dotDepth, "dotDepth", 0, "collapse DOT graph machines deeper than this")
+	flag.BoolVar(&collapse, "dotCollapse", false, "collapse DOT graph subtrees whose machines all had the same outcome")
 	flag.Parse()
 
 	sessions, err := parseSessions(os.Stdin)
@@ -248,6 +397,37 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if htmlFile != "" {
+		f, err := os.Create(htmlFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := sessions.writeHTML(f); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if dotFile != "" {
+		g := sessions.graph()
+		g.MaxDepth = dotDepth
+		g.CollapseOutcomes = collapse
+		f, err := os.Create(dotFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := g.WriteDOT(f); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	mids := make([]machID, 0, len(sessions))
 	for mid, sess := range sessions {
 		if match := haltPat.FindStringSubmatch(sess.err); match != nil {
@@ -266,10 +446,14 @@ func main() {
 	for _, mid := range mids {
 		sess := sessions[mid]
 		if sess.err != "" {
-			fmt.Printf("%s\terr=%v\n", sessions.fullID(sess), sess.err)
+			fmt.Printf("%s\terr=%v", sessions.fullID(sess), sess.err)
 		} else {
-			fmt.Printf("%s\tvalues=%v\n", sessions.fullID(sess), sess.values)
+			fmt.Printf("%s\tvalues=%v", sessions.fullID(sess), sess.values)
+		}
+		if paths {
+			fmt.Printf("\tpath=%v", sessions.forkPath(sess))
 		}
+		fmt.Println()
 		if !terse {
 			sessions.sessionLog(sess, func(format string, args ...interface{}) {
 				fmt.Printf("	"+format+"\n", args...)
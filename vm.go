@@ -11,7 +11,7 @@ import (
 const (
 	_pageSize        = 0x40
 	_pageMask        = _pageSize - 1
-	_machVersionCode = 0x00
+	_machVersionCode = 0x01
 	_pspInit         = 0xfffffffc
 )
 
@@ -22,6 +22,14 @@ var (
 	errNoQueue      = errors.New("no queue, cannot copy")
 	errAlignment    = errors.New("unaligned memory access")
 	errHalted       = errors.New("halted")
+
+	// ErrOutOfMemory is the fault caused by a machine crossing its memory
+	// limits (see MachOptions).
+	ErrOutOfMemory = errors.New("out of memory")
+
+	// ErrStepLimit is the fault caused by a machine reaching its run's
+	// step limit (see SetStepLimit).
+	ErrStepLimit = errors.New("step limit reached")
 )
 
 type alignmentError struct {
@@ -37,13 +45,27 @@ func (ae alignmentError) Error() string {
 type Mach struct {
 	ctx      context // execution context
 	opc      opCache // op decode cache
+	prog     *image  // loaded program, shared by all copies
 	err      error   // non-nil after termination
 	ip       uint32  // next op to decode
 	pbp, psp uint32  // param stack
 	pa       uint32  // param head
 	cbp, csp uint32  // control stack
-	// TODO track code segment and data segment
-	pages []*page // memory
+	// TODO track data segment
+	pages    pageTable // memory
+	npages   uint32    // number of allocated pages
+	maxPages uint32    // page limit, if non-zero
+	maxAddr  uint32    // highest storable address, if non-zero
+	maxOps   uint64    // run step limit, if non-zero
+	stats    *RunStats // run statistics, shared by all copies
+}
+
+type image struct {
+	version   byte              // encoding version
+	base, end uint32            // code segment
+	tc        []threadedOp      // predecoded code, if compiled
+	syms      Symbols           // symbols, if any
+	halts     map[uint32]string // halt code names, if any
 }
 
 func makeOpCache(n int) opCache {
@@ -152,13 +174,8 @@ func (m *Mach) halted() (uint32, bool) {
 func (m *Mach) run() (*Mach, error) {
 
 repeat:
-	// live
-	for m.err == nil {
-		m.step()
-	}
-
-	// win or die
-	err := m.ctx.Handle(m)
+	// live, then win or die
+	err := m.live()
 	if err == nil {
 		if n := m.ctx.next(); n != nil {
 			m.free()
@@ -172,12 +189,31 @@ repeat:
 	return m, err
 }
 
+// exec runs the machine until it ends. Ops are counted as they start, rather
+// than once the machine ends, so that the step limit holds for any machine
+// run inline by an op (see OverflowInline).
+func (m *Mach) exec() {
+	if m.prog != nil && m.prog.tc != nil {
+		m.execThreaded(m.prog.tc)
+		return
+	}
+	stats, limit := m.stats, m.opLimit()
+	for m.err == nil {
+		if stats.Ops >= limit {
+			m.err = ErrStepLimit
+			break
+		}
+		stats.Ops++
+		m.step()
+	}
+}
+
 func (m *Mach) step() {
 	// decode
 	ck := m.ip - m.cbp
 	oc, cached := m.opc.get(ck)
 	if !cached {
-		oc.ip, oc.code, oc.arg, m.err = m.read(m.ip)
+		oc, m.err = m.decode(m.ip)
 		if m.err != nil {
 			return
 		}
@@ -350,7 +386,7 @@ func (m *Mach) step() {
 	case opCodeDivmod | opCodeWithImm:
 		v := m.pa
 		m.pa = v / oc.arg
-		m.err = m.push(uint32(rem(int32(m.pa), int32(oc.arg))))
+		m.err = m.push(uint32(rem(int32(v), int32(oc.arg))))
 
 	// boolean logic
 	case opCodeLt:
@@ -385,7 +421,7 @@ func (m *Mach) step() {
 		m.err = err
 	case opCodeGte:
 		b, err := m.pop()
-		if err != nil {
+		if err == nil {
 			m.pa = bool2uint32(m.pa >= b)
 		}
 		m.err = err
@@ -393,13 +429,13 @@ func (m *Mach) step() {
 		m.pa = bool2uint32(m.pa == 0)
 	case opCodeAnd:
 		b, err := m.pop()
-		if err != nil {
+		if err == nil {
 			m.pa = bool2uint32((m.pa != 0) && (b != 0))
 		}
 		m.err = err
 	case opCodeOr:
 		b, err := m.pop()
-		if err != nil {
+		if err == nil {
 			m.pa = bool2uint32((m.pa != 0) || (b != 0))
 		}
 		m.err = err
@@ -487,7 +523,7 @@ func (m *Mach) step() {
 	case opCodeJz | opCodeWithImm:
 		val, err := m.pop()
 		if err == nil && val == 0 {
-			m.err = m.jump(int32(oc.arg))
+			err = m.jump(int32(oc.arg))
 		}
 		m.err = err
 
@@ -583,7 +619,7 @@ func (m *Mach) step() {
 		m.err = err
 	case opCodeBnz:
 		val, err := m.pop()
-		if err != nil && val != 0 {
+		if err == nil && val != 0 {
 			err = m.cbranch()
 		}
 		m.err = err
@@ -679,6 +715,26 @@ validate:
 		return
 	}
 
+	if have && m.prog != nil && m.prog.version >= 0x01 {
+		switch def.imm.kind() {
+		case opImmVal, opImmOffset:
+			arg = unzigzag(arg)
+		}
+	}
+
+	return
+}
+
+// decode reads the operation at addr for execution; unlike read, any
+// immediate offset is returned relative to the end of the operation, no
+// matter the program version.
+func (m *Mach) decode(addr uint32) (oc cachedOp, err error) {
+	oc.ip, oc.code, oc.arg, err = m.read(addr)
+	if err == nil && oc.code.hasImm() &&
+		m.prog != nil && m.prog.version >= 0x01 &&
+		ops[oc.code.code()].imm.kind() == opImmOffset {
+		oc.arg -= oc.ip - addr
+	}
 	return
 }
 
@@ -704,32 +760,14 @@ func (m *Mach) jumpTo(ip uint32) error {
 
 func (m *Mach) copy() (*Mach, error) {
 	n := machPool.Get().(*Mach)
-	pgs := n.pages
 	*n = *m
-	if cap(pgs) < len(m.pages) {
-		pgs = make([]*page, 0, len(m.pages))
-	}
-	pgs = pgs[:len(m.pages)]
-	for i, pg := range m.pages {
-		if pg != nil {
-			pgs[i] = pg
-			atomic.AddInt32(&pg.r, 1)
-		}
-	}
-	n.pages = pgs
+	n.pages = m.pages.copy()
 	return n, nil
 }
 
 func (m *Mach) free() {
-	for i, pg := range m.pages {
-		if pg != nil {
-			if atomic.AddInt32(&pg.r, -1) <= 0 {
-				pagePool.Put(pg)
-			}
-		}
-		m.pages[i] = nil
-	}
-	m.pages = m.pages[:0]
+	m.pages.free()
+	m.npages = 0
 	machPool.Put(m)
 }
 
@@ -743,7 +781,9 @@ func (m *Mach) fork(off int32) error {
 		return err
 	}
 	n.ip = ip
-	return m.ctx.queue(n)
+	m.stats.Forks++
+	_, err = m.queue(n)
+	return err
 }
 
 func (m *Mach) cfork() error {
@@ -751,6 +791,7 @@ func (m *Mach) cfork() error {
 	if err != nil {
 		return err
 	}
+	m.stats.Forks++
 	ip, err := n.cpop()
 	if err != nil {
 		return err
@@ -758,7 +799,8 @@ func (m *Mach) cfork() error {
 	if err := n.jumpTo(ip); err != nil {
 		return err
 	}
-	return m.ctx.queue(n)
+	_, err = m.queue(n)
+	return err
 }
 
 func (m *Mach) branch(off int32) error {
@@ -771,7 +813,9 @@ func (m *Mach) branch(off int32) error {
 		return err
 	}
 	m.ip = ip
-	return m.ctx.queue(n)
+	m.stats.Branches++
+	_, err = m.queue(n)
+	return err
 }
 
 func (m *Mach) cbranch() error {
@@ -779,14 +823,16 @@ func (m *Mach) cbranch() error {
 	if err != nil {
 		return err
 	}
+	m.stats.Branches++
 	ip, err := m.cpop()
 	if err != nil {
 		return err
 	}
-	if err := m.ctx.queue(n); err != nil {
+	jerr := m.jumpTo(ip)
+	if took, err := m.queue(n); err != nil || took {
 		return err
 	}
-	return m.jumpTo(ip)
+	return jerr
 }
 
 func (m *Mach) loop() error {
@@ -887,23 +933,16 @@ func (m *Mach) fetchMany(from, to uint32) ([]uint32, error) {
 }
 
 func (m *Mach) fetchBytes(addr uint32, bs []byte) (n int) {
-	var pg *page
 	i, j := addr>>6, addr&_pageMask
-	if int(i) < len(m.pages) {
-		pg = m.pages[i]
-	}
+	pg := m.pages.get(i)
 	for n < len(bs) {
 		if j > _pageMask {
 			i++
 			j &= _pageMask
-			if int(i) < len(m.pages) {
-				pg = m.pages[i]
-			} else {
-				pg = nil
-			}
+			pg = m.pages.get(i)
 		}
 		if pg == nil {
-			left := len(pg.d) - int(j) + 1
+			left := len(pg.d) - int(j)
 			if rem := len(bs) - n; rem <= left {
 				n += rem
 				break
@@ -919,34 +958,51 @@ func (m *Mach) fetchBytes(addr uint32, bs []byte) (n int) {
 	return
 }
 
-func (m *Mach) storeBytes(addr uint32, bs []byte) {
+func (m *Mach) storeBytes(addr uint32, bs []byte) error {
+	if err := m.checkStore(addr, uint32(len(bs))); err != nil {
+		return err
+	}
+
 	n := 0
-	var pg *page
 	i, j := addr>>6, addr&_pageMask
-	if int(i) < len(m.pages) {
-		pg = m.pages[i]
+	for {
+		slot := m.pages.slot(i)
+		if pg := *slot; pg == nil {
+			if err := m.alloc(); err != nil {
+				return err
+			}
+		} else if atomic.LoadInt32(&pg.r) > 1 {
+			m.stats.PageCopies++
+		}
+		pg, pgn := (*slot).storeBytes(j, bs[n:])
+		*slot = pg
+		n += pgn
+		if n >= len(bs) {
+			return nil
+		}
+		i++
+		j = 0
 	}
+}
 
-	goto doCopy
-
-nextPage:
-	i++
-	j = 0
-	if int(i) < len(m.pages) {
-		pg = m.pages[i]
-	} else {
-		pg = nil
+// checkStore returns ErrOutOfMemory if storing n bytes at addr would cross the
+// machine's address limit.
+func (m *Mach) checkStore(addr, n uint32) error {
+	if m.maxAddr != 0 && n > 0 && (addr > m.maxAddr || m.maxAddr-addr < n-1) {
+		return ErrOutOfMemory
 	}
+	return nil
+}
 
-doCopy:
-	npg, pgn := pg.storeBytes(j, bs[n:])
-	n += pgn
-	if npg != pg {
-		pg = m.setPage(i, npg)
-	}
-	if n < len(bs) {
-		goto nextPage
+// alloc accounts for a newly allocated page, returning ErrOutOfMemory if
+// the machine is already at its page limit.
+func (m *Mach) alloc() error {
+	if m.maxPages != 0 && m.npages >= m.maxPages {
+		return ErrOutOfMemory
 	}
+	m.npages++
+	m.stats.PagesAlloced++
+	return nil
 }
 
 func (m *Mach) fetch(addr uint32) (uint32, error) {
@@ -954,11 +1010,9 @@ func (m *Mach) fetch(addr uint32) (uint32, error) {
 	if off%4 != 0 {
 		return 0, alignmentError{"fetch", addr}
 	}
-	if int(i) < len(m.pages) {
-		if pg := m.pages[i]; pg != nil {
-			val := *(*uint32)(unsafe.Pointer(&(pg.d[off])))
-			return val, nil
-		}
+	if pg := m.pages.get(i); pg != nil {
+		val := *(*uint32)(unsafe.Pointer(&(pg.d[off])))
+		return val, nil
 	}
 	return 0, nil
 }
@@ -968,29 +1022,29 @@ func (m *Mach) ref(addr uint32) (*uint32, error) {
 	if off%4 != 0 {
 		return nil, alignmentError{"store", addr}
 	}
+	if err := m.checkStore(addr, 4); err != nil {
+		return nil, err
+	}
 
-	var pg *page
-	if int(i) < len(m.pages) {
-		pg = m.pages[i]
-		if pg == nil {
-			pg = pagePool.Get().(*page)
-		} else if atomic.LoadInt32(&pg.r) > 1 {
-			newPage := pagePool.Get().(*page)
-			newPage.d = pg.d
-			atomic.AddInt32(&pg.r, -1)
-			pg = newPage
-		} else {
-			goto load
+	slot := m.pages.slot(i)
+	pg := *slot
+	if pg == nil {
+		if err := m.alloc(); err != nil {
+			return nil, err
 		}
-	} else {
-		pages := make([]*page, i+1)
-		copy(pages, m.pages)
-		m.pages = pages
 		pg = pagePool.Get().(*page)
+	} else if atomic.LoadInt32(&pg.r) > 1 {
+		newPage := pagePool.Get().(*page)
+		newPage.d = pg.d
+		atomic.AddInt32(&pg.r, -1)
+		pg = newPage
+		m.stats.PageCopies++
+	} else {
+		goto load
 	}
 
 	pg.r = 1
-	m.pages[i] = pg
+	*slot = pg
 
 load:
 	p := (*uint32)(unsafe.Pointer(&(pg.d[off])))
@@ -1005,16 +1059,6 @@ func (m *Mach) store(addr, val uint32) error {
 	return err
 }
 
-func (m *Mach) setPage(i uint32, pg *page) *page {
-	if int(i) >= len(m.pages) {
-		pages := make([]*page, i+1)
-		copy(pages, m.pages)
-		m.pages = pages
-	}
-	m.pages[i] = pg
-	return pg
-}
-
 func (m *Mach) move(src, dst uint32) error {
 	val, err := m.fetch(src)
 	if err != nil {
@@ -42,3 +42,150 @@ func TestMach_basic_math(t *testing.T) {
 		},
 	}.Run(t)
 }
+
+func TestMach_basic_divmod(t *testing.T) {
+	TestCases{
+		{
+			Name: "17divmod5 leaves quotient and remainder",
+			Prog: MustAssemble(
+				0x40,
+				17, "push", 5, "divmod",
+				2, "push", "eq", 1, "hz",
+				3, "push", "eq", 2, "hz",
+				"halt",
+			),
+			Result: Result{},
+		},
+	}.Run(t)
+}
+
+func TestMach_basic_logic(t *testing.T) {
+	TestCases{
+		{
+			Name: "2gte3 should be false",
+			Prog: MustAssemble(
+				0x40,
+				2, "push", 3, "push", "gte",
+				0, "push", "eq", 1, "hz",
+				"halt",
+			),
+			Result: Result{},
+		},
+
+		{
+			Name: "1and0 should be false",
+			Prog: MustAssemble(
+				0x40,
+				1, "push", 0, "push", "and",
+				0, "push", "eq", 1, "hz",
+				"halt",
+			),
+			Result: Result{},
+		},
+
+		{
+			Name: "2or0 should be true",
+			Prog: MustAssemble(
+				0x40,
+				2, "push", 0, "push", "or",
+				1, "push", "eq", 1, "hz",
+				"halt",
+			),
+			Result: Result{},
+		},
+	}.Run(t)
+}
+
+func TestMach_basic_control(t *testing.T) {
+	TestCases{
+		{
+			Name: "jz into the stack should segfault",
+			Err:  "segfault",
+			Prog: MustAssemble(
+				0x40,
+				0, "push", -0x20, "jz",
+				"halt",
+			),
+			Result: Result{
+				Err: "segfault",
+			},
+		},
+
+		{
+			Name:      "bnz should branch",
+			QueueSize: 1,
+			Prog: MustAssemble(
+				0x40,
+				":b", "call",
+				"halt",
+				"b:",
+				1, "push", "bnz",
+				"cpop", "halt",
+			),
+			Result: Results{{}, {}},
+		},
+	}.Run(t)
+}
+
+func TestMach_basic_memory(t *testing.T) {
+	TestCases{
+		{
+			Name:      "fresh pages read as zero after others are freed",
+			QueueSize: 1,
+			Prog: MustAssemble(
+				0x40,
+				":b", "fork",
+				7, "push", 0x100, "storeTo",
+				"halt",
+				"b:",
+				1, "push", 0x104, "storeTo",
+				0x100, "fetch",
+				0, "push", "eq", 1, "hz",
+				"halt",
+			),
+			Result: Results{{}, {}},
+		},
+	}.Run(t)
+}
+
+func TestMach_program_versions(t *testing.T) {
+	TestCases{
+		{
+			Name: "version 0 countdown",
+			Prog: []byte{
+				0x00, 0x00, 0x40,
+				0x83, 0x00, // 3 push
+				0x81, 0x11, // loop: 1 sub
+				0x02,                               // dup
+				0x8f, 0xff, 0xff, 0xff, 0xf7, 0x31, // :loop jnz (-9, end relative)
+				0x80, 0x7f, // 0 halt
+			},
+			Result: Result{},
+		},
+
+		{
+			Name: "version 1 countdown",
+			Prog: []byte{
+				0x01, 0x00, 0x40,
+				0x86, 0x00, // 3 push
+				0x81, 0x10, // loop: -1 add
+				0x02,       // dup
+				0x85, 0x31, // :loop jnz (-3, start relative)
+				0x80, 0x7f, // 0 halt
+			},
+			Result: Result{},
+		},
+
+		{
+			Name: "version 1 countdown assembled",
+			Prog: MustAssemble(
+				0x40,
+				3, "push",
+				"loop:", -1, "add",
+				"dup", ":loop", "jnz",
+				0, "halt",
+			),
+			Result: Result{},
+		},
+	}.Run(t)
+}
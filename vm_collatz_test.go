@@ -129,3 +129,6 @@ var collatzExplore = TestCase{
 
 func TestMach_collatz_explore(t *testing.T)      { collatzExplore.Run(t) }
 func BenchmarkMach_collatz_explore(b *testing.B) { collatzExplore.Bench(b) }
+
+func TestMach_collatz_explore_compiled(t *testing.T)      { collatzExplore.Compiled().Run(t) }
+func BenchmarkMach_collatz_explore_compiled(b *testing.B) { collatzExplore.Compiled().Bench(b) }
@@ -0,0 +1,38 @@
+package stackvm_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/dumper"
+)
+
+func TestDump_code(t *testing.T) {
+	m, err := stackvm.New(MustAssemble(
+		0x40,
+		":f", "call",
+		0, "halt",
+		"f:",
+		1, "push",
+		"ret",
+	))
+	require.NoError(t, err, "unexpected load error")
+	require.NoError(t, m.Step(), "unexpected step error")
+
+	var lines []string
+	require.NoError(t, dumper.Dump(m, func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}), "unexpected dump error")
+	assert.Contains(t, lines,
+		"00000040  c4 36 80 7f 82 00 37 00  00 00 00 00 00 00 00 00  "+
+			"0040 @0x0044 call | 0042 0 halt <ret | 0044 1 push <ip | 0046 ret",
+		"expected annotated code")
+	assert.Contains(t, lines,
+		"00000030  00 00 00 00 00 00 00 00  00 00 00 00 42 00 00 00  [66]",
+		"expected annotated control stack")
+}
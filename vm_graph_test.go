@@ -0,0 +1,73 @@
+package stackvm_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestGraph(t *testing.T) {
+	prog := MustAssemble(
+		0x40,
+		":b", "branch",
+		1, "halt",
+		"b:",
+		":c", "fork",
+		":c", "fork",
+		2, "halt",
+		"c:",
+		":d", "fork",
+		3, "halt",
+		"d:",
+		3, "halt",
+	)
+
+	graph := func(t *testing.T, configure func(*tracer.Graph)) string {
+		m, err := stackvm.New(prog)
+		require.NoError(t, err, "unexpected load error")
+		m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+		g := tracer.NewGraph()
+		configure(g)
+		require.NoError(t, tracer.Run(m, tracer.Multi(tracer.NewIDTracer(), g)), "unexpected run error")
+		var buf bytes.Buffer
+		require.NoError(t, g.WriteDOT(&buf), "unexpected write error")
+		out := buf.String()
+		assert.True(t, strings.HasPrefix(out, "digraph stackvm {\n"), "expected a digraph")
+		assert.True(t, strings.HasSuffix(out, "}\n"), "expected the digraph to end")
+		return out
+	}
+
+	t.Run("full", func(t *testing.T) {
+		out := graph(t, func(*tracer.Graph) {})
+		assert.Contains(t, out, `"1(0:1)" [label="1(0:1)\n4 ops\nHALT(2)"];`)
+		assert.Contains(t, out, `"1(0:1)" -> "1(1:2)" [label="@0x0040"];`)
+		assert.Contains(t, out, `"1(1:2)" [label="1(1:2)\n1 ops\nHALT(1)"];`)
+		assert.Contains(t, out, `"1(0:1)" -> "1(1:3)" [label="@0x0044"];`)
+		assert.Contains(t, out, `"1(0:1)" -> "1(1:4)" [label="@0x0046"];`)
+		assert.Contains(t, out, `"1(1:3)" -> "1(3:6)" [label="@0x004a"];`)
+		assert.Equal(t, 4, strings.Count(out, "HALT(3)"), "expected four machines to halt with 3")
+	})
+
+	t.Run("depth", func(t *testing.T) {
+		out := graph(t, func(g *tracer.Graph) { g.MaxDepth = 2 })
+		assert.NotContains(t, out, "more machines", "expected nothing to collapse")
+		out = graph(t, func(g *tracer.Graph) { g.MaxDepth = 1 })
+		assert.Contains(t, out, `"1(1:3)+" [label="1 more machines\n1× HALT(3)", style=dashed];`)
+		assert.Contains(t, out, `"1(1:3)" -> "1(1:3)+";`)
+		assert.NotContains(t, out, `"1(3:6)"`, "expected collapsed machines")
+	})
+
+	t.Run("outcomes", func(t *testing.T) {
+		out := graph(t, func(g *tracer.Graph) { g.CollapseOutcomes = true })
+		assert.Contains(t, out, `"1(0:1)" [label="1(0:1)\n4 ops\nHALT(2)"];`, "expected mixed outcomes to stay")
+		assert.Contains(t, out, `"1(1:3)" [label="1(1:3)\n2 machines\nHALT(3)", style=dashed];`)
+		assert.NotContains(t, out, `"1(3:6)"`, "expected collapsed machines")
+	})
+}
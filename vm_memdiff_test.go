@@ -0,0 +1,94 @@
+package stackvm_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/dumper"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+var memDiffProg = MustAssemble(
+	0x40,
+	5, "push", 0x100, "storeTo",
+	7, "push", 0x104, "storeTo",
+	0, "halt",
+)
+
+func TestMemDiff(t *testing.T) {
+	a, err := stackvm.New(memDiffProg)
+	require.NoError(t, err, "unexpected load error")
+	b, err := stackvm.New(memDiffProg)
+	require.NoError(t, err, "unexpected load error")
+	assert.Empty(t, stackvm.MemDiff(a, b), "expected no difference after load")
+
+	require.NoError(t, b.Step(), "unexpected step error")
+	require.NoError(t, b.Step(), "unexpected step error")
+	assert.Equal(t, []stackvm.WordDiff{
+		{Addr: 0x100, A: 0, B: 5},
+	}, stackvm.MemDiff(a, b), "expected the store")
+
+	snap := b.MemSnapshot()
+	assert.Empty(t, snap.Diff(b), "expected no difference from a fresh snapshot")
+	require.NoError(t, b.Step(), "unexpected step error")
+	require.NoError(t, b.Step(), "unexpected step error")
+	assert.Equal(t, []stackvm.WordDiff{
+		{Addr: 0x104, A: 0, B: 7},
+	}, snap.Diff(b), "expected changes since the snapshot")
+	snap.Release()
+
+	var lines []string
+	require.NoError(t, dumper.DumpDiff(a, b, func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}), "unexpected dump error")
+	assert.Equal(t, []string{
+		"-00000100  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00",
+		"+00000100  05 00 00 00 07 00 00 00  00 00 00 00 00 00 00 00",
+	}, lines, "expected only the changed line")
+}
+
+func TestMemDiffTracer(t *testing.T) {
+	m, err := stackvm.New(memDiffProg)
+	require.NoError(t, err, "unexpected load error")
+	var lines []string
+	require.NoError(t, tracer.Run(m, tracer.Multi(
+		tracer.NewIDTracer(),
+		tracer.NewCountTracer(),
+		tracer.NewMemDiffTracer(func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}),
+	)), "unexpected run error")
+	assert.Equal(t, []string{
+		"1(0:1) #   2 @0x0042 @0x0100 storeTo [0x0100] 0 -> 5",
+		"1(0:1) #   4 @0x0047 @0x0104 storeTo [0x0104] 0 -> 7",
+	}, lines, "expected memory diffs")
+}
+
+func TestMemDiffTracer_pages(t *testing.T) {
+	run := func(trace bool) *stackvm.Mach {
+		m := loadLimited(t,
+			stackvm.MachOptions{StackSize: 0x40, MaxPages: 4},
+			0x100, "push", 1, "store",
+			0x104, "push", 2, "store",
+			0x140, "push", 1, "store",
+			0x180, "push", 1, "store",
+			0, "halt",
+		)
+		if trace {
+			require.NoError(t, m.Trace(tracer.NewMemDiffTracer(func(string, ...interface{}) {})), "unexpected run error")
+		} else {
+			require.NoError(t, m.Run(), "unexpected run error")
+		}
+		return m
+	}
+	m, tm := run(false), run(true)
+	assert.Equal(t, 4, tm.PageCount(), "expected page count")
+	assert.Equal(t, m.Stats().PagesAlloced, tm.Stats().PagesAlloced, "expected the same allocations")
+	assert.Zero(t, m.Stats().PageCopies, "expected no copies when untraced")
+	assert.NotZero(t, tm.Stats().PageCopies, "expected snapshots to force copies")
+}
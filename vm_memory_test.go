@@ -0,0 +1,86 @@
+package stackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+)
+
+func loadLimited(t *testing.T, opts stackvm.MachOptions, in ...interface{}) *stackvm.Mach {
+	prog, err := stackvm.DecodeProgram(MustAssemble(append([]interface{}{opts}, in...)...))
+	require.NoError(t, err, "unexpected decode error")
+	m, err := stackvm.Load(prog)
+	require.NoError(t, err, "unexpected load error")
+	return m
+}
+
+func TestMach_memoryLimits(t *testing.T) {
+	t.Run("max addr", func(t *testing.T) {
+		m := loadLimited(t,
+			stackvm.MachOptions{StackSize: 0x40, MaxAddr: 0xffff},
+			0xfffc, "push", 1, "store",
+			0xfffffff0, "push", 1, "store",
+			0, "halt",
+		)
+		err := m.Run()
+		if me, ok := err.(stackvm.MachError); assert.True(t, ok, "expected a MachError") {
+			assert.Equal(t, stackvm.ErrOutOfMemory, me.Cause(), "expected out of memory")
+		}
+		assert.True(t, m.PageCount() < 8, "expected only a few pages, got %d", m.PageCount())
+	})
+
+	t.Run("max pages", func(t *testing.T) {
+		m := loadLimited(t,
+			stackvm.MachOptions{StackSize: 0x40, MaxPages: 3},
+			0x100, "push", 1, "store",
+			0x140, "push", 1, "store",
+			0x180, "push", 1, "store",
+			0, "halt",
+		)
+		err := m.Run()
+		if me, ok := err.(stackvm.MachError); assert.True(t, ok, "expected a MachError") {
+			assert.Equal(t, stackvm.ErrOutOfMemory, me.Cause(), "expected out of memory")
+		}
+		assert.Equal(t, 3, m.PageCount(), "expected page count")
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		m := loadLimited(t,
+			stackvm.MachOptions{StackSize: 0x40},
+			0x100, "push", 1, "store",
+			0x140, "push", 1, "store",
+			0x180, "push", 1, "store",
+			0, "halt",
+		)
+		assert.NoError(t, m.Run(), "unexpected run error")
+		assert.Equal(t, 4, m.PageCount(), "expected page count")
+	})
+
+	t.Run("high address", func(t *testing.T) {
+		m := loadLimited(t,
+			stackvm.MachOptions{StackSize: 0x40},
+			0xfffffff0, "push", 1, "store",
+			0, "halt",
+		)
+		assert.NoError(t, m.Run(), "unexpected run error")
+		assert.Equal(t, 2, m.PageCount(), "expected page count")
+		var buf [4]byte
+		m.MemCopy(0xfffffff0, buf[:])
+		assert.Equal(t, [4]byte{1, 0, 0, 0}, buf, "expected stored value")
+	})
+
+	t.Run("code too big", func(t *testing.T) {
+		prog, err := stackvm.DecodeProgram(MustAssemble(
+			stackvm.MachOptions{StackSize: 0x40, MaxAddr: 0x40},
+			0x100, "push", 1, "store",
+			0, "halt",
+		))
+		require.NoError(t, err, "unexpected decode error")
+		_, err = stackvm.Load(prog)
+		assert.EqualError(t, err, "unable to load code: out of memory")
+	})
+}
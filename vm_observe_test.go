@@ -0,0 +1,133 @@
+package stackvm_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/action"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+type countObserver struct {
+	begin, end, queue, handle int
+}
+
+func (co *countObserver) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	if key != "counts" {
+		return nil, false
+	}
+	return *co, true
+}
+
+func (co *countObserver) Begin(m *stackvm.Mach)             { co.begin++ }
+func (co *countObserver) End(m *stackvm.Mach)               { co.end++ }
+func (co *countObserver) Queue(m, n *stackvm.Mach)          { co.queue++ }
+func (co *countObserver) Handle(m *stackvm.Mach, err error) { co.handle++ }
+
+func TestMach_Observe(t *testing.T) {
+	m, err := stackvm.New(collatzExplore.Prog)
+	require.NoError(t, err)
+
+	var co countObserver
+	var vals [][][]uint32
+	m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+		assert.Equal(t, m.Observer(), &co, "expected observer")
+		assert.Nil(t, m.Tracer(), "expected no tracer")
+		if _, ok := m.Observer().Context(m, "counts"); !assert.True(t, ok, "expected observer context") {
+			return nil
+		}
+		if code, halted := m.HaltCode(); halted && code == 0 {
+			vs, err := m.Values()
+			if err != nil {
+				return err
+			}
+			vals = append(vals, vs)
+		}
+		return nil
+	}))
+	require.NoError(t, m.Observe(&co))
+
+	assert.Equal(t, 4, len(vals), "expected results")
+	assert.True(t, co.begin > len(vals), "expected more machines than results")
+	assert.Equal(t, co.begin, co.end, "expected an End for each Begin")
+	assert.Equal(t, co.begin, co.handle, "expected a Handle for each Begin")
+	assert.Equal(t, co.begin-1, co.queue, "expected a Queue for each copy")
+}
+
+func TestMach_Trace_json(t *testing.T) {
+	m, err := stackvm.New(collatzExplore.Prog)
+	require.NoError(t, err)
+	m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+
+	var buf bytes.Buffer
+	require.NoError(t, tracer.Run(m, tracer.Multi(
+		tracer.NewIDTracer(),
+		tracer.NewCountTracer(),
+		tracer.NewJSONTracer(&buf),
+	)))
+
+	acts := make(map[string]int)
+	var vals [][][]uint32
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var ev tracer.JSONEvent
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &ev), "invalid event %q", sc.Bytes())
+		acts[ev.Action]++
+		assert.NotZero(t, ev.ID, "expected a machine id")
+		switch ev.Action {
+		case "queue":
+			assert.NotZero(t, ev.Parent, "expected a parent id")
+		case "before":
+			assert.NotEmpty(t, ev.Op, "expected an op")
+		case "end":
+			if ev.Err == "" {
+				vals = append(vals, ev.Values)
+			}
+		}
+	}
+	require.NoError(t, sc.Err())
+
+	assert.Equal(t, 4, len(vals), "expected results")
+	assert.Equal(t, acts["begin"], acts["end"], "expected an end for each begin")
+	assert.Equal(t, acts["begin"]-1, acts["queue"], "expected a queue for each copy")
+	assert.Equal(t, acts["before"]-acts["end"], acts["after"], "expected an after for each non-final before")
+	assert.Equal(t, int(m.Stats().Ops), acts["before"], "expected a before for each op")
+}
+
+func TestMach_Observe_multi(t *testing.T) {
+	p, err := action.ParsePredicate("begin")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		obs    stackvm.Observer
+		tracer bool
+	}{
+		{"multi observers", tracer.Multi(tracer.NewIDTracer(), tracer.NewPathTracer()), false},
+		{"multi tracer", tracer.Multi(tracer.NewIDTracer(), tracer.NewCountTracer()), true},
+		{"filtered observer", tracer.Filtered(tracer.NewIDTracer(), p), false},
+		{"filtered tracer", tracer.Filtered(tracer.NewCountTracer(), p), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, isTracer := tc.obs.(stackvm.Tracer)
+			assert.Equal(t, tc.tracer, isTracer, "expected tracer-ness")
+
+			m, err := stackvm.New(collatzExplore.Prog)
+			require.NoError(t, err)
+			n := 0
+			m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+				n++
+				assert.Equal(t, tc.tracer, m.Tracer() != nil, "expected tracer")
+				return nil
+			}))
+			require.NoError(t, tracer.Run(m, tc.obs))
+			assert.True(t, n > 0, "expected handled machines")
+		})
+	}
+}
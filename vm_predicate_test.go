@@ -0,0 +1,68 @@
+package stackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/action"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestPredicate_trace(t *testing.T) {
+	prog := MustAssemble(
+		0x40,
+		":b", "fork",
+		1, "push", 2, "push", "add",
+		0, "halt",
+		"b:",
+		3, "push", "pop",
+		5, "push", 0x100, "storeTo",
+		0, "halt",
+	)
+
+	for _, tc := range []struct {
+		pred     string
+		expected []string
+	}{
+		{"before && :push", []string{
+			"1(0:1) push", "1(0:1) push", "1(1:2) push", "1(1:2) push",
+		}},
+		{"before && !:push && !:halt", []string{
+			"1(0:1) fork", "1(0:1) add", "1(1:2) pop", "1(1:2) storeTo",
+		}},
+		{"before && id=1(1:*)", []string{
+			"1(1:2) push", "1(1:2) pop", "1(1:2) push", "1(1:2) storeTo", "1(1:2) halt",
+		}},
+		{"before@0x49..0x4b", []string{
+			"1(1:2) push", "1(1:2) pop",
+		}},
+		{"before && ps>=2", []string{"1(0:1) add"}},
+		{"before && ps=1 && id=1(0:1)", []string{"1(0:1) push", "1(0:1) halt"}},
+		{"before && count>4", []string{"1(0:1) halt", "1(1:2) storeTo", "1(1:2) halt"}},
+		{"before && mem[0x100]=5", []string{"1(1:2) halt"}},
+	} {
+		t.Run(tc.pred, func(t *testing.T) {
+			pred, err := action.ParsePredicate(tc.pred)
+			require.NoError(t, err, "unexpected parse error")
+			var seen []string
+			m, err := stackvm.New(prog)
+			require.NoError(t, err, "unexpected load error")
+			m.SetHandler(1, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+			require.NoError(t, tracer.Run(m, tracer.Multi(
+				tracer.NewIDTracer(),
+				tracer.NewCountTracer(),
+				tracer.Filtered(tracer.FuncTracer(func(m *stackvm.Mach) {
+					mid, _ := m.Observer().Context(m, "id")
+					op, _, err := m.ReadOp(m.IP())
+					require.NoError(t, err, "unexpected op read error")
+					seen = append(seen, mid.(tracer.MachID).String()+" "+op.Name())
+				}), pred),
+			)), "unexpected run error")
+			assert.Equal(t, tc.expected, seen, "expected filtered ops")
+		})
+	}
+}
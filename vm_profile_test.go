@@ -0,0 +1,75 @@
+package stackvm_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestProfiler(t *testing.T) {
+	m, err := stackvm.New(smmTest.Prog)
+	require.NoError(t, err, "unexpected load error")
+	m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+	prof := tracer.NewProfiler()
+	require.NoError(t, m.Trace(prof), "unexpected run error")
+	stats := m.Stats()
+
+	var ops, forks int64
+	for _, c := range prof.ByIP() {
+		ops += c.Ops
+		forks += c.Forks
+	}
+	assert.Equal(t, int64(stats.Ops), ops, "expected every op counted")
+	assert.Equal(t, int64(stats.Forks+stats.Branches), forks, "expected every fork counted")
+
+	byLabel := prof.ByLabel()
+	assert.True(t, byLabel["chooseLoop"].Forks > 0, "expected forks within chooseLoop")
+	assert.True(t, byLabel["markUsed"].Ops > 0, "expected ops within markUsed")
+
+	var buf bytes.Buffer
+	n, err := prof.WriteTo(&buf)
+	require.NoError(t, err, "unexpected profile write error")
+	assert.Equal(t, int64(buf.Len()), n, "expected written byte count")
+	assert.Equal(t, []byte{0x1f, 0x8b}, buf.Bytes()[:2], "expected gzip output")
+
+	gz, err := gzip.NewReader(&buf)
+	require.NoError(t, err, "unexpected gzip error")
+	pb, err := ioutil.ReadAll(gz)
+	require.NoError(t, err, "unexpected gunzip error")
+	var (
+		strs       []string
+		defaultTyp uint64
+	)
+	for len(pb) > 0 {
+		key, n := binary.Uvarint(pb)
+		require.True(t, n > 0, "invalid field key")
+		pb = pb[n:]
+		val, n := binary.Uvarint(pb)
+		require.True(t, n > 0, "invalid field value")
+		pb = pb[n:]
+		switch key & 7 {
+		case 0:
+			if key>>3 == 14 {
+				defaultTyp = val
+			}
+		case 2:
+			if key>>3 == 6 {
+				strs = append(strs, string(pb[:val]))
+			}
+			pb = pb[val:]
+		default:
+			require.Fail(t, "unexpected wire type", "in field key %#x", key)
+		}
+	}
+	if assert.True(t, defaultTyp < uint64(len(strs)), "expected a default sample type") {
+		assert.Equal(t, "ops", strs[defaultTyp], "expected ops to be the default sample type")
+	}
+}
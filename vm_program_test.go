@@ -0,0 +1,124 @@
+package stackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+)
+
+func TestProgram_roundTrip(t *testing.T) {
+	prog := stackvm.Program{
+		MachOptions: stackvm.MachOptions{
+			StackSize: 0x40,
+			MaxPages:  16,
+			MaxAddr:   0x3ff,
+		},
+		Version: stackvm.CodeVersion,
+		Entry:   2,
+		Code:    []byte{0x7f, 0x7f, 0x84, 0x08, 0x80, 0x7f},
+		Data: []stackvm.DataSegment{
+			{Addr: 0x100, Data: []byte{42, 0, 0, 0}},
+		},
+		Symbols: stackvm.Symbols{
+			{Addr: 0x40, Name: "dead"},
+			{Addr: 0x42, Name: "main"},
+		},
+		HaltNames: map[uint32]string{1: "nope"},
+		Meta:      map[string]string{"source": "test"},
+	}
+	buf := prog.Encode()
+
+	dec, err := stackvm.DecodeProgram(buf)
+	require.NoError(t, err, "unexpected decode error")
+	assert.Equal(t, &prog, dec, "expected same program")
+
+	buf[len(buf)-8] ^= 0xff
+	_, err = stackvm.DecodeProgram(buf)
+	assert.Error(t, err, "expected checksum error")
+}
+
+func TestProgram_optionRanges(t *testing.T) {
+	container := func(opts ...byte) []byte {
+		buf := []byte(stackvm.ProgramMagic)
+		buf = append(buf, 0x01)
+		buf = append(buf, 0x01, byte(len(opts)))
+		buf = append(buf, opts...)
+		return append(buf, 0x02, 0x01, 0x7f)
+	}
+
+	prog, err := stackvm.DecodeProgram(container(0x01, 0xff, 0xff, 0x03, 0x00))
+	require.NoError(t, err, "unexpected decode error")
+	assert.Equal(t, uint16(0xffff), prog.StackSize, "expected the largest stack size")
+
+	for _, tc := range []struct {
+		name string
+		opts []byte
+	}{
+		{"stack size", []byte{0x01, 0x80, 0x80, 0x04, 0x00}},
+		{"entry", []byte{0x01, 0x40, 0x80, 0x80, 0x80, 0x80, 0x10}},
+		{"max pages", []byte{0x01, 0x40, 0x00, 0x80, 0x80, 0x80, 0x80, 0x10, 0x00}},
+		{"max addr", []byte{0x01, 0x40, 0x00, 0x00, 0x80, 0x80, 0x80, 0x80, 0x10}},
+	} {
+		_, err := stackvm.DecodeProgram(container(tc.opts...))
+		assert.Error(t, err, "expected an out of range %s error", tc.name)
+	}
+}
+
+func TestProgram_load(t *testing.T) {
+	asm, err := stackvm.DecodeProgram(MustAssemble(
+		0x40,
+		1, "halt", // dead code before the entry point
+		0x100, "fetch", 42, "eq", 1, "hz",
+		0, "halt",
+	))
+	require.NoError(t, err, "unexpected decode error")
+
+	prog := stackvm.Program{
+		MachOptions: stackvm.MachOptions{StackSize: 0x40},
+		Version:     stackvm.CodeVersion,
+		Entry:       2,
+		Code:        asm.Code,
+		Data: []stackvm.DataSegment{
+			{Addr: 0x100, Data: []byte{42, 0, 0, 0}},
+		},
+		Symbols: stackvm.Symbols{
+			{Addr: 0x40, Name: "dead"},
+			{Addr: 0x42, Name: "main"},
+		},
+		HaltNames: map[uint32]string{1: "no answer"},
+	}
+
+	m, err := stackvm.New(prog.Encode())
+	require.NoError(t, err, "unexpected load error")
+	assert.Equal(t, prog.Symbols, m.Symbols(), "expected symbols")
+	if sym, ok := m.Symbols().Lookup(0x45); assert.True(t, ok, "expected symbol") {
+		assert.Equal(t, "main", sym.Name, "expected nearest symbol")
+	}
+	if name, ok := m.HaltName(1); assert.True(t, ok, "expected halt name") {
+		assert.Equal(t, "no answer", name)
+	}
+	assert.NoError(t, m.Run(), "unexpected run error")
+
+	prog.Data[0].Data[0] = 7
+	m, err = stackvm.Load(&prog)
+	require.NoError(t, err, "unexpected load error")
+	assert.EqualError(t, m.Run(), "@0x0049: HALT(1)", "expected run error")
+	assert.Contains(t, m.String(), "HALT:1(no answer)")
+}
+
+func TestProgram_legacy(t *testing.T) {
+	prog, err := stackvm.DecodeProgram([]byte{0x00, 0x00, 0x40, 0x80, 0x7f})
+	require.NoError(t, err, "unexpected decode error")
+	assert.Equal(t, &stackvm.Program{
+		MachOptions: stackvm.MachOptions{StackSize: 0x40},
+		Version:     0x00,
+		Code:        []byte{0x80, 0x7f},
+	}, prog)
+
+	_, err = stackvm.DecodeProgram([]byte{0x02, 0x00, 0x40, 0x80, 0x7f})
+	assert.EqualError(t, err, "unsupported stackvm program version 02")
+}
@@ -0,0 +1,141 @@
+package stackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+)
+
+// overflowing returns a copy of the test case with a queue far too small for
+// its forks, using the given overflow policy.
+func overflowing(tc TestCase, name string, p stackvm.OverflowPolicy) TestCase {
+	tc.Name = name
+	tc.QueueSize = 1
+	tc.Overflow = p
+	return tc
+}
+
+func TestMach_queueOverflow(t *testing.T) {
+	for _, tc := range []TestCase{
+		overflowing(smmTest, "smm grow", stackvm.OverflowGrow),
+		overflowing(smmTest, "smm grow to", stackvm.OverflowGrowTo(64)),
+		overflowing(smmTest, "smm spill", stackvm.OverflowSpill("")),
+		overflowing(smmTest, "smm inline", stackvm.OverflowInline),
+		overflowing(smmTest, "smm inline", stackvm.OverflowInline).Compiled(),
+		overflowing(collatzExplore, "collatz grow", stackvm.OverflowGrow),
+		overflowing(collatzExplore, "collatz spill", stackvm.OverflowSpill("")),
+		overflowing(collatzExplore, "collatz spill", stackvm.OverflowSpill("")).Compiled(),
+	} {
+		t.Run(tc.Name, tc.Run)
+	}
+
+}
+
+func TestMach_queueOverflow_fail(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		p    stackvm.OverflowPolicy
+	}{
+		{"default", nil},
+		{"fail", stackvm.OverflowFail},
+		{"grow to cap", stackvm.OverflowGrowTo(2)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := stackvm.New(smmTest.Prog)
+			require.NoError(t, err, "unexpected load error")
+			m.SetHandler(1, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+				if _, halted := m.HaltCode(); !halted {
+					return m.Err()
+				}
+				return nil
+			}))
+			if c.p != nil {
+				require.NoError(t, m.SetOverflowPolicy(c.p), "unexpected policy error")
+			}
+			err = m.Run()
+			if assert.Error(t, err, "expected run error") {
+				assert.Contains(t, err.Error(), "run queue full")
+			}
+		})
+	}
+}
+
+func TestMach_queueOverflow_inline(t *testing.T) {
+	// inline runs forks depth-first, so results come out in a different
+	// order than when queued
+	run := func(p stackvm.OverflowPolicy) (vals [][][]uint32) {
+		m, err := stackvm.New(collatzExplore.Prog)
+		require.NoError(t, err, "unexpected load error")
+		m.SetHandler(1, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+			if code, halted := m.HaltCode(); !halted {
+				return m.Err()
+			} else if code == 0 {
+				vs, err := m.Values()
+				if err != nil {
+					return err
+				}
+				vals = append(vals, vs)
+			}
+			return nil
+		}))
+		require.NoError(t, m.SetOverflowPolicy(p), "unexpected policy error")
+		require.NoError(t, m.Run(), "unexpected run error")
+		return vals
+	}
+
+	expected := run(stackvm.OverflowGrow)
+	assert.Equal(t, 4, len(expected), "expected results")
+	assert.ElementsMatch(t, expected, run(stackvm.OverflowInline), "expected same results")
+}
+
+func TestMach_queueOverflow_inlineDepth(t *testing.T) {
+	// every copy forks again, and with no room to queue any of them, each
+	// is inlined within the last
+	chain := func(n int) []byte {
+		return MustAssemble(
+			0x40,
+			n, "push",
+			"loop:",
+			"dup", ":done", "jz",
+			-1, "add",
+			":loop", "fork",
+			"done:",
+			"halt",
+		)
+	}
+	run := func(n int) (halts int, errs []error) {
+		m, err := stackvm.New(chain(n))
+		require.NoError(t, err, "unexpected load error")
+		m.SetHandler(0, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+			if err := m.Err(); err != nil {
+				errs = append(errs, err)
+			} else {
+				halts++
+			}
+			return nil
+		}))
+		require.NoError(t, m.SetOverflowPolicy(stackvm.OverflowInline), "unexpected policy error")
+		require.NoError(t, m.Run(), "unexpected run error")
+		return
+	}
+
+	halts, errs := run(1000)
+	assert.Equal(t, 1001, halts, "expected every machine to halt")
+	assert.Empty(t, errs, "expected no errors")
+
+	halts, errs = run(100000)
+	if assert.Equal(t, 1, len(errs), "expected the deepest forking machine to fail") {
+		assert.Contains(t, errs[0].Error(), "inline overflow too deep")
+	}
+	assert.Equal(t, 1024, halts, "expected every other machine to halt")
+}
+
+func TestMach_SetOverflowPolicy(t *testing.T) {
+	m, err := stackvm.New(smmTest.Prog)
+	require.NoError(t, err, "unexpected load error")
+	assert.EqualError(t, m.SetOverflowPolicy(stackvm.OverflowGrow), "no queue, cannot copy")
+}
@@ -0,0 +1,171 @@
+package stackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestForkPath(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		path stackvm.ForkPath
+	}{
+		{"", nil},
+		{"p", stackvm.ForkPath{false}},
+		{"c", stackvm.ForkPath{true}},
+		{"3pc2p", stackvm.ForkPath{false, false, false, true, false, false}},
+		{"12c", stackvm.ForkPath{
+			true, true, true, true, true, true,
+			true, true, true, true, true, true,
+		}},
+	} {
+		assert.Equal(t, tc.s, tc.path.String(), "expected path string")
+		path, err := stackvm.ParseForkPath(tc.s)
+		if assert.NoError(t, err, "unexpected parse error for %q", tc.s) {
+			assert.Equal(t, tc.path, path, "expected parsed %q", tc.s)
+		}
+	}
+	for _, s := range []string{"x", "3", "0", "00", "p0", "0p", "p2", "99999999999c"} {
+		_, err := stackvm.ParseForkPath(s)
+		assert.Error(t, err, "expected parse error for %q", s)
+	}
+}
+
+// replayResult is the outcome of one machine: its halt code, or its values.
+type replayResult struct {
+	code   uint32
+	values [][]uint32
+}
+
+func resultOf(t *testing.T, m *stackvm.Mach) replayResult {
+	code, halted := m.HaltCode()
+	require.True(t, halted, "unexpected machine error: %v", m.Err())
+	var res replayResult
+	if res.code = code; code == 0 {
+		vals, err := m.Values()
+		require.NoError(t, err, "unexpected values error")
+		res.values = vals
+	}
+	return res
+}
+
+func testReplay(t *testing.T, prog []byte) {
+	// record every result, along with its path
+	m, err := stackvm.New(prog)
+	require.NoError(t, err, "unexpected load error")
+	pt := tracer.NewPathTracer()
+	paths := make(map[string]replayResult)
+	ids := make(map[tracer.MachID]string)
+	m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+		path, _ := m.Observer().Context(m, "path")
+		mid, _ := m.Observer().Context(m, "id")
+		s := path.(stackvm.ForkPath).String()
+		paths[s] = resultOf(t, m)
+		ids[mid.(tracer.MachID)] = s
+		return nil
+	}))
+	require.NoError(t, m.Observe(tracer.Multi(tracer.NewIDTracer(), pt)), "unexpected run error")
+	require.True(t, len(paths) > 1, "expected more than one result")
+
+	// paths may also be looked up by machine id after the run
+	for id, s := range ids {
+		path, ok := pt.Path(id)
+		if assert.True(t, ok, "expected a path for %v", id) {
+			assert.Equal(t, s, path.String(), "expected the same path for %v", id)
+		}
+	}
+
+	// replay each path, which should then be the only result
+	for s, expected := range paths {
+		path, err := stackvm.ParseForkPath(s)
+		require.NoError(t, err, "unexpected path parse error")
+		m, err := stackvm.New(prog)
+		require.NoError(t, err, "unexpected load error")
+		var results []replayResult
+		m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+			results = append(results, resultOf(t, m))
+			return nil
+		}))
+		m.SetReplay(path)
+		require.NoError(t, m.Run(), "unexpected replay error")
+		assert.Equal(t, []replayResult{expected}, results, "expected one result from path %q", s)
+		assert.Equal(t, uint64(1), m.Stats().Handled, "expected only one machine run for path %q", s)
+	}
+}
+
+func TestMach_SetReplay(t *testing.T) {
+	t.Run("collatz", func(t *testing.T) {
+		testReplay(t, collatzExplore.Prog)
+	})
+
+	t.Run("branches", func(t *testing.T) {
+		testReplay(t, MustAssemble(
+			0x40,
+			":b", "branch", // original goes to b, copy falls through
+			1, "halt",
+			"b:",
+			":c", "fork", // original falls through, copy goes to c
+			":d", "call",
+			2, "halt",
+			"c:",
+			3, "halt",
+			"d:",
+			1, "push", "bnz", // original returns, copy falls through
+			4, "halt",
+		))
+	})
+
+	t.Run("observed", func(t *testing.T) {
+		prog := MustAssemble(
+			0x40,
+			":a", "fork",
+			":b", "fork",
+			1, "halt",
+			"a:", 2, "halt",
+			"b:", 3, "halt",
+		)
+		for _, tc := range []struct {
+			path    string
+			handled int
+		}{
+			{"", 3},
+			{"pp", 1},
+			{"pc", 1},
+			{"c", 1},
+			{"p", 2},
+		} {
+			path, err := stackvm.ParseForkPath(tc.path)
+			require.NoError(t, err, "unexpected path parse error")
+			m, err := stackvm.New(prog)
+			require.NoError(t, err, "unexpected load error")
+			m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+			m.SetReplay(path)
+			var co countObserver
+			require.NoError(t, tracer.Run(m, tracer.Multi(&co, tracer.FuncTracer(func(*stackvm.Mach) {}))),
+				"unexpected run error for path %q", tc.path)
+			assert.Equal(t, tc.handled, co.handle, "expected handled machines for path %q", tc.path)
+			assert.Equal(t, co.begin, co.end, "expected an End for each Begin for path %q", tc.path)
+			assert.Equal(t, co.begin, co.handle, "expected a Handle for each Begin for path %q", tc.path)
+			assert.Equal(t, co.begin-1, co.queue, "expected a Queue only for queued copies for path %q", tc.path)
+		}
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		m, err := stackvm.New(collatzExplore.Prog)
+		require.NoError(t, err, "unexpected load error")
+		n := 0
+		m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+			n++
+			return nil
+		}))
+		m.SetReplay(stackvm.ForkPath{false})
+		require.NoError(t, m.Run(), "unexpected replay error")
+		assert.True(t, n > 1, "expected the rest of the tree to run")
+	})
+}
@@ -132,3 +132,6 @@ var smmTest = TestCase{
 
 func TestMach_send_more_money(t *testing.T)      { smmTest.Run(t) }
 func BenchmarkMach_send_more_money(b *testing.B) { smmTest.Bench(b) }
+
+func TestMach_send_more_money_compiled(t *testing.T)      { smmTest.Compiled().Run(t) }
+func BenchmarkMach_send_more_money_compiled(b *testing.B) { smmTest.Compiled().Bench(b) }
@@ -0,0 +1,51 @@
+package stackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func collatzStats(t *testing.T, compile, trace bool) stackvm.RunStats {
+	m, err := stackvm.New(collatzExplore.Prog)
+	require.NoError(t, err, "unexpected load error")
+	if compile {
+		m.Compile()
+	}
+	m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+		if _, halted := m.HaltCode(); !halted {
+			return m.Err()
+		}
+		return nil
+	}))
+	if trace {
+		require.NoError(t, m.Trace(tracer.NewCountTracer()), "unexpected run error")
+	} else {
+		require.NoError(t, m.Run(), "unexpected run error")
+	}
+	return m.Stats()
+}
+
+func TestMach_Stats(t *testing.T) {
+	stats := collatzStats(t, false, false)
+	assert.NotZero(t, stats.Ops, "expected ops")
+	assert.NotZero(t, stats.Forks, "expected forks")
+	assert.Zero(t, stats.Branches, "expected no branches")
+	assert.Equal(t, stats.Forks+stats.Branches+1, stats.Handled, "expected every machine handled")
+	assert.True(t, stats.MaxQueueDepth > 0, "expected a queue")
+	assert.NotZero(t, stats.PagesAlloced, "expected page allocations")
+	assert.NotZero(t, stats.PageCopies, "expected copy-on-write")
+	assert.NotZero(t, stats.Elapsed, "expected elapsed time")
+
+	for _, other := range []stackvm.RunStats{
+		collatzStats(t, true, false),
+		collatzStats(t, false, true),
+	} {
+		other.Elapsed = stats.Elapsed
+		assert.Equal(t, stats, other, "expected same stats")
+	}
+}
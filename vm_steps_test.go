@@ -0,0 +1,116 @@
+package stackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestMach_SetStepLimit(t *testing.T) {
+	loop := MustAssemble(
+		0x40,
+		"loop:",
+		":loop", "jump",
+	)
+	for _, tc := range []struct {
+		name string
+		run  func(m *stackvm.Mach) error
+	}{
+		{"run", (*stackvm.Mach).Run},
+		{"compiled", func(m *stackvm.Mach) error {
+			m.Compile()
+			return m.Run()
+		}},
+		{"traced", func(m *stackvm.Mach) error {
+			return m.Trace(tracer.FuncTracer(func(*stackvm.Mach) {}))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := stackvm.New(loop)
+			require.NoError(t, err, "unexpected load error")
+			m.SetStepLimit(100)
+			err = tc.run(m)
+			if me, ok := err.(stackvm.MachError); assert.True(t, ok, "expected a MachError") {
+				assert.Equal(t, stackvm.ErrStepLimit, me.Cause(), "expected step limit")
+			}
+			assert.Equal(t, uint64(100), m.Stats().Ops, "expected op count")
+		})
+	}
+
+	t.Run("shared", func(t *testing.T) {
+		m, err := stackvm.New(MustAssemble(
+			0x40,
+			":b", "fork",
+			1, "push", "pop",
+			1, "push", "pop",
+			0, "halt",
+			"b:",
+			1, "push", "pop",
+			0, "halt",
+		))
+		require.NoError(t, err, "unexpected load error")
+		var errs []error
+		m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+			errs = append(errs, m.Err())
+			return nil
+		}))
+		m.SetStepLimit(7)
+		require.NoError(t, m.Run(), "unexpected run error")
+		if assert.Equal(t, 2, len(errs), "expected two machines") {
+			assert.NoError(t, errs[0], "expected the first machine to finish")
+			if me, ok := errs[1].(stackvm.MachError); assert.True(t, ok, "expected a MachError") {
+				assert.Equal(t, stackvm.ErrStepLimit, me.Cause(), "expected step limit")
+			}
+		}
+		assert.Equal(t, uint64(7), m.Stats().Ops, "expected op count")
+	})
+
+	t.Run("inline", func(t *testing.T) {
+		for _, compile := range []bool{false, true} {
+			m, err := stackvm.New(MustAssemble(
+				0x40,
+				":loop", "fork",
+				":loop", "fork",
+				"loop:",
+				":loop", "jump",
+			))
+			require.NoError(t, err, "unexpected load error")
+			handled := 0
+			m.SetHandler(1, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+				handled++
+				return nil
+			}))
+			require.NoError(t, m.SetOverflowPolicy(stackvm.OverflowInline), "unexpected policy error")
+			m.SetStepLimit(100)
+			if compile {
+				m.Compile()
+			}
+			require.NoError(t, m.Run(), "unexpected run error")
+			assert.Equal(t, 3, handled, "expected every machine to be handled")
+			assert.Equal(t, uint64(100), m.Stats().Ops, "expected op count, compiled=%v", compile)
+		}
+	})
+}
+
+func TestMach_Push(t *testing.T) {
+	m, err := stackvm.New(MustAssemble(
+		0x40,
+		"add", 0x100, "storeTo",
+		0x104, "push", 0x100, "push", 2, "p2c",
+		"halt",
+	))
+	require.NoError(t, err, "unexpected load error")
+	require.NoError(t, m.Push(2, 3), "unexpected push error")
+	ps, _, err := m.Stacks()
+	require.NoError(t, err, "unexpected stacks error")
+	assert.Equal(t, []uint32{2, 3}, ps, "expected primed stack")
+	require.NoError(t, m.Run(), "unexpected run error")
+	vals, err := m.Values()
+	require.NoError(t, err, "unexpected values error")
+	assert.Equal(t, [][]uint32{{5}}, vals, "expected values")
+}
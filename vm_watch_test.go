@@ -0,0 +1,70 @@
+package stackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/action"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestWatchTracer(t *testing.T) {
+	prog := MustAssemble(
+		0x40,
+		":b", "fork",
+		5, "push", 0x100, "storeTo", // changes the watched word
+		0x100, "fetch", "pop", // reads it
+		0x100, "push", 5, "push", "store", // writes it, unchanged
+		7, "push", 0x104, "storeTo", // changes an unwatched word
+		0, "halt",
+		"b:",
+		6, "push", 0x100, "storeTo",
+		0, "halt",
+	)
+
+	watch := func(t *testing.T, pred string) []string {
+		var pf action.PredicateFlag
+		require.NoError(t, pf.Set(pred), "unexpected predicate error")
+		m, err := stackvm.New(prog)
+		require.NoError(t, err, "unexpected load error")
+		m.SetHandler(1, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+		var evs []string
+		require.NoError(t, tracer.Run(m, tracer.Multi(
+			tracer.NewIDTracer(),
+			tracer.NewWatchTracer(func(ev tracer.WatchEvent) {
+				evs = append(evs, ev.String())
+			}, pf.Build()),
+		)), "unexpected run error")
+		return evs
+	}
+
+	for _, tc := range []struct {
+		pred     string
+		expected []string
+	}{
+		{"watch(mem[0x100])", []string{
+			"1(0:1) @0x0044 @0x0100 storeTo write,change [0x0100] 0 -> 5",
+			"1(1:2) @0x005a @0x0100 storeTo write,change [0x0100] 0 -> 6",
+		}},
+		{"watch(mem[0x100..0x103]:read,write,change) && id=1(0:*)", []string{
+			"1(0:1) @0x0044 @0x0100 storeTo write,change [0x0100] 0 -> 5",
+			"1(0:1) @0x0047 @0x0100 fetch read [0x0100] 5 -> 5",
+			"1(0:1) @0x0050 store write [0x0100] 5 -> 5",
+		}},
+		{"watch(mem[0x100]:write) && !watch(mem[0x100])", []string{
+			"1(0:1) @0x0050 store write [0x0100] 5 -> 5",
+		}},
+		{"watch(mem[0x104]:write) || watch(mem[0x100]) && @0x5a", []string{
+			"1(0:1) @0x0053 @0x0104 storeTo write,change [0x0104] 0 -> 7",
+			"1(1:2) @0x005a @0x0100 storeTo write,change [0x0100] 0 -> 6",
+		}},
+	} {
+		t.Run(tc.pred, func(t *testing.T) {
+			assert.Equal(t, tc.expected, watch(t, tc.pred), "expected watch events")
+		})
+	}
+}
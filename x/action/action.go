@@ -28,7 +28,9 @@ const (
 )
 
 // Test returns true if the current trace action is the received one.
-func (ta TraceAction) Test(act TraceAction, _ uint32, _ stackvm.Op) bool { return act == ta }
+func (ta TraceAction) Test(_ *stackvm.Mach, act TraceAction, _ uint32, _ stackvm.Op) bool {
+	return act == ta
+}
 
 func (ta TraceAction) String() string {
 	switch ta {
@@ -4,7 +4,7 @@ import "strings"
 
 // PredicateFlag collects predicates specified by a command line flag.
 // Predicates strings may be given over multiple flag instances, or as
-// space-separated fields within one flag value. All such collected predicates
+// space-separated terms within one flag value. All such collected predicates
 // are combined into an Any() Predicate; i.e. implicit "or" semantics.
 type PredicateFlag struct {
 	ps []Predicate
@@ -33,15 +33,9 @@ func (pf *PredicateFlag) Build() Predicate {
 	return Never
 }
 
-// Set implements flag.Value by processing fields from the given string. Each
-// field string will be parsed by ParsePredicate.
+// Set implements flag.Value by parsing the given string with ParsePredicate.
 func (pf *PredicateFlag) Set(s string) error {
-	for _, ss := range strings.Fields(s) {
-		if err := pf.add(ss); err != nil {
-			return err
-		}
-	}
-	return nil
+	return pf.add(s)
 }
 
 // Get implements flag.Getter, it just calls (*PredicateFlag).Build().
@@ -8,33 +8,219 @@ import (
 	"strings"
 )
 
-// TODO: maybe support
-// - IP ranges
-// - explicit "and"/"or"
-// - explicit "not"
-// - big feature: matching on trace id (currently an internal detail of LogfTracer)
-
 var errNotAPredicate = errors.New("not a predicate string")
 
 var predicateParsePattern = regexp.MustCompile(stripSpace(`
 	^
 	(?P<action> \w+ )?
 	(?:
-		@ (?: (?P<ipDec> [0-9]+ ) | 0x(?P<ipHex> [0-9a-fA-F]+ ) ) |
+		@ (?: (?P<ipDec> [0-9]+ ) | 0x(?P<ipHex> [0-9a-fA-F]+ ) )
+		(?: \.\. (?: (?P<hiDec> [0-9]+ ) | 0x(?P<hiHex> [0-9a-fA-F]+ ) ) )? |
 		: (?P<op> \w+ (?: , \w+ )* )
 	)?
 	$
 `))
 
-// ParsePredicate parses a string like "action", "action@ip", or
-// "action:op[,op[,...]" into a predicate. The action string may be any of
-// "begin", "end", "queue", "before", or "after" (corresponding to Tracer
-// methods). The ip string may either be a decimal number, or a "0x" prefixed
-// hex number. The op strings may be any valid operation names.
+var stateParsePattern = regexp.MustCompile(stripSpace(`
+	^
+	(?:
+		(?P<var> ps | cs | count ) |
+		mem \[ (?: (?P<addrDec> [0-9]+ ) | 0x(?P<addrHex> [0-9a-fA-F]+ ) ) \]
+	)
+	(?P<cmp> = | != | <= | >= | < | > )
+	(?: (?P<valDec> [0-9]+ ) | 0x(?P<valHex> [0-9a-fA-F]+ ) )
+	$
+`))
+
+var watchParsePattern = regexp.MustCompile(stripSpace(`
+	^
+	watch \( mem \[
+		(?: (?P<loDec> [0-9]+ ) | 0x(?P<loHex> [0-9a-fA-F]+ ) )
+		(?: \.\. (?: (?P<hiDec> [0-9]+ ) | 0x(?P<hiHex> [0-9a-fA-F]+ ) ) )?
+	\]
+	(?: : (?P<cond> \w+ (?: , \w+ )* ) )?
+	\)
+	$
+`))
+
+var machIDParsePattern = regexp.MustCompile(`^id=(\d+|\*)\((\d+|\*):(\d+|\*)\)$`)
+
+// ParsePredicate parses a predicate expression, made up of terms like
+// "action", "action@ip", "action@ip..ip", "action:op[,op[,...]", or
+// "id=tree(parent:self)". The action string may be any of "begin", "end",
+// "queue", "before", "after", or "handle" (corresponding to Tracer methods).
+// The ip strings may either be decimal numbers, or "0x" prefixed hex numbers;
+// ip ranges are inclusive, and may not be inverted. The op strings may be any
+// valid operation names. Machine id components may be "*" to match anything.
+//
+// Machine state may be compared to a value by terms like "ps>10", "cs<=2",
+// "count>=100", or "mem[0x140]=7"; these compare the parameter stack depth,
+// control stack depth, op count (from the "count" context key, e.g. provided
+// by tracer.NewCountTracer), or memory word at a 4-byte aligned address.
+// Comparisons may be any of "=", "!=", "<", "<=", ">", or ">=".
+//
+// Memory accesses may be watched by terms like "watch(mem[0x140])" or
+// "watch(mem[0x100..0x10c]:read,write)", which match before any fetch, store,
+// or storeTo op that accesses a watched address in one of the listed ways:
+// "read", "write", or "change", the default. Only those three ops are
+// watched, so a word changed by any other op doesn't match (see Watchpoint).
+//
+// Terms may be combined with "!", "&&", and "||", in order of precedence, and
+// grouped with parentheses; terms separated only by space are or-ed, e.g.
+// "before && @0x40..0x80 && !:push || id=3(1:*)".
 func ParsePredicate(s string) (Predicate, error) {
-	if s == "" {
+	toks, err := tokenizePredicate(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
 		return Never, nil
 	}
+	pp := predicateParser{toks: toks}
+	p, err := pp.or()
+	if err != nil {
+		return nil, err
+	}
+	if pp.i < len(pp.toks) {
+		return nil, fmt.Errorf("unexpected %q in predicate", pp.toks[pp.i])
+	}
+	return p, nil
+}
+
+func tokenizePredicate(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"):
+			toks = append(toks, s[i:i+2])
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			toks = append(toks, s[i:i+1])
+			i++
+		default:
+			j := i
+			// "!" only negates at the start of a term, so that "ps!=0" works
+			for j < len(s) && !strings.ContainsRune(" \t\n&|()", rune(s[j])) {
+				j++
+			}
+			if j == i {
+				return nil, errNotAPredicate
+			}
+			if (strings.HasPrefix(s[i:j], "id=") || s[i:j] == "watch") && j < len(s) && s[j] == '(' {
+				// machine ids, like "3(1:2)", and watchpoints, like
+				// "watch(mem[0x140])", contain parentheses
+				k := strings.IndexByte(s[j:], ')')
+				if k < 0 {
+					return nil, errNotAPredicate
+				}
+				j += k + 1
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+type predicateParser struct {
+	toks []string
+	i    int
+}
+
+func (pp *predicateParser) peek() string {
+	if pp.i < len(pp.toks) {
+		return pp.toks[pp.i]
+	}
+	return ""
+}
+
+func (pp *predicateParser) or() (Predicate, error) {
+	var ps []Predicate
+	for {
+		p, err := pp.and()
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+		switch pp.peek() {
+		case "||":
+			pp.i++
+		case "", ")":
+			return Any(ps...), nil
+		}
+	}
+}
+
+func (pp *predicateParser) and() (Predicate, error) {
+	var ps []Predicate
+	for {
+		p, err := pp.unary()
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+		if pp.peek() != "&&" {
+			return All(ps...), nil
+		}
+		pp.i++
+	}
+}
+
+func (pp *predicateParser) unary() (Predicate, error) {
+	tok := pp.peek()
+	switch tok {
+	case "":
+		return nil, errors.New("unexpected end of predicate")
+	case "&&", "||", ")":
+		return nil, fmt.Errorf("unexpected %q in predicate", tok)
+	}
+	pp.i++
+	switch tok {
+	case "!":
+		p, err := pp.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(p), nil
+	case "(":
+		p, err := pp.or()
+		if err != nil {
+			return nil, err
+		}
+		if pp.peek() != ")" {
+			return nil, errors.New("missing ) in predicate")
+		}
+		pp.i++
+		return p, nil
+	}
+	return parseTerm(tok)
+}
+
+func parseTerm(s string) (Predicate, error) {
+	if parts := stateParsePattern.FindStringSubmatch(s); parts != nil {
+		return parseState(parts)
+	}
+
+	if parts := watchParsePattern.FindStringSubmatch(s); parts != nil {
+		return parseWatch(parts)
+	}
+
+	if parts := machIDParsePattern.FindStringSubmatch(s); parts != nil {
+		var pat isMachID
+		for i, part := range parts[1:] {
+			pat[i] = -1
+			if part != "*" {
+				n, err := strconv.Atoi(part)
+				if err != nil {
+					return nil, err
+				}
+				pat[i] = n
+			}
+		}
+		return pat, nil
+	}
 
 	parts := predicateParsePattern.FindStringSubmatch(s)
 	if parts == nil {
@@ -51,20 +237,25 @@ func ParsePredicate(s string) (Predicate, error) {
 		ps = append(ps, act)
 	}
 
-	if parts[2] != "" { // group 2 ipDec
-		ip, err := strconv.ParseUint(parts[2], 10, 32)
+	if parts[2] != "" || parts[3] != "" { // groups 2 and 3 ip
+		ip, err := parseIP(parts[2], parts[3])
 		if err != nil {
 			return nil, err
 		}
-		ps = append(ps, isIP(ip))
-	} else if parts[3] != "" { // group 3 ipHex
-		ip, err := strconv.ParseUint(parts[3], 16, 32)
-		if err != nil {
-			return nil, err
+		if parts[4] != "" || parts[5] != "" { // groups 4 and 5 range end
+			hi, err := parseIP(parts[4], parts[5])
+			if err != nil {
+				return nil, err
+			}
+			if hi < ip {
+				return nil, fmt.Errorf("inverted ip range %#x..%#x", ip, hi)
+			}
+			ps = append(ps, ipRange{ip, hi})
+		} else {
+			ps = append(ps, isIP(ip))
 		}
-		ps = append(ps, isIP(ip))
-	} else if parts[4] != "" { // group 4 op
-		ops := strings.Split(parts[4], ",")
+	} else if parts[6] != "" { // group 6 op
+		ops := strings.Split(parts[6], ",")
 		// TODO: validate op names, maybe resolve to codes
 		if len(ops) == 1 {
 			ps = append(ps, isOPName(ops[0]))
@@ -79,6 +270,79 @@ func ParsePredicate(s string) (Predicate, error) {
 	return Never, nil
 }
 
+func parseState(parts []string) (Predicate, error) {
+	sc := stateCmp{cmp: parts[4]}
+	switch parts[1] { // group 1 var
+	case "ps":
+		sc.v = psDepth
+	case "cs":
+		sc.v = csDepth
+	case "count":
+		sc.v = opCount
+	default: // groups 2 and 3 addr
+		addr, err := parseIP(parts[2], parts[3])
+		if err != nil {
+			return nil, err
+		}
+		if addr%4 != 0 {
+			return nil, fmt.Errorf("unaligned memory address %#x", addr)
+		}
+		sc.v, sc.addr = memWord, addr
+	}
+	val, err := parseIP(parts[5], parts[6]) // groups 5 and 6 val
+	if err != nil {
+		return nil, err
+	}
+	sc.val = int64(val)
+	return sc, nil
+}
+
+func parseWatch(parts []string) (Predicate, error) {
+	var wp Watchpoint
+	lo, err := parseIP(parts[1], parts[2]) // groups 1 and 2 lo
+	if err != nil {
+		return nil, err
+	}
+	if lo%4 != 0 {
+		return nil, fmt.Errorf("unaligned memory address %#x", lo)
+	}
+	wp.Lo, wp.Hi = lo, lo
+	if parts[3] != "" || parts[4] != "" { // groups 3 and 4 hi
+		if wp.Hi, err = parseIP(parts[3], parts[4]); err != nil {
+			return nil, err
+		}
+		if wp.Hi < wp.Lo {
+			return nil, fmt.Errorf("inverted memory range %#x..%#x", wp.Lo, wp.Hi)
+		}
+	}
+	if parts[5] == "" { // group 5 cond
+		wp.Cond = WatchChange
+		return wp, nil
+	}
+	for _, name := range strings.Split(parts[5], ",") {
+		switch name {
+		case "read":
+			wp.Cond |= WatchRead
+		case "write":
+			wp.Cond |= WatchWrite
+		case "change":
+			wp.Cond |= WatchChange
+		default:
+			return nil, fmt.Errorf("invalid watch condition %q", name)
+		}
+	}
+	return wp, nil
+}
+
+func parseIP(dec, hex string) (uint32, error) {
+	if dec != "" {
+		ip, err := strconv.ParseUint(dec, 10, 32)
+		return uint32(ip), err
+	}
+	ip, err := strconv.ParseUint(hex, 16, 32)
+	return uint32(ip), err
+}
+
 // PredicateString returns a string parse-able by ParsePredicate, or
 // "!TYPE(VAL)" if the given predicate wouldn't have been possible from
 // ParsePredicate.
@@ -86,28 +350,74 @@ func PredicateString(p Predicate) string {
 	if p == Never {
 		return ""
 	}
+	return predicateString(p, 0)
+}
+
+// predicateString formats a predicate within an expression of the given
+// precedence: 1 for "||", 2 for "&&", and 3 for "!".
+func predicateString(p Predicate, prec int) string {
 	switch v := p.(type) {
+	case anyPredicate:
+		return joinPredicates(v, " || ", 1, prec)
 	case allPredicate:
-		if len(v) != 2 {
-			break
-		}
-		if ta, ok := v[0].(TraceAction); ok {
-			if sub := PredicateString(v[1]); sub != "" {
-				return fmt.Sprintf("%v%s", ta, sub)
+		if len(v) == 2 {
+			if ta, ok := v[0].(TraceAction); ok {
+				switch v[1].(type) {
+				case isIP, ipRange, isOPName, anyOPName:
+					return ta.String() + predicateString(v[1], 3)
+				}
 			}
 		}
+		return joinPredicates(v, " && ", 2, prec)
+	case notPredicate:
+		return "!" + predicateString(v.Predicate, 3)
 	case TraceAction:
 		return v.String()
 	case isIP:
-		return fmt.Sprintf("@%#x", v)
+		return fmt.Sprintf("@%#x", uint32(v))
+	case ipRange:
+		return fmt.Sprintf("@%#x..%#x", v.lo, v.hi)
 	case isOPName:
 		return ":" + string(v)
 	case anyOPName:
 		return ":" + strings.Join(v, ",")
+	case stateCmp:
+		switch v.v {
+		case psDepth:
+			return fmt.Sprintf("ps%s%d", v.cmp, v.val)
+		case csDepth:
+			return fmt.Sprintf("cs%s%d", v.cmp, v.val)
+		case opCount:
+			return fmt.Sprintf("count%s%d", v.cmp, v.val)
+		case memWord:
+			return fmt.Sprintf("mem[%#x]%s%d", v.addr, v.cmp, v.val)
+		}
+	case Watchpoint:
+		return v.String()
+	case isMachID:
+		var parts [3]string
+		for i, n := range v {
+			if parts[i] = "*"; n >= 0 {
+				parts[i] = strconv.Itoa(n)
+			}
+		}
+		return fmt.Sprintf("id=%s(%s:%s)", parts[0], parts[1], parts[2])
 	}
 	return fmt.Sprintf("!%T(%#v)", p, p)
 }
 
+func joinPredicates(ps []Predicate, sep string, prec, outer int) string {
+	ss := make([]string, len(ps))
+	for i, p := range ps {
+		ss[i] = predicateString(p, prec)
+	}
+	s := strings.Join(ss, sep)
+	if outer > prec {
+		s = "(" + s + ")"
+	}
+	return s
+}
+
 func stripSpace(s string) string {
 	s = strings.Replace(s, "\n", "", -1)
 	s = strings.Replace(s, "\t", "", -1)
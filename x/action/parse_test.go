@@ -0,0 +1,217 @@
+package action_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/action"
+)
+
+func TestParsePredicate(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"before", "before"},
+		{"before@0x40", "before@0x40"},
+		{"before@64", "before@0x40"},
+		{"after:push,pop", "after:push,pop"},
+		{"@0x40..0x80", "@0x40..0x80"},
+		{"@0x40..0x40", "@0x40..0x40"},
+		{"before@0x40..0x80", "before@0x40..0x80"},
+		{"id=3(1:*)", "id=3(1:*)"},
+		{"!:push", "!:push"},
+		{"!!:push", ":push"},
+		{"begin end", "begin || end"},
+		{"before && @0x40", "before@0x40"},
+		{
+			"before && @0x40..0x80 && !:push || id=3(1:*)",
+			"before && @0x40..0x80 && !:push || id=3(1:*)",
+		},
+		{"before && (:push || :pop)", "before && (:push || :pop)"},
+		{"!(begin || end) && id=*(*:2)", "!(begin || end) && id=*(*:2)"},
+		{"!begin && end", "!begin && end"},
+		{"(begin || end) && (after || before)", "(begin || end) && (after || before)"},
+	} {
+		p, err := action.ParsePredicate(tc.in)
+		if !assert.NoError(t, err, "unexpected error parsing %q", tc.in) {
+			continue
+		}
+		s := action.PredicateString(p)
+		assert.Equal(t, tc.out, s, "expected string of %q", tc.in)
+		q, err := action.ParsePredicate(s)
+		if assert.NoError(t, err, "unexpected error re-parsing %q", s) {
+			assert.Equal(t, s, action.PredicateString(q), "expected %q to round-trip", s)
+		}
+	}
+
+	for _, in := range []string{
+		"bogus",
+		"before &&",
+		"&& before",
+		"(before",
+		"before)",
+		"()",
+		"!",
+		"before & after",
+		"before | after",
+		"id=3(1:",
+		"@0x40..",
+		"@..0x40",
+		"@0x80..0x40",
+		"before@0x80..0x40",
+	} {
+		_, err := action.ParsePredicate(in)
+		assert.Error(t, err, "expected error parsing %q", in)
+	}
+}
+
+func TestParsePredicate_precedence(t *testing.T) {
+	push, err := stackvm.ResolveOp("push", 0, false)
+	require.NoError(t, err)
+	pop, err := stackvm.ResolveOp("pop", 0, false)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		pred string
+		act  action.TraceAction
+		ip   uint32
+		op   stackvm.Op
+		want bool
+	}{
+		// && binds tighter than ||
+		{"begin || end && @0x40", action.TraceBegin, 0, stackvm.Op{}, true},
+		{"begin || end && @0x40", action.TraceEnd, 0, stackvm.Op{}, false},
+		{"begin || end && @0x40", action.TraceEnd, 0x40, stackvm.Op{}, true},
+		{"(begin || end) && @0x40", action.TraceBegin, 0, stackvm.Op{}, false},
+
+		// terms separated by space are or-ed, below &&
+		{"begin end && @0x40", action.TraceBegin, 0, stackvm.Op{}, true},
+		{"begin end && @0x40", action.TraceEnd, 0, stackvm.Op{}, false},
+
+		// ! binds tighter than &&
+		{"!begin && end", action.TraceEnd, 0, stackvm.Op{}, true},
+		{"!begin && end", action.TraceBegin, 0, stackvm.Op{}, false},
+		{"!begin && end", action.TraceAfter, 0, stackvm.Op{}, false},
+		{"!(begin && end)", action.TraceAfter, 0, stackvm.Op{}, true},
+		{"!begin || end", action.TraceBegin, 0, stackvm.Op{}, false},
+		{"!!begin", action.TraceBegin, 0, stackvm.Op{}, true},
+
+		// ! binds to a whole action:op term
+		{"!before:push", action.TraceBefore, 0, push, false},
+		{"!before:push", action.TraceBefore, 0, pop, true},
+		{"!before:push", action.TraceAfter, 0, push, true},
+
+		// ip ranges are inclusive
+		{"@0x40..0x40", action.TraceBefore, 0x40, stackvm.Op{}, true},
+		{"@0x40..0x40", action.TraceBefore, 0x3c, stackvm.Op{}, false},
+		{"@0x40..0x40", action.TraceBefore, 0x44, stackvm.Op{}, false},
+		{"@0x40..0x80", action.TraceBefore, 0x80, stackvm.Op{}, true},
+		{"@0x40..0x80", action.TraceBefore, 0x84, stackvm.Op{}, false},
+
+		{"after:push,pop", action.TraceAfter, 0, pop, true},
+		{"after:push,pop", action.TraceBefore, 0, pop, false},
+	} {
+		p, err := action.ParsePredicate(tc.pred)
+		if !assert.NoError(t, err, "unexpected error parsing %q", tc.pred) {
+			continue
+		}
+		assert.Equal(t, tc.want, p.Test(nil, tc.act, tc.ip, tc.op),
+			"expected %q to test %v for %v @%#x %v", tc.pred, tc.want, tc.act, tc.ip, tc.op)
+	}
+}
+
+func TestParsePredicate_state(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"ps>10", "ps>10"},
+		{"cs<=0x2", "cs<=2"},
+		{"count>=100", "count>=100"},
+		{"ps!=0", "ps!=0"},
+		{"!ps!=0", "!ps!=0"},
+		{"after && mem[0x140]=7", "after && mem[0x140]=7"},
+		{"mem[320]!=0 || !ps<1", "mem[0x140]!=0 || !ps<1"},
+		{"mem[0]=0x10", "mem[0x0]=16"},
+	} {
+		p, err := action.ParsePredicate(tc.in)
+		if !assert.NoError(t, err, "unexpected error parsing %q", tc.in) {
+			continue
+		}
+		s := action.PredicateString(p)
+		assert.Equal(t, tc.out, s, "expected string of %q", tc.in)
+		q, err := action.ParsePredicate(s)
+		if assert.NoError(t, err, "unexpected error re-parsing %q", s) {
+			assert.Equal(t, s, action.PredicateString(q), "expected %q to round-trip", s)
+		}
+	}
+
+	for _, in := range []string{
+		"ps>",
+		"ps=>1",
+		"ps>-1",
+		"sp>1",
+		"mem[]=1",
+		"mem[0x140]",
+		"mem[0x141]=7",
+		"mem[0x142]=7",
+		"mem[321]=7",
+		"mem[0x140..0x144]=7",
+	} {
+		_, err := action.ParsePredicate(in)
+		assert.Error(t, err, "expected error parsing %q", in)
+	}
+}
+
+func TestParsePredicate_watch(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+		wp      action.Watchpoint
+	}{
+		{"watch(mem[0x140])", "watch(mem[0x140])", action.Watchpoint{Lo: 0x140, Hi: 0x140, Cond: action.WatchChange}},
+		{"watch(mem[0x140]:change)", "watch(mem[0x140])", action.Watchpoint{Lo: 0x140, Hi: 0x140, Cond: action.WatchChange}},
+		{"watch(mem[0x140..0x140])", "watch(mem[0x140])", action.Watchpoint{Lo: 0x140, Hi: 0x140, Cond: action.WatchChange}},
+		{
+			"watch(mem[256..0x10c]:write,read)", "watch(mem[0x100..0x10c]:read,write)",
+			action.Watchpoint{Lo: 0x100, Hi: 0x10c, Cond: action.WatchRead | action.WatchWrite},
+		},
+	} {
+		p, err := action.ParsePredicate(tc.in)
+		if !assert.NoError(t, err, "unexpected error parsing %q", tc.in) {
+			continue
+		}
+		assert.Equal(t, tc.wp, p, "expected watchpoint from %q", tc.in)
+		s := action.PredicateString(p)
+		assert.Equal(t, tc.out, s, "expected string of %q", tc.in)
+		q, err := action.ParsePredicate(s)
+		if assert.NoError(t, err, "unexpected error re-parsing %q", s) {
+			assert.Equal(t, p, q, "expected %q to round-trip", s)
+		}
+	}
+
+	p, err := action.ParsePredicate("watch(mem[0x140]:write) && id=1(*:*)")
+	if assert.NoError(t, err, "unexpected error parsing a watch and id") {
+		assert.Equal(t, "watch(mem[0x140]:write) && id=1(*:*)", action.PredicateString(p))
+	}
+
+	for _, in := range []string{
+		"watch",
+		"watch()",
+		"watch(0x140)",
+		"watch(mem[])",
+		"watch(mem[0x140]",
+		"watch(mem[0x140]))",
+		"watch(mem[0x140]:)",
+		"watch(mem[0x140]:poke)",
+		"watch(mem[0x140]:read,)",
+		"watch(mem[0x141])",
+		"watch(mem[0x108..0x100])",
+		"watch (mem[0x140])",
+	} {
+		_, err := action.ParsePredicate(in)
+		assert.Error(t, err, "expected error parsing %q", in)
+	}
+}
@@ -1,10 +1,15 @@
 package action
 
-import "github.com/jcorbin/stackvm"
+import (
+	"reflect"
 
-// Predicate matches machine trace state.
+	"github.com/jcorbin/stackvm"
+)
+
+// Predicate matches machine trace state; the machine may be nil, e.g. when
+// testing a predicate outside of any trace.
 type Predicate interface {
-	Test(act TraceAction, ip uint32, op stackvm.Op) bool
+	Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool
 }
 
 // TODO: flatten same kind under Any/All, elide nils, and fold fixeds; maybe
@@ -36,6 +41,19 @@ func All(ps ...Predicate) Predicate {
 	}
 }
 
+// Not returns a predicate that works as the logical Not of the given
+// predicate.
+func Not(p Predicate) Predicate {
+	switch v := p.(type) {
+	case fixedPredicate:
+		return !v
+	case notPredicate:
+		return v.Predicate
+	default:
+		return notPredicate{p}
+	}
+}
+
 var (
 	// Never is an always false predicate.
 	Never = fixedPredicate(false)
@@ -47,43 +65,58 @@ var (
 type anyPredicate []Predicate
 type allPredicate []Predicate
 type fixedPredicate bool
+type notPredicate struct{ Predicate }
 
-func (b fixedPredicate) Test(_ TraceAction, _ uint32, _ stackvm.Op) bool { return bool(b) }
+func (b fixedPredicate) Test(_ *stackvm.Mach, _ TraceAction, _ uint32, _ stackvm.Op) bool {
+	return bool(b)
+}
 
 // TestFunc is a convenience for implementing Predicate directly with
 // a function.
-type TestFunc func(act TraceAction, ip uint32, op stackvm.Op) bool
+type TestFunc func(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool
 
 // Test calls the wrapped function.
-func (f TestFunc) Test(act TraceAction, ip uint32, op stackvm.Op) bool { return f(act, ip, op) }
+func (f TestFunc) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
+	return f(m, act, ip, op)
+}
 
-func (any anyPredicate) Test(act TraceAction, ip uint32, op stackvm.Op) bool {
+func (any anyPredicate) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
 	for _, p := range any {
-		if p.Test(act, ip, op) {
+		if p.Test(m, act, ip, op) {
 			return true
 		}
 	}
 	return false
 }
 
-func (all allPredicate) Test(act TraceAction, ip uint32, op stackvm.Op) bool {
+func (all allPredicate) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
 	for _, p := range all {
-		if !p.Test(act, ip, op) {
+		if !p.Test(m, act, ip, op) {
 			return false
 		}
 	}
 	return true
 }
 
+func (not notPredicate) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
+	return !not.Predicate.Test(m, act, ip, op)
+}
+
 type isIP uint32
+type ipRange struct{ lo, hi uint32 } // inclusive
 type isOPName string
 type anyOPName []string
 
-func (fip isIP) Test(act TraceAction, ip uint32, op stackvm.Op) bool { return ip == uint32(fip) }
-func (name isOPName) Test(act TraceAction, ip uint32, op stackvm.Op) bool {
+func (fip isIP) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
+	return ip == uint32(fip)
+}
+func (r ipRange) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
+	return r.lo <= ip && ip <= r.hi
+}
+func (name isOPName) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
 	return op.Name() == string(name)
 }
-func (names anyOPName) Test(act TraceAction, ip uint32, op stackvm.Op) bool {
+func (names anyOPName) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
 	for _, name := range names {
 		if op.Name() == name {
 			return true
@@ -91,3 +124,106 @@ func (names anyOPName) Test(act TraceAction, ip uint32, op stackvm.Op) bool {
 	}
 	return false
 }
+
+// isMachID matches the machine id provided under the "id" context key, e.g. by
+// tracer.NewIDTracer, against a pattern; -1 components match anything.
+type isMachID [3]int
+
+func (pat isMachID) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
+	if m == nil {
+		return false
+	}
+	o := m.Observer()
+	if o == nil {
+		return false
+	}
+	// the id type is only known to be an array of 3 ints, since the tracer
+	// package, that defines it, depends on this one
+	mid, _ := o.Context(m, "id")
+	v := reflect.ValueOf(mid)
+	if v.Kind() != reflect.Array || v.Len() != 3 {
+		return false
+	}
+	for i, want := range pat {
+		el := v.Index(i)
+		if el.Kind() != reflect.Int {
+			return false
+		}
+		if want >= 0 && int(el.Int()) != want {
+			return false
+		}
+	}
+	return true
+}
+
+type stateVar int
+
+const (
+	psDepth = stateVar(iota + 1) // "ps", parameter stack depth
+	csDepth                      // "cs", control stack depth
+	opCount                      // "count", op count from the "count" context
+	memWord                      // "mem[addr]", memory word
+)
+
+// stateCmp compares some part of machine state with a value; it's false if
+// the state isn't available, e.g. without a machine, or without a "count"
+// context.
+type stateCmp struct {
+	v    stateVar
+	addr uint32 // for memWord
+	cmp  string // one of = != < <= > >=
+	val  int64
+}
+
+func (sc stateCmp) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
+	if m == nil {
+		return false
+	}
+	var val int64
+	switch sc.v {
+	case psDepth, csDepth:
+		ps, cs, err := m.Stacks()
+		if err != nil {
+			return false
+		}
+		if sc.v == psDepth {
+			val = int64(len(ps))
+		} else {
+			val = int64(len(cs))
+		}
+	case opCount:
+		o := m.Observer()
+		if o == nil {
+			return false
+		}
+		c, _ := o.Context(m, "count")
+		n, ok := c.(int)
+		if !ok {
+			return false
+		}
+		val = int64(n)
+	case memWord:
+		w, err := m.Fetch(sc.addr)
+		if err != nil {
+			return false
+		}
+		val = int64(w)
+	default:
+		return false
+	}
+	switch sc.cmp {
+	case "=":
+		return val == sc.val
+	case "!=":
+		return val != sc.val
+	case "<":
+		return val < sc.val
+	case "<=":
+		return val <= sc.val
+	case ">":
+		return val > sc.val
+	case ">=":
+		return val >= sc.val
+	}
+	return false
+}
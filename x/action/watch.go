@@ -0,0 +1,139 @@
+package action
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jcorbin/stackvm"
+)
+
+// WatchCond is a set of memory access conditions to watch for.
+type WatchCond uint8
+
+const (
+	// WatchRead matches words read by a fetch op.
+	WatchRead WatchCond = 1 << iota
+	// WatchWrite matches words written by a store op, even if unchanged.
+	WatchWrite
+	// WatchChange matches words whose value a store op changes; changes made
+	// by any other op aren't seen (see Watchpoint).
+	WatchChange
+)
+
+func (wc WatchCond) String() string {
+	var parts []string
+	if wc&WatchRead != 0 {
+		parts = append(parts, "read")
+	}
+	if wc&WatchWrite != 0 {
+		parts = append(parts, "write")
+	}
+	if wc&WatchChange != 0 {
+		parts = append(parts, "change")
+	}
+	return strings.Join(parts, ",")
+}
+
+// Watchpoint is a predicate that matches, before an op, if the op is about to
+// access an inclusive range of memory addresses in one of the watched ways.
+// Only the fetch, store, and storeTo ops are considered, so changes made by
+// any other op, such as stack ops writing to stack memory, aren't seen.
+type Watchpoint struct {
+	Lo, Hi uint32
+	Cond   WatchCond
+}
+
+// Test returns true if the op is about to access watched memory.
+func (wp Watchpoint) Test(m *stackvm.Mach, act TraceAction, ip uint32, op stackvm.Op) bool {
+	if m == nil || act != TraceBefore {
+		return false
+	}
+	acc, ok := Access(m, op)
+	if !ok || acc.Addr < wp.Lo || acc.Addr > wp.Hi {
+		return false
+	}
+	return wp.Cond&acc.Cond() != 0
+}
+
+func (wp Watchpoint) String() string {
+	s := fmt.Sprintf("mem[%#x]", wp.Lo)
+	if wp.Hi != wp.Lo {
+		s = fmt.Sprintf("mem[%#x..%#x]", wp.Lo, wp.Hi)
+	}
+	if wp.Cond != WatchChange {
+		s += ":" + wp.Cond.String()
+	}
+	return "watch(" + s + ")"
+}
+
+// MemAccess is a memory access that an op is about to make.
+type MemAccess struct {
+	Addr  uint32
+	Write bool
+	Old   uint32 // the word at Addr before the op
+	New   uint32 // the word that a write will store; Old for reads
+}
+
+// Cond returns the conditions that the access meets.
+func (acc MemAccess) Cond() WatchCond {
+	if !acc.Write {
+		return WatchRead
+	}
+	if acc.New != acc.Old {
+		return WatchWrite | WatchChange
+	}
+	return WatchWrite
+}
+
+// Access returns the memory access that a fetch, store, or storeTo op is about
+// to make; it returns false for any other op, or if the machine's stack
+// doesn't hold the op's operands.
+func Access(m *stackvm.Mach, op stackvm.Op) (MemAccess, bool) {
+	var acc MemAccess
+	switch op.Name() {
+	case "fetch":
+	case "store", "storeTo":
+		acc.Write = true
+	default:
+		return acc, false
+	}
+
+	// operands, in the order that the op takes them: any immediate, and
+	// then values popped from the stack
+	ps, _, err := m.Stacks()
+	if err != nil {
+		return acc, false
+	}
+	args := make([]uint32, 0, 2)
+	if op.Have {
+		args = append(args, op.Arg)
+	}
+	for i := len(ps) - 1; i >= 0 && len(args) < 2; i-- {
+		args = append(args, ps[i])
+	}
+
+	switch op.Name() {
+	case "fetch": // addr
+		if len(args) < 1 {
+			return acc, false
+		}
+		acc.Addr = args[0]
+	case "store": // val, addr
+		if len(args) < 2 {
+			return acc, false
+		}
+		acc.New, acc.Addr = args[0], args[1]
+	case "storeTo": // addr, val
+		if len(args) < 2 {
+			return acc, false
+		}
+		acc.Addr, acc.New = args[0], args[1]
+	}
+	if acc.Old, err = m.Fetch(acc.Addr); err != nil {
+		return acc, false
+	}
+	if !acc.Write {
+		acc.New = acc.Old
+	}
+	return acc, true
+}
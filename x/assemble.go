@@ -14,7 +14,42 @@ import (
 // argument. An immediate argument may be an integer value, or a label
 // reference string of the form ":name". Labels are defined with a string of
 // the form "name:".
+//
+// The result is a sectioned program container (see stackvm.Program), with
+// every label included as a symbol.
 func Assemble(in ...interface{}) ([]byte, error) {
+	return assembleTokens(false, in)
+}
+
+// AssembleOptimized works like Assemble, but additionally runs a peephole
+// optimization pass over the resolved operations: immediate values pushed
+// right before an operation that can take them as an immediate argument are
+// folded into it, dup-then-pop pairs are dropped, and jumps to jumps are
+// threaded through to their final target.
+func AssembleOptimized(in ...interface{}) ([]byte, error) {
+	return assembleTokens(true, in)
+}
+
+// MustAssemble uses assemble the input, using Assemble(), and panics
+// if it returns a non-nil error.
+func MustAssemble(in ...interface{}) []byte {
+	prog, err := Assemble(in...)
+	if err != nil {
+		panic(err)
+	}
+	return prog
+}
+
+// MustAssembleOptimized is like MustAssemble, but uses AssembleOptimized().
+func MustAssembleOptimized(in ...interface{}) []byte {
+	prog, err := AssembleOptimized(in...)
+	if err != nil {
+		panic(err)
+	}
+	return prog
+}
+
+func assembleTokens(opt bool, in []interface{}) ([]byte, error) {
 	if len(in) < 2 {
 		return nil, errors.New("program too short, need at least options and one token")
 	}
@@ -44,22 +79,16 @@ func Assemble(in ...interface{}) ([]byte, error) {
 		return nil, err
 	}
 
-	ops, jumps, err := resolve(toks)
+	ops, jumps, labels, err := resolve(toks)
 	if err != nil {
 		return nil, err
 	}
 
-	return assemble(opts, ops, jumps), nil
-}
-
-// MustAssemble uses assemble the input, using Assemble(), and panics
-// if it returns a non-nil error.
-func MustAssemble(in ...interface{}) []byte {
-	prog, err := Assemble(in...)
-	if err != nil {
-		panic(err)
+	if opt {
+		ops, jumps, labels = optimize(ops, jumps, labels)
 	}
-	return prog
+
+	return assemble(opts, ops, jumps, labels), nil
 }
 
 type token struct {
@@ -118,6 +147,11 @@ func tokenize(in []interface{}) (out []token, err error) {
 	op:
 		i++
 		// got r ref or v imm, must have opName
+		if i >= len(in) {
+			return nil, fmt.Errorf(
+				`missing token after %T(%v); expected "opName"`,
+				in[i-1], in[i-1])
+		}
 		if s, ok := in[i].(string); ok {
 			out = append(out, opName(s))
 			continue
@@ -130,9 +164,9 @@ func tokenize(in []interface{}) (out []token, err error) {
 	return
 }
 
-func resolve(toks []token) (ops []stackvm.Op, jumps []int, err error) {
+func resolve(toks []token) (ops []stackvm.Op, jumps []int, labels map[string]int, err error) {
 	numJumps := 0
-	labels := make(map[string]int)
+	labels = make(map[string]int)
 	refs := make(map[string][]int)
 
 	for i := 0; i < len(toks); i++ {
@@ -148,10 +182,10 @@ func resolve(toks []token) (ops []stackvm.Op, jumps []int, err error) {
 			tok = toks[i]
 			op, err := stackvm.ResolveOp(tok.op, 0, true)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 			if !op.AcceptsRef() {
-				return nil, nil, fmt.Errorf("%v does not accept ref %q", op, ref)
+				return nil, nil, nil, fmt.Errorf("%v does not accept ref %q", op, ref)
 			}
 			ops = append(ops, op)
 			refs[ref] = append(refs[ref], len(ops)-1)
@@ -168,7 +202,7 @@ func resolve(toks []token) (ops []stackvm.Op, jumps []int, err error) {
 
 		op, err := stackvm.ResolveOp(tok.op, arg, have)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		ops = append(ops, op)
 	}
@@ -178,7 +212,7 @@ func resolve(toks []token) (ops []stackvm.Op, jumps []int, err error) {
 		for name, sites := range refs {
 			i, ok := labels[name]
 			if !ok {
-				return nil, nil, fmt.Errorf("undefined label %q", name)
+				return nil, nil, nil, fmt.Errorf("undefined label %q", name)
 			}
 			for _, j := range sites {
 				ops[j].Arg = uint32(i - j - 1)
@@ -236,7 +270,7 @@ func (jc jumpCursor) rewind(ri int) jumpCursor {
 	return jc
 }
 
-func assemble(opts stackvm.MachOptions, ops []stackvm.Op, jumps []int) []byte {
+func assemble(opts stackvm.MachOptions, ops []stackvm.Op, jumps []int, labels map[string]int) []byte {
 	// setup jump tracking state
 	jc := makeJumpCursor(ops, jumps)
 
@@ -252,17 +286,46 @@ func assemble(opts stackvm.MachOptions, ops []stackvm.Op, jumps []int) []byte {
 		est++
 	}
 
-	buf := make([]byte, est+5)
-	n := opts.EncodeInto(buf)
-	assembleInto(opts, ops, jc, buf[n:])
-	return buf
+	buf := make([]byte, est)
+	code, offsets := assembleInto(opts, ops, jc, buf)
+
+	prog := stackvm.Program{
+		MachOptions: opts,
+		Version:     stackvm.CodeVersion,
+		Code:        code,
+	}
+	if len(labels) > 0 {
+		base := uint32(opts.StackSize)
+		prog.Symbols = make(stackvm.Symbols, 0, len(labels))
+		for name, i := range labels {
+			prog.Symbols = append(prog.Symbols, stackvm.Symbol{
+				Addr: base + offsets[i],
+				Name: name,
+			})
+		}
+		sort.Sort(symbolsByAddrName(prog.Symbols))
+	}
+	return prog.Encode()
+}
+
+// symbolsByAddrName orders symbols by address, and then name, so that
+// assembly is deterministic.
+type symbolsByAddrName stackvm.Symbols
+
+func (ss symbolsByAddrName) Len() int      { return len(ss) }
+func (ss symbolsByAddrName) Swap(i, j int) { ss[i], ss[j] = ss[j], ss[i] }
+func (ss symbolsByAddrName) Less(i, j int) bool {
+	if ss[i].Addr == ss[j].Addr {
+		return ss[i].Name < ss[j].Name
+	}
+	return ss[i].Addr < ss[j].Addr
 }
 
-func assembleInto(opts stackvm.MachOptions, ops []stackvm.Op, jc jumpCursor, p []byte) []byte {
+func assembleInto(opts stackvm.MachOptions, ops []stackvm.Op, jc jumpCursor, p []byte) ([]byte, []uint32) {
 	base := uint32(opts.StackSize)
 	offsets := make([]uint32, len(ops)+1)
 	c, i := uint32(0), 0 // current op offset and index
-	for i < len(ops) {
+	for {
 		// fix a previously encoded jump's target
 		for 0 <= jc.ji && jc.ji < i && jc.ti <= i {
 			jIP := base + offsets[jc.ji]
@@ -283,10 +346,13 @@ func assembleInto(opts stackvm.MachOptions, ops []stackvm.Op, jc jumpCursor, p [
 				jc = jc.next()
 			}
 		}
+		if i >= len(ops) {
+			break
+		}
 		// encode next operation
 		c += uint32(ops[i].EncodeInto(p[c:]))
 		i++
 		offsets[i] = c
 	}
-	return p[:c]
+	return p[:c], offsets
 }
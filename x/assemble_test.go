@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/jcorbin/stackvm"
 	. "github.com/jcorbin/stackvm/x"
 )
 
@@ -21,6 +22,7 @@ type assemblerCase struct {
 	name string
 	in   []interface{}
 	out  []byte
+	syms stackvm.Symbols
 	err  string
 }
 
@@ -35,63 +37,94 @@ type assemblerTest struct {
 
 func (t assemblerTest) run() {
 	prog, err := Assemble(t.in...)
-	if t.err == "" {
-		require.NoError(t, err, "unexpected error")
-	} else {
+	if t.err != "" {
 		assert.EqualError(t, err, t.err, "expected error")
+		assert.Nil(t, prog, "expected no program")
+		return
+	}
+	require.NoError(t, err, "unexpected error")
+	p, err := stackvm.DecodeProgram(prog)
+	require.NoError(t, err, "unexpected decode error")
+	assert.Equal(t, uint16(0x40), p.StackSize, "expected stack size")
+	assert.Equal(t, byte(stackvm.CodeVersion), p.Version, "expected code version")
+	assert.Equal(t, t.out, p.Code, "expected machine code")
+	if t.syms != nil {
+		assert.Equal(t, t.syms, p.Symbols, "expected symbols")
 	}
-	assert.Equal(t, t.out, prog, "expected machine code")
 }
 
 func TestAssemble(t *testing.T) {
 	assemblerCases{
 		{
 			name: "bad token",
-			in:   []interface{}{'X'},
+			in:   []interface{}{0x40, 'X'},
 			err:  `invalid token int32(88); expected "label:", ":ref", "opName", or an int`,
 		},
 
 		{
 			name: "broken op",
-			in:   []interface{}{99, 44},
+			in:   []interface{}{0x40, 99, 44},
 			err:  `invalid token int(44); expected "opName"`,
 		},
 
+		{
+			name: "truncated op",
+			in:   []interface{}{0x40, 99},
+			err:  `missing token after int(99); expected "opName"`,
+		},
+
 		{
 			name: "invalid op",
-			in:   []interface{}{42, "nope"},
+			in:   []interface{}{0x40, 42, "nope"},
 			err:  `no such operation "nope"`,
 		},
 
 		{
 			name: "invalid rep op",
-			in:   []interface{}{":such", "nope"},
+			in:   []interface{}{0x40, ":such", "nope"},
 			err:  `no such operation "nope"`,
 		},
 
 		{
 			name: "undefined ref",
-			in:   []interface{}{":such", "jump"},
+			in:   []interface{}{0x40, ":such", "jump"},
 			err:  `undefined label "such"`,
 		},
 
 		{
 			name: "basic",
 			in: []interface{}{
+				0x40,
 				2, "push",
 				3, "add",
 				5, "eq",
 			},
 			out: []byte{
-				0x82, 0x00,
-				0x83, 0x11,
-				0x85, 0x1a,
+				0x84, 0x00,
+				0x86, 0x10,
+				0x8a, 0x1c,
+			},
+		},
+
+		{
+			name: "negative immediates",
+			in: []interface{}{
+				0x40,
+				-1, "push",
+				-64, "add",
+				-65, "add",
+			},
+			out: []byte{
+				0x81, 0x00,
+				0xff, 0x10,
+				0x81, 0x81, 0x10,
 			},
 		},
 
 		{
 			name: "small loop",
 			in: []interface{}{
+				0x40,
 				10, "push",
 				"loop:",
 				1, "sub",
@@ -100,17 +133,19 @@ func TestAssemble(t *testing.T) {
 				"halt",
 			},
 			out: []byte{
-				0x8a, 0x00,
-				0x81, 0x12,
-				0x80, 0x1c,
-				0x8f, 0xff, 0xff, 0xff, 0xf6, 0x29,
+				0x94, 0x00,
+				0x82, 0x11,
+				0x80, 0x1a,
+				0x87, 0x31,
 				0x7f,
 			},
+			syms: stackvm.Symbols{{Addr: 0x42, Name: "loop"}},
 		},
 
 		{
 			name: "fizzbuzz",
 			in: []interface{}{
+				0x40,
 				3, "mod", ":fizz", "jz",
 				5, "mod", ":buzz", "jz",
 				":cont", "jump",
@@ -134,20 +169,20 @@ func TestAssemble(t *testing.T) {
 			},
 			out: []byte{
 
-				0x83, 0x15, 0x86, 0x2a, // f
-				0x85, 0x15, 0x8a, 0x2a, // b
-				0x94, 0x28, // c
+				0x86, 0x14, 0x90, 0x32, // f
+				0x8a, 0x14, 0x98, 0x32, // b
+				0xac, 0x30, // c
 
-				0x85, 0x15, 0x8c, 0x2a, // fb
-				0x83, 0x00,
-				0x8c, 0x28, // c
+				0x8a, 0x14, 0x9c, 0x32, // fb
+				0x86, 0x00,
+				0x9c, 0x30, // c
 
-				0x83, 0x15, 0x84, 0x2a, // fb
-				0x85, 0x00,
-				0x84, 0x28, // c
+				0x86, 0x14, 0x8c, 0x32, // fb
+				0x8a, 0x00,
+				0x8c, 0x30, // c
 
-				0x83, 0x00,
-				0x85, 0x00,
+				0x86, 0x00,
+				0x8a, 0x00,
 
 				0x7f,
 			},
@@ -156,6 +191,7 @@ func TestAssemble(t *testing.T) {
 		{
 			name: "be kind",
 			in: []interface{}{
+				0x40,
 				":cont", "jump",
 				0x01020304, "push",
 				0x01020304, "push",
@@ -192,39 +228,39 @@ func TestAssemble(t *testing.T) {
 				"cont:", "halt",
 			},
 			out: []byte{
-				0x81, 0xa0, 0x28,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
-				0x88, 0x88, 0x86, 0x84, 0x00,
+				0x82, 0xc6, 0x30,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
+				0x90, 0x90, 0x8c, 0x88, 0x00,
 				0x7f,
 			},
 		},
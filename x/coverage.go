@@ -0,0 +1,83 @@
+package xstackvm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+// Coverage collects code coverage across test case runs, separately for each
+// distinct program.
+type Coverage struct {
+	progs []coveredProg
+	index map[string]int
+}
+
+type coveredProg struct {
+	name string
+	prog []byte
+	cov  *tracer.Coverage
+}
+
+// NewCoverage creates a new, empty, coverage collection.
+func NewCoverage() *Coverage {
+	return &Coverage{index: make(map[string]int)}
+}
+
+// WithCoverage returns a copy of the test case that records its coverage into
+// the given collection.
+func (tc TestCase) WithCoverage(c *Coverage) TestCase {
+	tc.Coverage = c
+	return tc
+}
+
+// WithCoverage returns copies of the test cases that record their coverage
+// into the given collection.
+func (tcs TestCases) WithCoverage(c *Coverage) TestCases {
+	r := make(TestCases, len(tcs))
+	for i, tc := range tcs {
+		r[i] = tc.WithCoverage(c)
+	}
+	return r
+}
+
+// tracer returns the coverage tracer for the test case's program, named after
+// the first test case to run it.
+func (c *Coverage) tracer(tc TestCase) *tracer.Coverage {
+	key := string(tc.Prog)
+	if i, def := c.index[key]; def {
+		return c.progs[i].cov
+	}
+	cov := tracer.NewCoverage()
+	c.index[key] = len(c.progs)
+	c.progs = append(c.progs, coveredProg{tc.Name, tc.Prog, cov})
+	return cov
+}
+
+// Program returns coverage for the given program, if any was collected.
+func (c *Coverage) Program(prog []byte) (*tracer.Coverage, bool) {
+	if i, def := c.index[string(prog)]; def {
+		return c.progs[i].cov, true
+	}
+	return nil, false
+}
+
+// WriteReport writes an annotated listing for each program, in the order that
+// they were first run (see (*tracer.Coverage).WriteReport).
+func (c *Coverage) WriteReport(w io.Writer) error {
+	for _, cp := range c.progs {
+		m, err := stackvm.New(cp.prog)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "# %s\n", cp.name); err != nil {
+			return err
+		}
+		if err := cp.cov.WriteReport(w, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
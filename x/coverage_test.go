@@ -0,0 +1,57 @@
+package xstackvm_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/jcorbin/stackvm/x"
+)
+
+func TestCoverage(t *testing.T) {
+	// classify n as zero, or not, storing 0 or 1 into 0x100; the final hz
+	// can never be taken
+	prog := func(n int) []byte {
+		return MustAssemble(
+			0x40,
+			n, "push", ":zero", "jz",
+			0x100, "push", 1, "store", ":done", "jump",
+			"zero:",
+			0x100, "push", 0, "store",
+			"done:",
+			1, "push", 2, "hz",
+			0x104, "push", 0x100, "push", 2, "p2c",
+			"halt",
+		)
+	}
+
+	cov := NewCoverage()
+	TestCases{
+		{Name: "zero", Prog: prog(0), Result: Result{Values: [][]uint32{{0}}}},
+		{Name: "one", Prog: prog(1), Result: Result{Values: [][]uint32{{1}}}},
+		{Name: "one again", Prog: prog(1), Result: Result{Values: [][]uint32{{1}}}},
+	}.WithCoverage(cov).Run(t)
+
+	zero, ok := cov.Program(prog(0))
+	require.True(t, ok, "expected coverage for zero")
+	one, ok := cov.Program(prog(1))
+	require.True(t, ok, "expected coverage for one")
+
+	jz := uint32(0x42)
+	assert.Equal(t, int64(1), zero.Hits[jz], "expected zero jz hit once")
+	assert.Equal(t, int64(1), zero.Branches[jz].Taken, "expected zero to take jz")
+	assert.Equal(t, int64(2), one.Hits[jz], "expected one jz hit twice")
+	assert.Equal(t, int64(2), one.Branches[jz].NotTaken, "expected one to not take jz")
+
+	var buf bytes.Buffer
+	require.NoError(t, cov.WriteReport(&buf), "unexpected report error")
+	report := buf.String()
+	assert.Contains(t, report, "# zero\n")
+	assert.Contains(t, report, "# one\n")
+	assert.NotContains(t, report, "# one again\n")
+	assert.Contains(t, report, "zero:\n")
+	assert.Contains(t, report, "taken:0 not-taken:2")
+	assert.Contains(t, report, "coverage: ")
+}
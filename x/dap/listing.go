@@ -0,0 +1,57 @@
+package dap
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jcorbin/stackvm"
+)
+
+// listing is a disassembly of a machine's code, which the server presents to
+// the client as the program's source: each label and op gets its own line, so
+// that line breakpoints map onto ips.
+type listing struct {
+	text   []byte
+	ipLine map[uint32]int // ip -> 1-based line
+	lineIP []uint32       // 0-based line -> ip of the op at, or after, it
+}
+
+func makeListing(m *stackvm.Mach) listing {
+	var buf bytes.Buffer
+	lst := listing{ipLine: make(map[uint32]int)}
+	syms := m.Symbols()
+	start, end := m.CodeRange()
+	for ip := start; ip < end; {
+		for _, sym := range syms {
+			if sym.Addr == ip {
+				fmt.Fprintf(&buf, "%s:\n", sym.Name)
+				lst.lineIP = append(lst.lineIP, ip)
+			}
+		}
+		op, next, err := m.ReadOp(ip)
+		lst.ipLine[ip] = len(lst.lineIP) + 1
+		lst.lineIP = append(lst.lineIP, ip)
+		if err != nil {
+			fmt.Fprintf(&buf, "\t@%#04x  ?? %v\n", ip, err)
+			ip++
+			continue
+		}
+		fmt.Fprintf(&buf, "\t@%#04x  %v\n", ip, op)
+		ip = next
+	}
+	lst.text = buf.Bytes()
+	return lst
+}
+
+// ip returns the ip of the op at, or after, the given 1-based line.
+func (lst listing) ip(line int) (uint32, bool) {
+	if line < 1 || line > len(lst.lineIP) {
+		return 0, false
+	}
+	return lst.lineIP[line-1], true
+}
+
+// line returns the 1-based line of the op at ip, or 0 if there isn't one.
+func (lst listing) line(ip uint32) int {
+	return lst.ipLine[ip]
+}
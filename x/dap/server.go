@@ -0,0 +1,728 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/jcorbin/stackvm"
+)
+
+const listingRef = 1 // sourceReference of the program listing
+
+var (
+	errNotLaunched = errors.New("no program launched")
+	errNotPaused   = errors.New("not paused")
+	errNoThread    = errors.New("no such thread")
+)
+
+type runMode int
+
+const (
+	modeContinue = runMode(iota)
+	modeStep
+	modeNext
+	modeOut
+)
+
+// Server serves the Debug Adapter Protocol for a single stackvm program. Each
+// running, or queued, machine is a thread; the run is paused, as a whole, by
+// a Tracer whenever a breakpoint matches, or a stepped thread moves.
+type Server struct {
+	r   *bufio.Reader
+	w   io.Writer
+	wmu sync.Mutex
+	seq int
+
+	mu          sync.Mutex
+	m           *stackvm.Mach // loaded program, until run
+	name        string
+	lst         listing
+	syms        stackvm.Symbols
+	queueSize   int
+	stopOnEntry bool
+	started     bool
+
+	nextBP    int
+	srcBreaks map[uint32]int // ip -> breakpoint id
+	fnBreaks  map[uint32]int
+	insBreaks map[uint32]int
+
+	nextID int
+	ids    map[*stackvm.Mach]int
+	machs  map[int]*stackvm.Mach // running, or pending, by thread id
+
+	mode   runMode
+	reason string        // stopped reason when stepping
+	focus  *stackvm.Mach // thread being stepped, or nil for any
+	nextIP uint32        // where a next stops
+	depth  int           // call depth within a step out
+	outRet bool          // step out has returned
+	paused *stackvm.Mach
+	resume chan struct{}
+	quit   bool
+}
+
+// NewServer creates a server that reads requests from r, and writes
+// responses and events to w.
+func NewServer(r io.Reader, w io.Writer) *Server {
+	return &Server{
+		r:         bufio.NewReader(r),
+		w:         w,
+		queueSize: 100,
+		srcBreaks: make(map[uint32]int),
+		fnBreaks:  make(map[uint32]int),
+		insBreaks: make(map[uint32]int),
+		ids:       make(map[*stackvm.Mach]int),
+		machs:     make(map[int]*stackvm.Mach),
+		resume:    make(chan struct{}, 1),
+	}
+}
+
+// Serve handles requests until the client disconnects, or its input ends.
+func (s *Server) Serve() error {
+	for {
+		var req request
+		if err := readMessage(s.r, &req); err == io.EOF {
+			s.disconnect()
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := s.handle(req)
+		res := response{
+			Type:       "response",
+			RequestSeq: req.Seq,
+			Success:    err == nil,
+			Command:    req.Command,
+			Body:       body,
+		}
+		if err != nil {
+			res.Message = err.Error()
+		}
+		if err := s.send(&res, &res.Seq); err != nil {
+			return err
+		}
+		switch {
+		case req.Command == "initialize" && res.Success:
+			s.event("initialized", nil)
+		case req.Command == "disconnect":
+			return nil
+		}
+	}
+}
+
+func (s *Server) send(v interface{}, seq *int) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	*seq = s.seq
+	return writeMessage(s.w, v)
+}
+
+func (s *Server) event(name string, body interface{}) {
+	ev := event{Type: "event", Event: name, Body: body}
+	_ = s.send(&ev, &ev.Seq)
+}
+
+func (s *Server) output(category, format string, args ...interface{}) {
+	s.event("output", map[string]interface{}{
+		"category": category,
+		"output":   fmt.Sprintf(format, args...),
+	})
+}
+
+func (s *Server) handle(req request) (interface{}, error) {
+	args := req.Arguments
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest":      true,
+			"supportsFunctionBreakpoints":           true,
+			"supportsInstructionBreakpoints":        true,
+			"supportsReadMemoryRequest":             true,
+			"supportsSteppingGranularity":           false,
+			"supportsTerminateThreadsRequest":       false,
+			"supportsSingleThreadExecutionRequests": false,
+		}, nil
+	case "launch":
+		return nil, s.launch(args)
+	case "setBreakpoints":
+		return s.setBreakpoints(args)
+	case "setFunctionBreakpoints":
+		return s.setFunctionBreakpoints(args)
+	case "setInstructionBreakpoints":
+		return s.setInstructionBreakpoints(args)
+	case "setExceptionBreakpoints":
+		return map[string]interface{}{"breakpoints": []breakpoint{}}, nil
+	case "configurationDone":
+		return nil, s.configurationDone()
+	case "threads":
+		return s.threads(), nil
+	case "stackTrace":
+		return s.stackTrace(args)
+	case "scopes":
+		return s.scopes(args)
+	case "variables":
+		return s.variables(args)
+	case "readMemory":
+		return s.readMemory(args)
+	case "source":
+		return s.source()
+	case "continue":
+		s.step(modeContinue, nil, "")
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+	case "next", "stepIn", "stepOut":
+		return nil, s.stepThread(req.Command, args)
+	case "pause":
+		s.mu.Lock()
+		s.mode, s.focus, s.reason = modeStep, nil, "pause"
+		s.mu.Unlock()
+		return nil, nil
+	case "disconnect", "terminate":
+		s.disconnect()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported command %q", req.Command)
+}
+
+func (s *Server) launch(args json.RawMessage) error {
+	var la struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+		QueueSize   int    `json:"queueSize"`
+	}
+	if err := json.Unmarshal(args, &la); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(la.Program)
+	if err != nil {
+		return err
+	}
+	m, err := stackvm.New(buf)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m, s.name = m, la.Program
+	s.lst = makeListing(m)
+	s.syms = m.Symbols()
+	s.stopOnEntry = la.StopOnEntry
+	if la.QueueSize > 0 {
+		s.queueSize = la.QueueSize
+	}
+	return nil
+}
+
+func (s *Server) listingSource() *source {
+	return &source{Name: s.name + " (disassembly)", SourceReference: listingRef}
+}
+
+func (s *Server) source() (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		return nil, errNotLaunched
+	}
+	return map[string]interface{}{
+		"content":  string(s.lst.text),
+		"mimeType": "text/x-stackvm",
+	}, nil
+}
+
+func (s *Server) addBreak(set map[uint32]int, ip uint32) int {
+	s.nextBP++
+	set[ip] = s.nextBP
+	return s.nextBP
+}
+
+func (s *Server) setBreakpoints(args json.RawMessage) (interface{}, error) {
+	var ba struct {
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(args, &ba); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		return nil, errNotLaunched
+	}
+	s.srcBreaks = make(map[uint32]int)
+	bps := make([]breakpoint, len(ba.Breakpoints))
+	for i, b := range ba.Breakpoints {
+		bps[i].Line = b.Line
+		if ip, ok := s.lst.ip(b.Line); ok {
+			bps[i].ID = s.addBreak(s.srcBreaks, ip)
+			bps[i].Verified = true
+			bps[i].Line = s.lst.line(ip)
+			bps[i].Source = s.listingSource()
+			bps[i].InstructionReference = fmt.Sprintf("%#04x", ip)
+		} else {
+			bps[i].Message = "no such line"
+		}
+	}
+	return map[string]interface{}{"breakpoints": bps}, nil
+}
+
+func (s *Server) setFunctionBreakpoints(args json.RawMessage) (interface{}, error) {
+	var ba struct {
+		Breakpoints []struct {
+			Name string `json:"name"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(args, &ba); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		return nil, errNotLaunched
+	}
+	s.fnBreaks = make(map[uint32]int)
+	bps := make([]breakpoint, len(ba.Breakpoints))
+	for i, b := range ba.Breakpoints {
+		if ip, ok := s.syms.Addr(b.Name); ok {
+			bps[i].ID = s.addBreak(s.fnBreaks, ip)
+			bps[i].Verified = true
+			bps[i].Line = s.lst.line(ip)
+			bps[i].Source = s.listingSource()
+			bps[i].InstructionReference = fmt.Sprintf("%#04x", ip)
+		} else {
+			bps[i].Message = fmt.Sprintf("no such label %q", b.Name)
+		}
+	}
+	return map[string]interface{}{"breakpoints": bps}, nil
+}
+
+func (s *Server) setInstructionBreakpoints(args json.RawMessage) (interface{}, error) {
+	var ba struct {
+		Breakpoints []struct {
+			InstructionReference string `json:"instructionReference"`
+			Offset               int    `json:"offset"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(args, &ba); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.insBreaks = make(map[uint32]int)
+	bps := make([]breakpoint, len(ba.Breakpoints))
+	for i, b := range ba.Breakpoints {
+		addr, err := strconv.ParseUint(b.InstructionReference, 0, 32)
+		if err != nil {
+			bps[i].Message = err.Error()
+			continue
+		}
+		ip := uint32(int64(addr) + int64(b.Offset))
+		bps[i].ID = s.addBreak(s.insBreaks, ip)
+		bps[i].Verified = true
+		bps[i].InstructionReference = fmt.Sprintf("%#04x", ip)
+		if line := s.lst.line(ip); line > 0 {
+			bps[i].Line = line
+			bps[i].Source = s.listingSource()
+		}
+	}
+	return map[string]interface{}{"breakpoints": bps}, nil
+}
+
+func (s *Server) configurationDone() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		return errNotLaunched
+	}
+	if s.started {
+		return errors.New("already started")
+	}
+	s.started = true
+	if s.stopOnEntry {
+		s.mode, s.reason = modeStep, "entry"
+	}
+	go s.run(s.m, s.queueSize)
+	return nil
+}
+
+func (s *Server) run(m *stackvm.Mach, queueSize int) {
+	m.SetHandler(queueSize, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+		s.mu.Lock()
+		id := s.ids[m]
+		s.mu.Unlock()
+		if code, halted := m.HaltCode(); !halted || code != 0 {
+			s.output("console", "machine %d: %v\n", id, m.Err())
+			return nil
+		}
+		vals, err := m.Values()
+		if err != nil {
+			return err
+		}
+		s.output("stdout", "machine %d: values=%v\n", id, vals)
+		return nil
+	}))
+	code := 0
+	if err := m.Trace(tracer{s}); err != nil {
+		s.output("stderr", "run failed: %v\n", err)
+		code = 1
+	}
+	s.event("exited", map[string]interface{}{"exitCode": code})
+	s.event("terminated", nil)
+}
+
+func (s *Server) disconnect() {
+	s.mu.Lock()
+	s.quit = true
+	s.mu.Unlock()
+	s.step(modeContinue, nil, "")
+}
+
+// step sets the run mode, and resumes the run if it's paused.
+func (s *Server) step(mode runMode, focus *stackvm.Mach, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mode, s.focus, s.reason = mode, focus, reason
+	s.depth, s.outRet = 0, false
+	if s.paused != nil {
+		s.paused = nil
+		s.resume <- struct{}{}
+	}
+}
+
+func (s *Server) stepThread(cmd string, args json.RawMessage) error {
+	var sa struct {
+		ThreadID int `json:"threadId"`
+	}
+	if err := json.Unmarshal(args, &sa); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	m := s.machs[sa.ThreadID]
+	s.mu.Unlock()
+	if m == nil {
+		return errNoThread
+	}
+	switch cmd {
+	case "next":
+		// reading the op at ip is only safe while the run is paused
+		if _, err := s.pausedThread(sa.ThreadID); err != nil {
+			return err
+		}
+		op, end, err := m.ReadOp(m.IP())
+		if err == nil && op.Name() == "call" {
+			s.mu.Lock()
+			s.nextIP = end
+			s.mu.Unlock()
+			s.step(modeNext, m, "step")
+			return nil
+		}
+		s.step(modeStep, m, "step")
+	case "stepIn":
+		s.step(modeStep, m, "step")
+	case "stepOut":
+		s.step(modeOut, m, "step")
+	}
+	return nil
+}
+
+func (s *Server) threads() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int, 0, len(s.machs))
+	for id := range s.machs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	ts := make([]thread, len(ids))
+	for i, id := range ids {
+		ts[i] = thread{id, fmt.Sprintf("machine %d", id)}
+	}
+	return map[string]interface{}{"threads": ts}
+}
+
+// pausedThread returns the machine for a thread id, so long as the run is
+// paused, and so every machine's state is safe to read.
+func (s *Server) pausedThread(id int) (*stackvm.Mach, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused == nil {
+		return nil, errNotPaused
+	}
+	m := s.machs[id]
+	if m == nil {
+		return nil, errNoThread
+	}
+	return m, nil
+}
+
+func (s *Server) stackTrace(args json.RawMessage) (interface{}, error) {
+	var sa struct {
+		ThreadID int `json:"threadId"`
+	}
+	if err := json.Unmarshal(args, &sa); err != nil {
+		return nil, err
+	}
+	m, err := s.pausedThread(sa.ThreadID)
+	if err != nil {
+		return nil, err
+	}
+	ip := m.IP()
+	frame := stackFrame{
+		ID:     sa.ThreadID,
+		Name:   s.where(ip),
+		Source: s.listingSource(),
+		Line:   s.lst.line(ip),
+		Column: 1,
+
+		InstructionPointerReference: fmt.Sprintf("%#04x", ip),
+	}
+	return map[string]interface{}{
+		"stackFrames": []stackFrame{frame},
+		"totalFrames": 1,
+	}, nil
+}
+
+func (s *Server) where(ip uint32) string {
+	if sym, ok := s.syms.Lookup(ip); ok {
+		if off := ip - sym.Addr; off > 0 {
+			return fmt.Sprintf("%s+%d", sym.Name, off)
+		}
+		return sym.Name
+	}
+	return fmt.Sprintf("@%#04x", ip)
+}
+
+// Each frame, and so each thread, has two scopes: its parameter stack, whose
+// variables reference is twice the thread id, and its control stack.
+
+func (s *Server) scopes(args json.RawMessage) (interface{}, error) {
+	var sa struct {
+		FrameID int `json:"frameId"`
+	}
+	if err := json.Unmarshal(args, &sa); err != nil {
+		return nil, err
+	}
+	m, err := s.pausedThread(sa.FrameID)
+	if err != nil {
+		return nil, err
+	}
+	ps, cs, err := m.Stacks()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"scopes": []scope{
+		{Name: "Parameter Stack", VariablesReference: 2 * sa.FrameID, IndexedVariables: len(ps)},
+		{Name: "Control Stack", VariablesReference: 2*sa.FrameID + 1, IndexedVariables: len(cs)},
+	}}, nil
+}
+
+func (s *Server) variables(args json.RawMessage) (interface{}, error) {
+	var va struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(args, &va); err != nil {
+		return nil, err
+	}
+	m, err := s.pausedThread(va.VariablesReference / 2)
+	if err != nil {
+		return nil, err
+	}
+	ps, cs, err := m.Stacks()
+	if err != nil {
+		return nil, err
+	}
+	vals := ps
+	if va.VariablesReference%2 == 1 {
+		vals = cs
+	}
+	vars := make([]variable, len(vals))
+	for i, val := range vals {
+		vars[i] = variable{
+			Name:            fmt.Sprintf("[%d]", i),
+			Value:           fmt.Sprintf("%d (%#x)", val, val),
+			MemoryReference: fmt.Sprintf("%#x", val),
+		}
+	}
+	return map[string]interface{}{"variables": vars}, nil
+}
+
+const maxReadMemory = 1 << 16
+
+func (s *Server) readMemory(args json.RawMessage) (interface{}, error) {
+	var ra struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(args, &ra); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	m := s.paused
+	s.mu.Unlock()
+	if m == nil {
+		return nil, errNotPaused
+	}
+	base, err := strconv.ParseUint(ra.MemoryReference, 0, 32)
+	if err != nil {
+		return nil, err
+	}
+	addr := uint32(int64(base) + int64(ra.Offset))
+	if ra.Count > maxReadMemory {
+		ra.Count = maxReadMemory
+	}
+	if ra.Count < 0 {
+		ra.Count = 0
+	}
+	buf := make([]byte, ra.Count)
+	n := m.MemCopy(addr, buf)
+	return map[string]interface{}{
+		"address": fmt.Sprintf("%#x", addr),
+		"data":    base64.StdEncoding.EncodeToString(buf[:n]),
+	}, nil
+}
+
+// tracer is the server's pausing tracer.
+type tracer struct{ s *Server }
+
+func (t tracer) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	if key != "id" {
+		return nil, false
+	}
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	return t.s.ids[m], true
+}
+
+func (t tracer) Begin(m *stackvm.Mach) {
+	s := t.s
+	s.mu.Lock()
+	id, def := s.ids[m]
+	if !def {
+		s.nextID++
+		id = s.nextID
+		s.ids[m] = id
+		s.machs[id] = m
+	}
+	s.mu.Unlock()
+	if !def {
+		s.event("thread", map[string]interface{}{"reason": "started", "threadId": id})
+	}
+}
+
+func (t tracer) Queue(m, n *stackvm.Mach) {
+	s := t.s
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.ids[n] = id
+	s.machs[id] = n
+	s.mu.Unlock()
+	s.event("thread", map[string]interface{}{"reason": "started", "threadId": id})
+}
+
+func (t tracer) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	s := t.s
+	s.mu.Lock()
+	if s.quit {
+		s.mu.Unlock()
+		return
+	}
+	var (
+		reason string
+		hit    []int
+	)
+	for _, set := range []map[uint32]int{s.srcBreaks, s.fnBreaks, s.insBreaks} {
+		if id, def := set[ip]; def {
+			hit = append(hit, id)
+		}
+	}
+	if len(hit) > 0 {
+		reason = "breakpoint"
+	} else {
+		switch s.mode {
+		case modeStep:
+			if s.focus == nil || s.focus == m {
+				reason = s.reason
+			}
+		case modeNext:
+			if s.focus == m && ip == s.nextIP {
+				reason = s.reason
+			}
+		case modeOut:
+			if s.focus != m {
+				break
+			}
+			if s.outRet {
+				reason = s.reason
+			}
+			switch op.Name() {
+			case "call":
+				s.depth++
+			case "ret":
+				if s.depth == 0 {
+					s.outRet = true
+				} else {
+					s.depth--
+				}
+			}
+		}
+	}
+	if reason == "" {
+		s.mu.Unlock()
+		return
+	}
+	s.paused = m
+	s.focus = m
+	id := s.ids[m]
+	s.mu.Unlock()
+
+	body := map[string]interface{}{
+		"reason":            reason,
+		"threadId":          id,
+		"allThreadsStopped": true,
+	}
+	if len(hit) > 0 {
+		body["hitBreakpointIds"] = hit
+	}
+	s.event("stopped", body)
+	<-s.resume
+}
+
+func (t tracer) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {}
+
+func (t tracer) End(m *stackvm.Mach) {
+	s := t.s
+	s.mu.Lock()
+	if s.focus == m {
+		// stepping carries on with whichever machine runs next
+		s.focus = nil
+	}
+	s.mu.Unlock()
+}
+
+func (t tracer) Handle(m *stackvm.Mach, err error) {
+	s := t.s
+	s.mu.Lock()
+	id := s.ids[m]
+	delete(s.ids, m)
+	delete(s.machs, id)
+	s.mu.Unlock()
+	s.event("thread", map[string]interface{}{"reason": "exited", "threadId": id})
+}
@@ -0,0 +1,282 @@
+package dap_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/dap"
+)
+
+// message is any protocol message, as seen by the test client.
+type message struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func (msg message) String() string {
+	if msg.Type == "event" {
+		return fmt.Sprintf("event %s %s", msg.Event, msg.Body)
+	}
+	return fmt.Sprintf("%s %s success:%v %q %s", msg.Type, msg.Command, msg.Success, msg.Message, msg.Body)
+}
+
+// client is a scripted DAP client.
+type client struct {
+	t    *testing.T
+	w    io.Writer
+	seq  int
+	msgs chan message
+	seen []message // events received while waiting for something else
+}
+
+func newClient(t *testing.T, r io.Reader, w io.Writer) *client {
+	c := &client{t: t, w: w, msgs: make(chan message, 100)}
+	go func() {
+		defer close(c.msgs)
+		br := bufio.NewReader(r)
+		for {
+			hdr, err := textproto.NewReader(br).ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(hdr.Get("Content-Length"))
+			body := make([]byte, n)
+			if _, err := io.ReadFull(br, body); err != nil {
+				return
+			}
+			var msg message
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Errorf("invalid message %q: %v", body, err)
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+func (c *client) next() message {
+	select {
+	case msg, ok := <-c.msgs:
+		require.True(c.t, ok, "unexpected end of server output")
+		return msg
+	case <-time.After(5 * time.Second):
+		require.FailNow(c.t, "timed out waiting for server")
+	}
+	return message{}
+}
+
+// request sends a request, and returns its successful response body, decoded
+// into v if non-nil.
+func (c *client) request(cmd string, args, v interface{}) {
+	c.seq++
+	req := map[string]interface{}{"seq": c.seq, "type": "request", "command": cmd}
+	if args != nil {
+		req["arguments"] = args
+	}
+	body, err := json.Marshal(req)
+	require.NoError(c.t, err)
+	_, err = fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	require.NoError(c.t, err)
+	for {
+		msg := c.next()
+		if msg.Type != "response" {
+			c.seen = append(c.seen, msg)
+			continue
+		}
+		require.Equal(c.t, c.seq, msg.RequestSeq, "unexpected response %v", msg)
+		require.True(c.t, msg.Success, "unexpected failure %v", msg)
+		if v != nil {
+			require.NoError(c.t, json.Unmarshal(msg.Body, v), "invalid %s body", cmd)
+		}
+		return
+	}
+}
+
+// event waits for the named event, returning its body decoded into v if
+// non-nil; any other events are kept in seen.
+func (c *client) event(name string, v interface{}) {
+	for i, msg := range c.seen {
+		if msg.Event == name {
+			c.seen = append(c.seen[:i], c.seen[i+1:]...)
+			c.decodeEvent(msg, v)
+			return
+		}
+	}
+	for {
+		msg := c.next()
+		if msg.Type == "event" && msg.Event == name {
+			c.decodeEvent(msg, v)
+			return
+		}
+		c.seen = append(c.seen, msg)
+	}
+}
+
+func (c *client) decodeEvent(msg message, v interface{}) {
+	if v != nil {
+		require.NoError(c.t, json.Unmarshal(msg.Body, v), "invalid %s event body", msg.Event)
+	}
+}
+
+type stopped struct {
+	Reason   string `json:"reason"`
+	ThreadID int    `json:"threadId"`
+	HitIDs   []int  `json:"hitBreakpointIds"`
+}
+
+type frames struct {
+	StackFrames []struct {
+		Name string `json:"name"`
+		Line int    `json:"line"`
+		IP   string `json:"instructionPointerReference"`
+	} `json:"stackFrames"`
+}
+
+type variables struct {
+	Variables []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"variables"`
+}
+
+func TestServer(t *testing.T) {
+	f, err := ioutil.TempFile("", "stackvm-dap-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(MustAssemble(
+		0x40,
+		0x100, "push", 42, "store",
+		":fizz", "fork",
+		0x100, "push", 1, "call",
+		"halt",
+		"fizz:",
+		7, "push", 3, "push",
+		0x104, "push", 0x100, "push", 2, "p2c",
+		"halt",
+	))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	srv := dap.NewServer(inR, outW)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve()
+		outW.Close()
+	}()
+	c := newClient(t, outR, inW)
+
+	var caps map[string]interface{}
+	c.request("initialize", map[string]interface{}{"adapterID": "stackvm"}, &caps)
+	assert.Equal(t, true, caps["supportsReadMemoryRequest"], "expected memory reads")
+	c.event("initialized", nil)
+
+	c.request("launch", map[string]interface{}{"program": f.Name()}, nil)
+
+	var src struct {
+		Content string `json:"content"`
+	}
+	c.request("source", map[string]interface{}{"sourceReference": 1}, &src)
+	assert.Contains(t, src.Content, "fizz:\n", "expected labels in listing")
+
+	var bps struct {
+		Breakpoints []struct {
+			ID       int  `json:"id"`
+			Verified bool `json:"verified"`
+			Line     int  `json:"line"`
+		} `json:"breakpoints"`
+	}
+	c.request("setFunctionBreakpoints", map[string]interface{}{
+		"breakpoints": []map[string]interface{}{{"name": "fizz"}, {"name": "buzz"}},
+	}, &bps)
+	require.Equal(t, 2, len(bps.Breakpoints), "expected breakpoint results")
+	assert.True(t, bps.Breakpoints[0].Verified, "expected fizz verified")
+	assert.False(t, bps.Breakpoints[1].Verified, "expected buzz unverified")
+	fizzID := bps.Breakpoints[0].ID
+
+	c.request("configurationDone", nil, nil)
+
+	// the fork queued a thread, which runs after the main one fails its call
+	var stop stopped
+	c.event("stopped", &stop)
+	assert.Equal(t, "breakpoint", stop.Reason)
+	assert.Equal(t, []int{fizzID}, stop.HitIDs)
+	assert.Equal(t, 2, stop.ThreadID, "expected the forked thread to stop")
+
+	var ths struct {
+		Threads []struct {
+			ID int `json:"id"`
+		} `json:"threads"`
+	}
+	c.request("threads", nil, &ths)
+	if assert.Equal(t, 1, len(ths.Threads), "expected one thread") {
+		assert.Equal(t, 2, ths.Threads[0].ID)
+	}
+
+	var fs frames
+	c.request("stackTrace", map[string]interface{}{"threadId": 2}, &fs)
+	if assert.Equal(t, 1, len(fs.StackFrames), "expected one frame") {
+		assert.Equal(t, "fizz", fs.StackFrames[0].Name)
+	}
+
+	var mem struct {
+		Data string `json:"data"`
+	}
+	c.request("readMemory", map[string]interface{}{"memoryReference": "0x100", "count": 4}, &mem)
+	data, err := base64.StdEncoding.DecodeString(mem.Data)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{42, 0, 0, 0}, data, "expected memory")
+
+	c.request("stepIn", map[string]interface{}{"threadId": 2}, nil)
+	c.event("stopped", &stop)
+	c.request("next", map[string]interface{}{"threadId": 2}, nil)
+	c.event("stopped", &stop)
+	assert.Equal(t, "step", stop.Reason)
+
+	var scopes struct {
+		Scopes []struct {
+			Name string `json:"name"`
+			Ref  int    `json:"variablesReference"`
+		} `json:"scopes"`
+	}
+	c.request("scopes", map[string]interface{}{"frameId": 2}, &scopes)
+	require.Equal(t, 2, len(scopes.Scopes), "expected two scopes")
+	var vars variables
+	c.request("variables", map[string]interface{}{"variablesReference": scopes.Scopes[0].Ref}, &vars)
+	if assert.Equal(t, 2, len(vars.Variables), "expected two params") {
+		assert.Equal(t, "7 (0x7)", vars.Variables[0].Value)
+		assert.Equal(t, "3 (0x3)", vars.Variables[1].Value)
+	}
+
+	c.request("continue", map[string]interface{}{"threadId": 2}, nil)
+	var exited struct {
+		ExitCode int `json:"exitCode"`
+	}
+	c.event("exited", &exited)
+	assert.Equal(t, 0, exited.ExitCode)
+	c.event("terminated", nil)
+
+	c.request("disconnect", nil, nil)
+	assert.NoError(t, <-served, "unexpected serve error")
+}
@@ -12,17 +12,84 @@ type dumper struct {
 	m    *stackvm.Mach
 	f    func(string, ...interface{})
 	last uint32
+	code map[uint32][]string // disassembled ops, by line address
 }
 
-// Dump dumps the machine's memory to a log formating function.
+// Dump dumps the machine's memory to a log formating function. Lines in the
+// code segment are annotated with the ops that start on them; the op at the
+// current IP is marked with "<ip", and any at return addresses found on the
+// control stack are marked with "<ret".
 func Dump(m *stackvm.Mach, f func(string, ...interface{})) error {
 	d := dumper{
-		m: m,
-		f: f,
+		m:    m,
+		f:    f,
+		code: disassemble(m),
 	}
 	return m.EachPage(d.page)
 }
 
+// DumpDiff dumps only the lines of memory that differ between two machines,
+// e.g. between a machine and its copy: each such line is dumped from a with a
+// "-" prefix, and then from b with a "+" prefix.
+func DumpDiff(a, b *stackvm.Mach, f func(string, ...interface{})) error {
+	da := dumper{m: a, f: prefixed("-", f), code: disassemble(a)}
+	db := dumper{m: b, f: prefixed("+", f), code: disassemble(b)}
+	var (
+		last   uint32
+		any    bool
+		la, lb [16]byte
+	)
+	for _, wd := range stackvm.MemDiff(a, b) {
+		addr := wd.Addr &^ 0xf
+		if any && addr == last {
+			continue
+		}
+		last, any = addr, true
+		la, lb = [16]byte{}, [16]byte{}
+		a.MemCopy(addr, la[:])
+		b.MemCopy(addr, lb[:])
+		da.line(addr, la[:])
+		db.line(addr, lb[:])
+	}
+	return nil
+}
+
+func prefixed(prefix string, f func(string, ...interface{})) func(string, ...interface{}) {
+	return func(format string, args ...interface{}) {
+		f(prefix+format, args...)
+	}
+}
+
+func disassemble(m *stackvm.Mach) map[uint32][]string {
+	start, end := m.CodeRange()
+	if start >= end {
+		return nil
+	}
+	rets := make(map[uint32]bool)
+	if _, cs, err := m.Stacks(); err == nil {
+		for _, v := range cs {
+			rets[v] = true
+		}
+	}
+	code := make(map[uint32][]string)
+	for ip := start; ip < end; {
+		op, next, err := m.ReadOp(ip)
+		ann := fmt.Sprintf("%04x %v", ip, op)
+		if err != nil {
+			ann, next = fmt.Sprintf("%04x ??", ip), ip+1
+		}
+		if ip == m.IP() {
+			ann += " <ip"
+		} else if rets[ip] {
+			ann += " <ret"
+		}
+		line := ip &^ 0xf
+		code[line] = append(code[line], ann)
+		ip = next
+	}
+	return code
+}
+
 func (d *dumper) page(addr uint32, p [64]byte) error {
 	if d.last < addr {
 		d.f("........  .. .. .. .. .. .. .. ..  .. .. .. .. .. .. .. ..")
@@ -54,7 +121,7 @@ func (d dumper) line(addr uint32, l []byte) {
 
 func (d dumper) annotate(addr uint32, l []byte) string {
 	var (
-		parts [2]string
+		parts [3]string
 		i     int
 	)
 	if ann := d.annotateStackBytes(addr, l, d.m.PBP(), d.m.PSP()); ann != "" {
@@ -65,6 +132,10 @@ func (d dumper) annotate(addr uint32, l []byte) string {
 		parts[i] = ann
 		i++
 	}
+	if ops := d.code[addr]; len(ops) > 0 {
+		parts[i] = strings.Join(ops, " | ")
+		i++
+	}
 	if i > 0 {
 		return strings.Join(parts[:i], " ")
 	}
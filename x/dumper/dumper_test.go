@@ -0,0 +1,52 @@
+package dumper_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/dumper"
+)
+
+func TestDumpDiff(t *testing.T) {
+	prog := MustAssemble(
+		0x40,
+		5, "push", 0x100, "storeTo",
+		7, "push", 0x108, "storeTo",
+		9, "push", 0x140, "storeTo",
+		0, "halt",
+	)
+	a, err := stackvm.New(prog)
+	require.NoError(t, err, "unexpected load error")
+	b, err := stackvm.New(prog)
+	require.NoError(t, err, "unexpected load error")
+
+	diff := func() []string {
+		var lines []string
+		require.NoError(t, dumper.DumpDiff(a, b, func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}), "unexpected dump error")
+		return lines
+	}
+
+	assert.Empty(t, diff(), "expected no difference after load")
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, b.Step(), "unexpected step error")
+	}
+	assert.Equal(t, []string{
+		"-00000100  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00",
+		"+00000100  05 00 00 00 00 00 00 00  07 00 00 00 00 00 00 00",
+		"-00000140  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00",
+		"+00000140  09 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00",
+	}, diff(), "expected each changed line once, from a then b")
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, a.Step(), "unexpected step error")
+	}
+	assert.Empty(t, diff(), "expected no difference once a catches up")
+}
@@ -0,0 +1,140 @@
+package xstackvm
+
+import "github.com/jcorbin/stackvm"
+
+// foldableOps are those operations that take an immediate argument in lieu of
+// popping it from the parameter stack; any such operation without an
+// immediate, that follows a push with one, can absorb the pushed value.
+// Notably divmod is not among them, since its immediate form leaves its
+// results in a different order.
+var foldableOps = map[string]bool{
+	"fetch": true, "store": true, "storeTo": true,
+	"add": true, "sub": true, "mul": true, "div": true, "mod": true,
+	"lt": true, "lte": true, "gt": true, "gte": true, "eq": true, "neq": true,
+}
+
+// threadableOps are those operations whose reference argument is a control
+// flow target, rather than a data address.
+var threadableOps = map[string]bool{
+	"jump": true, "jnz": true, "jz": true,
+	"fork": true, "fnz": true, "fz": true,
+	"branch": true, "bnz": true, "bz": true,
+	"call": true,
+}
+
+// optimize performs peephole optimization on resolved ops, returning new ops,
+// jumps, and labels. Jump arguments are expected, and left, in the form
+// produced by resolve: op index offsets, relative to the op after the jump.
+func optimize(ops []stackvm.Op, jumps []int, labels map[string]int) ([]stackvm.Op, []int, map[string]int) {
+	ops = append([]stackvm.Op(nil), ops...)
+	jumps = append([]int(nil), jumps...)
+	nlabels := make(map[string]int, len(labels))
+	for name, i := range labels {
+		nlabels[name] = i
+	}
+	labels = nlabels
+	threadJumps(ops, jumps)
+	for {
+		nops, njumps := foldOps(ops, jumps, labels)
+		if len(nops) == len(ops) {
+			return nops, njumps, labels
+		}
+		ops, jumps = nops, njumps
+	}
+}
+
+func jumpTarget(ops []stackvm.Op, j int) int {
+	return j + 1 + int(int32(ops[j].Arg))
+}
+
+// threadJumps retargets any jump whose target is an unconditional jump to
+// that jump's eventual target.
+func threadJumps(ops []stackvm.Op, jumps []int) {
+	isJump := make(map[int]bool, len(jumps))
+	for _, j := range jumps {
+		isJump[j] = true
+	}
+	for _, j := range jumps {
+		if !threadableOps[ops[j].Name()] {
+			continue
+		}
+		t := jumpTarget(ops, j)
+		for n := 0; n < len(jumps); n++ {
+			if t >= len(ops) || !isJump[t] || ops[t].Name() != "jump" {
+				break
+			}
+			t = jumpTarget(ops, t)
+		}
+		ops[j].Arg = uint32(t - j - 1)
+	}
+}
+
+// foldOps does a single pass of folding over ops, returning new ops and jumps,
+// and updating labels in place. Ops that are jump targets, or labeled, are
+// never folded into the op before them.
+func foldOps(ops []stackvm.Op, jumps []int, labels map[string]int) ([]stackvm.Op, []int) {
+	isJump := make(map[int]bool, len(jumps))
+	isTarget := make(map[int]bool, len(jumps)+len(labels))
+	for _, j := range jumps {
+		isJump[j] = true
+		isTarget[jumpTarget(ops, j)] = true
+	}
+	for _, i := range labels {
+		isTarget[i] = true
+	}
+
+	out := make([]stackvm.Op, 0, len(ops))
+	idx := make([]int, len(ops)+1) // old op index -> new op index
+	for i := 0; i < len(ops); i++ {
+		a := ops[i]
+
+		// drop jumps to the very next op
+		if isJump[i] && a.Name() == "jump" && jumpTarget(ops, i) == i+1 {
+			idx[i] = len(out)
+			continue
+		}
+
+		if j := i + 1; j < len(ops) && !isJump[i] && !isJump[j] && !isTarget[j] {
+			b := ops[j]
+
+			// N push OP -> N OP
+			if a.Name() == "push" && a.Have && !b.Have && foldableOps[b.Name()] {
+				idx[i], idx[j] = len(out), len(out)
+				out = append(out, stackvm.Op{Code: b.Code, Arg: a.Arg, Have: true})
+				i = j
+				continue
+			}
+
+			// dup pop -> ...
+			if a.Name() == "dup" && (!a.Have || a.Arg == 1) &&
+				b.Name() == "pop" && (!b.Have || b.Arg == 1) {
+				idx[i], idx[j] = len(out), len(out)
+				i = j
+				continue
+			}
+		}
+
+		idx[i] = len(out)
+		out = append(out, a)
+	}
+	idx[len(ops)] = len(out)
+
+	if len(out) == len(ops) {
+		return ops, jumps
+	}
+
+	for name, i := range labels {
+		labels[name] = idx[i]
+	}
+
+	njumps := make([]int, 0, len(jumps))
+	for _, j := range jumps {
+		if isJump[j] && ops[j].Name() == "jump" && jumpTarget(ops, j) == j+1 {
+			continue
+		}
+		nj, nt := idx[j], idx[jumpTarget(ops, j)]
+		out[nj].Arg = uint32(nt - nj - 1)
+		njumps = append(njumps, nj)
+	}
+	return out, njumps
+}
@@ -0,0 +1,149 @@
+package xstackvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+)
+
+type optimizerCase struct {
+	name   string
+	in     []interface{}
+	expect []optimizerResult
+}
+
+func (c optimizerCase) run(t *testing.T) {
+	prog, err := Assemble(c.in...)
+	require.NoError(t, err, "unexpected assemble error")
+	oprog, err := AssembleOptimized(c.in...)
+	require.NoError(t, err, "unexpected optimized assemble error")
+	assert.True(t, len(oprog) < len(prog),
+		"expected optimized program to be smaller (%d vs %d bytes)", len(oprog), len(prog))
+	res := runResults(t, prog)
+	if c.expect != nil {
+		assert.Equal(t, c.expect, res, "expected unoptimized results")
+	}
+	assert.Equal(t, res, runResults(t, oprog), "expected same results")
+}
+
+type optimizerResult struct {
+	Values [][]uint32
+	Code   uint32
+}
+
+func runResults(t *testing.T, prog []byte) []optimizerResult {
+	m, err := stackvm.New(prog)
+	require.NoError(t, err, "unexpected load error")
+	var res []optimizerResult
+	m.SetHandler(100, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+		code, halted := m.HaltCode()
+		if !halted {
+			return m.Err()
+		}
+		var r optimizerResult
+		r.Code = code
+		if code == 0 {
+			vals, err := m.Values()
+			if err != nil {
+				return err
+			}
+			r.Values = vals
+		}
+		res = append(res, r)
+		return nil
+	}))
+	require.NoError(t, m.Run(), "unexpected run error")
+	return res
+}
+
+func TestAssembleOptimized(t *testing.T) {
+	for _, c := range []optimizerCase{
+		{
+			name: "folds pushed immediates",
+			in: []interface{}{
+				0x40,
+				0x100, "push", 7, "push", "store",
+				0x100, "push", "fetch",
+				3, "push", "add",
+				2, "push", "mul",
+				20, "push", "eq",
+				1, "hz",
+				0x104, "push", 0x100, "push", 2, "p2c",
+				"halt",
+			},
+			expect: []optimizerResult{{Values: [][]uint32{{7}}}},
+		},
+
+		{
+			name: "does not fold divmod",
+			in: []interface{}{
+				0x40,
+				17, "push", 5, "push", "divmod",
+				0x104, "push", "storeTo",
+				0x100, "push", "storeTo",
+				0x108, "push", 0x100, "push", 2, "p2c",
+				"halt",
+			},
+			expect: []optimizerResult{{Values: [][]uint32{{5, 0}}}},
+		},
+
+		{
+			name: "drops dup pop",
+			in: []interface{}{
+				0x40,
+				5, "push", "dup", "pop",
+				"dup", "pop", 0x100, "push", "swap", "store",
+				0x104, "push", 0x100, "push", 2, "p2c",
+				"halt",
+			},
+			expect: []optimizerResult{{Values: [][]uint32{{5}}}},
+		},
+
+		{
+			name: "threads jump chains",
+			in: []interface{}{
+				0x40,
+				0, "push",
+				"loop:",
+				1, "push", "add",
+				"dup", 5, "push", "lt", ":hop1", "jnz",
+				0x100, "push", "swap", "store",
+				0x104, "push", 0x100, "push", 2, "p2c",
+				"halt",
+				"hop1:", ":hop2", "jump",
+				"hop2:", ":loop", "jump",
+			},
+			expect: []optimizerResult{{Values: [][]uint32{{5}}}},
+		},
+
+		{
+			name: "collatz explore",
+			in: []interface{}{
+				0x40,
+				6, "push", 0x100, "push", 0x100, "push", 3, "p2c",
+				1, "push",
+				"round:",
+				"dup", 1, "push", "sub", 3, "push", "mod",
+				":third", "fz",
+				"double:", 2, "push", "mul",
+				":next", "jump",
+				"third:", 1, "push", "sub", 3, "push", "div",
+				"next:",
+				"dup", 1, "hz",
+				"dup", 2, "c2p",
+				"dup", 4, "push", "add", "p2c",
+				"swap", "p2c", "storeTo",
+				"c2p", 1, "push", "sub",
+				"dup", "p2c", 0, "push", "gt",
+				":round", "jnz",
+				"pop", "cpop", "halt",
+			},
+		},
+	} {
+		t.Run(c.name, c.run)
+	}
+}
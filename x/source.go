@@ -0,0 +1,64 @@
+package xstackvm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseSource parses textual assembly source into the tokens taken by
+// Assemble. Tokens are separated by whitespace, and a "#" starts a comment
+// that runs to the end of its line. Integers, either decimal or hex with a
+// "0x" prefix, and optionally negative, become ints; everything else stays a
+// string, so that labels, refs, and operation names are written just as they
+// would be passed to Assemble. As with Assemble, the first token must be the
+// stack size, e.g.:
+//
+//	0x40
+//	    5 push 0x100 storeTo  # x = 5
+//	loop:
+//	    ...
+func ParseSource(r io.Reader) ([]interface{}, error) {
+	var toks []interface{}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := sc.Text()
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		for _, field := range strings.Fields(s) {
+			if !isNumeric(field) {
+				toks = append(toks, field)
+				continue
+			}
+			n, err := strconv.ParseInt(field, 0, 64)
+			if err != nil || n < -1<<31 || n > 1<<32-1 {
+				return nil, fmt.Errorf("line %d: invalid number %q", line, field)
+			}
+			toks = append(toks, int(n))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return toks, nil
+}
+
+// AssembleSource parses and assembles textual assembly source; see
+// ParseSource and Assemble.
+func AssembleSource(r io.Reader) ([]byte, error) {
+	toks, err := ParseSource(r)
+	if err != nil {
+		return nil, err
+	}
+	return Assemble(toks...)
+}
+
+func isNumeric(s string) bool {
+	if len(s) > 1 && s[0] == '-' {
+		s = s[1:]
+	}
+	return len(s) > 0 && '0' <= s[0] && s[0] <= '9'
+}
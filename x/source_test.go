@@ -0,0 +1,49 @@
+package xstackvm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/jcorbin/stackvm/x"
+)
+
+func TestParseSource(t *testing.T) {
+	toks, err := ParseSource(strings.NewReader(`
+# count down from 3
+0x40
+	3 push         # n
+loop:
+	dup -1 add
+	dup :loop jnz
+	0 halt
+`))
+	require.NoError(t, err, "unexpected parse error")
+	assert.Equal(t, []interface{}{
+		0x40,
+		3, "push",
+		"loop:",
+		"dup", -1, "add",
+		"dup", ":loop", "jnz",
+		0, "halt",
+	}, toks, "expected tokens")
+
+	prog, err := Assemble(toks...)
+	require.NoError(t, err, "unexpected assemble error")
+	src, err := AssembleSource(strings.NewReader("0x40 3 push loop: dup -1 add dup :loop jnz 0 halt"))
+	require.NoError(t, err, "unexpected assemble error")
+	assert.Equal(t, prog, src, "expected the same program")
+
+	for _, in := range []string{
+		"0x40 0xzz push",
+		"0x40 1a push",
+		"0x40 0x100000000 push",
+	} {
+		_, err := ParseSource(strings.NewReader(in))
+		assert.Error(t, err, "expected error parsing %q", in)
+	}
+	_, err = AssembleSource(strings.NewReader("0x40 :nowhere jump"))
+	assert.Error(t, err, "expected undefined label error")
+}
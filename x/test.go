@@ -20,13 +20,17 @@ import (
 var (
 	traceFlag   bool
 	dumpMemFlag action.PredicateFlag
+	watchFlag   action.PredicateFlag
 )
 
 func init() {
 	flag.BoolVar(&traceFlag, "stackvm.test.trace", false,
 		"run any stackvm tests with tracing on, even if they pass")
 	flag.Var(&dumpMemFlag, "stackvm.test.dumpmem",
-		"dump memory when the given predicates are true (FIXME predicates?!?)")
+		"dump memory when the given predicate is true, e.g. \"before && ps>10\" or \"after && mem[0x140]=7\"")
+	flag.Var(&watchFlag, "stackvm.test.watch",
+		"log fetch, store, and storeTo ops that access watched memory, e.g. \"watch(mem[0x140])\" or \"watch(mem[0x100..0x10c]:read,write) && id=1(*:*)\"; "+
+			"words changed any other way, e.g. by stack ops or handlers, aren't seen")
 }
 
 // TestCases is list of test cases for stackvm.
@@ -39,6 +43,9 @@ type TestCase struct {
 	Prog      []byte
 	Err       string
 	QueueSize int
+	Overflow  stackvm.OverflowPolicy
+	Compile   bool
+	Coverage  *Coverage
 	Handler   func(*stackvm.Mach) ([]byte, error)
 	Result    TestCaseResult
 }
@@ -103,6 +110,16 @@ func (tc TestCase) LogTo(w io.Writer) TestCase {
 	return tc
 }
 
+// Compiled returns a copy of the test case that compiles its machine before
+// running it; see (*stackvm.Mach).Compile.
+func (tc TestCase) Compiled() TestCase {
+	tc.Compile = true
+	if tc.Name != "" {
+		tc.Name += " compiled"
+	}
+	return tc
+}
+
 // Run runs the test case; it either succeeds quietly, or fails with a trace
 // log.
 func (tc TestCase) Run(t *testing.T) {
@@ -110,8 +127,11 @@ func (tc TestCase) Run(t *testing.T) {
 		TB:       t,
 		TestCase: tc,
 	}
-	if traceFlag || run.canaryFailed() {
-		run.trace()
+	if traceFlag {
+		run.trace(true)
+	} else if run.canaryFailed() {
+		// coverage was already collected by the canary run
+		run.trace(false)
 	}
 }
 
@@ -134,12 +154,12 @@ func (tc TestCase) Trace(t *testing.T) {
 		TB:       t,
 		TestCase: tc,
 	}
-	run.trace()
+	run.trace(true)
 }
 
 func (t testCaseRun) contextLog(m *stackvm.Mach) func(string, ...interface{}) {
 	logf := t.Logf
-	if v, def := m.Tracer().Context(m, "logf"); def {
+	if v, def := m.Observer().Context(m, "logf"); def {
 		if f, ok := v.(func(string, ...interface{})); ok {
 			logf = f
 		}
@@ -154,6 +174,13 @@ func (t testCaseRun) queueSize() int {
 	return t.QueueSize
 }
 
+func (t testCaseRun) setHandler(m *stackvm.Mach, h stackvm.Handler) {
+	m.SetHandler(t.queueSize(), h)
+	if t.Overflow != nil {
+		require.NoError(t, m.SetOverflowPolicy(t.Overflow), "unexpected overflow policy error")
+	}
+}
+
 func (t *testCaseRun) init() {
 	if t.Logf == nil {
 		t.Logf = t.TB.Logf
@@ -165,7 +192,7 @@ func (t testCaseRun) bench() {
 	m := t.build()
 	fin := t.Result.start(t.TB, m)
 	if h, ok := fin.(stackvm.Handler); ok {
-		m.SetHandler(t.queueSize(), h)
+		t.setHandler(m, h)
 	}
 	t.checkError(m.Run())
 	fin.finish(m)
@@ -177,16 +204,20 @@ func (t testCaseRun) canaryFailed() bool {
 	m := t.build()
 	fin := t.Result.start(t.TB, m)
 	if h, ok := fin.(stackvm.Handler); ok {
-		m.SetHandler(t.queueSize(), h)
+		t.setHandler(m, h)
+	}
+	if t.Coverage != nil {
+		t.checkError(m.Trace(t.Coverage.tracer(t.TestCase)))
+	} else {
+		t.checkError(m.Run())
 	}
-	t.checkError(m.Run())
 	fin.finish(m)
 	return t.Failed()
 }
 
-func (t testCaseRun) trace() {
+func (t testCaseRun) trace(cover bool) {
 	t.init()
-	trc := tracer.Multi(
+	trcs := []stackvm.Observer{
 		tracer.NewIDTracer(),
 		tracer.NewCountTracer(),
 		tracer.NewLogTracer(t.Logf),
@@ -196,14 +227,21 @@ func (t testCaseRun) trace() {
 			}),
 			dumpMemFlag.Build(),
 		),
-	)
+	}
+	if watch := watchFlag.Build(); watch != action.Never {
+		trcs = append(trcs, tracer.NewWatchTracer(tracer.LogWatch(t.Logf), watch))
+	}
+	if cover && t.Coverage != nil {
+		trcs = append(trcs, t.Coverage.tracer(t.TestCase))
+	}
+	trc := tracer.Multi(trcs...)
 
 	m := t.build()
 	fin := t.Result.start(t.TB, m)
 	if h, ok := fin.(stackvm.Handler); ok {
-		m.SetHandler(t.queueSize(), h)
+		t.setHandler(m, h)
 	}
-	t.checkError(m.Trace(trc))
+	t.checkError(tracer.Run(m, trc))
 	fin.finish(m)
 }
 
@@ -216,6 +254,9 @@ func (t testCaseRun) logLines(s string) {
 func (t testCaseRun) build() *stackvm.Mach {
 	m, err := stackvm.New(t.Prog)
 	require.NoError(t, err, "unexpected machine compile error")
+	if t.Compile {
+		m.Compile()
+	}
 	return m
 }
 
@@ -0,0 +1,173 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jcorbin/stackvm"
+)
+
+// condOps are those operations that may, or may not, take their action
+// depending on the value that they pop.
+var condOps = map[string]bool{
+	"jz": true, "jnz": true,
+	"fz": true, "fnz": true,
+	"bz": true, "bnz": true,
+	"hz": true, "hnz": true,
+}
+
+// BranchCount counts how many times a conditional operation did, or did not,
+// take its action: jumping, forking, branching, or halting.
+type BranchCount struct {
+	Taken    int64
+	NotTaken int64
+}
+
+// Coverage is a tracer that records how many times each ip was executed, and
+// which directions each conditional operation went.
+type Coverage struct {
+	Hits     map[uint32]int64
+	Branches map[uint32]BranchCount
+
+	pending map[*stackvm.Mach]pendingCond
+}
+
+type pendingCond struct {
+	ip, end uint32
+	taken   bool
+}
+
+// NewCoverage creates a new coverage tracer.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		Hits:     make(map[uint32]int64),
+		Branches: make(map[uint32]BranchCount),
+		pending:  make(map[*stackvm.Mach]pendingCond),
+	}
+}
+
+// Context returns the coverage tracer itself for the "coverage" key.
+func (c *Coverage) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	if key != "coverage" {
+		return nil, false
+	}
+	return c, true
+}
+
+// Begin does nothing.
+func (c *Coverage) Begin(m *stackvm.Mach) {}
+
+// Before records a hit, and notes any conditional operation.
+func (c *Coverage) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	c.Hits[ip]++
+	if condOps[op.Name()] {
+		if _, end, err := m.ReadOp(ip); err == nil {
+			c.pending[m] = pendingCond{ip: ip, end: end}
+		}
+	}
+}
+
+// After resolves any conditional operation: it was taken if it forked or
+// branched, or if it didn't fall through.
+func (c *Coverage) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	if pc, def := c.pending[m]; def {
+		delete(c.pending, m)
+		c.count(pc.ip, pc.taken || ip != pc.end)
+	}
+}
+
+// Queue marks any conditional operation as taken.
+func (c *Coverage) Queue(m, n *stackvm.Mach) {
+	if pc, def := c.pending[m]; def {
+		pc.taken = true
+		c.pending[m] = pc
+	}
+}
+
+// End resolves any conditional operation that the machine ended on; a halting
+// operation was taken if the machine halted.
+func (c *Coverage) End(m *stackvm.Mach) {
+	if pc, def := c.pending[m]; def {
+		delete(c.pending, m)
+		_, halted := m.HaltCode()
+		c.count(pc.ip, pc.taken || halted)
+	}
+}
+
+// Handle does nothing.
+func (c *Coverage) Handle(m *stackvm.Mach, err error) {}
+
+func (c *Coverage) count(ip uint32, taken bool) {
+	bc := c.Branches[ip]
+	if taken {
+		bc.Taken++
+	} else {
+		bc.NotTaken++
+	}
+	c.Branches[ip] = bc
+}
+
+// WriteReport writes a disassembly listing of the given machine's code, which
+// should have been loaded from the traced program, annotated with hit and
+// branch counts; unexecuted operations are marked with "-". A summary line
+// follows the listing.
+func (c *Coverage) WriteReport(w io.Writer, m *stackvm.Mach) error {
+	var (
+		ops, hit     int
+		dirs, dirHit int
+	)
+	syms := m.Symbols()
+	start, end := m.CodeRange()
+	for ip := start; ip < end; {
+		for _, sym := range syms {
+			if sym.Addr == ip {
+				if _, err := fmt.Fprintf(w, "%s:\n", sym.Name); err != nil {
+					return err
+				}
+			}
+		}
+
+		op, next, err := m.ReadOp(ip)
+		if err != nil {
+			if _, err := fmt.Fprintf(w, "%8s  @%#04x  ?? %v\n", "", ip, err); err != nil {
+				return err
+			}
+			ip++
+			continue
+		}
+
+		ops++
+		count := "-"
+		if n := c.Hits[ip]; n > 0 {
+			hit++
+			count = fmt.Sprint(n)
+		}
+		line := fmt.Sprintf("%8s  @%#04x  %v", count, ip, op)
+		if condOps[op.Name()] {
+			bc := c.Branches[ip]
+			dirs += 2
+			if bc.Taken > 0 {
+				dirHit++
+			}
+			if bc.NotTaken > 0 {
+				dirHit++
+			}
+			line = fmt.Sprintf("%-36s taken:%d not-taken:%d", line, bc.Taken, bc.NotTaken)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		ip = next
+	}
+
+	_, err := fmt.Fprintf(w, "coverage: %d/%d ops (%.1f%%), %d/%d branch directions (%.1f%%)\n",
+		hit, ops, percent(hit, ops), dirHit, dirs, percent(dirHit, dirs))
+	return err
+}
+
+func percent(n, d int) float64 {
+	if d == 0 {
+		return 100
+	}
+	return 100 * float64(n) / float64(d)
+}
@@ -0,0 +1,245 @@
+package tracer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/internal/errors"
+)
+
+// GraphNode is one machine in a Graph.
+type GraphNode struct {
+	ID      MachID
+	Parent  MachID // zero for the root machine
+	ForkIP  uint32 // ip of the parent's op that queued the machine
+	Ops     int    // ops run by the machine itself, since it was queued
+	Outcome string // halt or error, or values, once the machine has ended
+}
+
+// Graph is a tracer that records the lineage of machines, which it can then
+// write out in Graphviz DOT format. Machine ids are taken from the "id"
+// context key, so it should be combined with NewIDTracer; nodes may also be
+// added directly, e.g. from a parsed trace log.
+type Graph struct {
+	// MaxDepth, if positive, collapses every machine deeper than it into a
+	// single node under its ancestor at MaxDepth.
+	MaxDepth int
+
+	// CollapseOutcomes collapses any subtree whose machines all had the same
+	// outcome into a single node.
+	CollapseOutcomes bool
+
+	nodes map[MachID]*GraphNode
+	live  map[*stackvm.Mach]*GraphNode
+	last  map[*stackvm.Mach]uint32 // ip of the last op started
+}
+
+// NewGraph creates a new, empty, graph tracer.
+func NewGraph() *Graph {
+	return &Graph{
+		nodes: make(map[MachID]*GraphNode),
+		live:  make(map[*stackvm.Mach]*GraphNode),
+		last:  make(map[*stackvm.Mach]uint32),
+	}
+}
+
+// Add adds a node to the graph, replacing any prior node with the same id.
+func (g *Graph) Add(node GraphNode) {
+	g.nodes[node.ID] = &node
+}
+
+// Context returns the graph itself for the "graph" key.
+func (g *Graph) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	if key != "graph" {
+		return nil, false
+	}
+	return g, true
+}
+
+// Begin adds a node for any machine that wasn't queued.
+func (g *Graph) Begin(m *stackvm.Mach) {
+	if _, def := g.live[m]; def {
+		return
+	}
+	if id, ok := g.machID(m); ok {
+		node := &GraphNode{ID: id}
+		g.nodes[id] = node
+		g.live[m] = node
+	}
+}
+
+// Queue adds a node for the new machine.
+func (g *Graph) Queue(m, n *stackvm.Mach) {
+	par, ok := g.live[m]
+	if !ok {
+		return
+	}
+	id, ok := g.machID(n)
+	if !ok {
+		return
+	}
+	ip, def := g.last[m]
+	if !def {
+		ip = m.IP()
+	}
+	node := &GraphNode{ID: id, Parent: par.ID, ForkIP: ip}
+	g.nodes[id] = node
+	g.live[n] = node
+}
+
+// Before counts the op, and notes its ip.
+func (g *Graph) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	if node, ok := g.live[m]; ok {
+		node.Ops++
+	}
+	g.last[m] = ip
+}
+
+// After does nothing.
+func (g *Graph) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {}
+
+// End records the machine's outcome.
+func (g *Graph) End(m *stackvm.Mach) {
+	node, ok := g.live[m]
+	if !ok {
+		return
+	}
+	if err := m.Err(); err != nil {
+		node.Outcome = errors.Cause(err).Error()
+	} else if vs, err := m.Values(); err != nil {
+		node.Outcome = fmt.Sprintf("values_err=%v", err)
+	} else {
+		node.Outcome = fmt.Sprintf("values=%v", vs)
+	}
+}
+
+// Handle forgets the machine, which may be reused after it's been handled.
+func (g *Graph) Handle(m *stackvm.Mach, err error) {
+	delete(g.live, m)
+	delete(g.last, m)
+}
+
+func (g *Graph) machID(m *stackvm.Mach) (MachID, bool) {
+	mid, _ := m.Observer().Context(m, "id")
+	id, ok := mid.(MachID)
+	return id, ok
+}
+
+// WriteDOT writes the graph in Graphviz DOT format: nodes are labeled with
+// their id, op count, and outcome; edges with the ip of the fork that queued
+// the child.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	kids := make(map[MachID][]*GraphNode, len(g.nodes))
+	var roots []*GraphNode
+	for _, node := range g.nodes {
+		if _, def := g.nodes[node.Parent]; node.Parent == (MachID{}) || !def {
+			roots = append(roots, node)
+		} else {
+			kids[node.Parent] = append(kids[node.Parent], node)
+		}
+	}
+	sortGraphNodes(roots)
+	for _, ns := range kids {
+		sortGraphNodes(ns)
+	}
+
+	gw := graphWriter{Graph: g, kids: kids, w: bufio.NewWriter(w)}
+	gw.printf("digraph stackvm {\n")
+	gw.printf("\tnode [shape=box, fontname=monospace];\n")
+	for _, root := range roots {
+		gw.node(root, 0)
+	}
+	gw.printf("}\n")
+	if gw.err == nil {
+		gw.err = gw.w.Flush()
+	}
+	return gw.err
+}
+
+type graphWriter struct {
+	*Graph
+	kids map[MachID][]*GraphNode
+	w    *bufio.Writer
+	err  error
+}
+
+func (gw *graphWriter) printf(format string, args ...interface{}) {
+	if gw.err == nil {
+		_, gw.err = fmt.Fprintf(gw.w, format, args...)
+	}
+}
+
+func (gw *graphWriter) node(node *GraphNode, depth int) {
+	kids := gw.kids[node.ID]
+	if len(kids) > 0 && gw.CollapseOutcomes {
+		if outcome, n, same := gw.sameOutcome(node); same {
+			gw.printf("\t%q [label=%q, style=dashed];\n",
+				node.ID.String(), fmt.Sprintf("%v\n%d machines\n%s", node.ID, n, outcome))
+			return
+		}
+	}
+	gw.printf("\t%q [label=%q];\n",
+		node.ID.String(), fmt.Sprintf("%v\n%d ops\n%s", node.ID, node.Ops, node.Outcome))
+	if len(kids) == 0 {
+		return
+	}
+	if gw.MaxDepth > 0 && depth >= gw.MaxDepth {
+		counts := make(map[string]int)
+		n := 0
+		for _, kid := range kids {
+			n += gw.countOutcomes(kid, counts)
+		}
+		outcomes := make([]string, 0, len(counts))
+		for outcome, count := range counts {
+			outcomes = append(outcomes, fmt.Sprintf("%d× %s", count, outcome))
+		}
+		sort.Strings(outcomes)
+		id := node.ID.String() + "+"
+		gw.printf("\t%q [label=%q, style=dashed];\n",
+			id, fmt.Sprintf("%d more machines\n%s", n, strings.Join(outcomes, "\n")))
+		gw.printf("\t%q -> %q;\n", node.ID.String(), id)
+		return
+	}
+	for _, kid := range kids {
+		gw.printf("\t%q -> %q [label=%q];\n",
+			node.ID.String(), kid.ID.String(), fmt.Sprintf("@%#04x", kid.ForkIP))
+		gw.node(kid, depth+1)
+	}
+}
+
+// sameOutcome returns the outcome, and size, of the node's subtree if all of
+// its machines had the same outcome.
+func (gw *graphWriter) sameOutcome(node *GraphNode) (string, int, bool) {
+	n := 1
+	for _, kid := range gw.kids[node.ID] {
+		outcome, m, same := gw.sameOutcome(kid)
+		if !same || outcome != node.Outcome {
+			return "", 0, false
+		}
+		n += m
+	}
+	return node.Outcome, n, true
+}
+
+func (gw *graphWriter) countOutcomes(node *GraphNode, counts map[string]int) int {
+	counts[node.Outcome]++
+	n := 1
+	for _, kid := range gw.kids[node.ID] {
+		n += gw.countOutcomes(kid, counts)
+	}
+	return n
+}
+
+func sortGraphNodes(ns []*GraphNode) {
+	sort.Slice(ns, func(i, j int) bool {
+		a, b := ns[i].ID, ns[j].ID
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		return a[2] < b[2]
+	})
+}
@@ -0,0 +1,75 @@
+package tracer_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestGraph_WriteDOT(t *testing.T) {
+	build := func(t *testing.T, configure func(*tracer.Graph)) string {
+		g := tracer.NewGraph()
+		configure(g)
+		for _, node := range []tracer.GraphNode{
+			{ID: tracer.MachID{1, 3, 4}, Parent: tracer.MachID{1, 1, 3}, ForkIP: 0x48, Ops: 1, Outcome: "HALT(2)"},
+			{ID: tracer.MachID{1, 1, 3}, Parent: tracer.MachID{1, 0, 1}, ForkIP: 0x44, Ops: 2, Outcome: "HALT(2)"},
+			{ID: tracer.MachID{1, 1, 2}, Parent: tracer.MachID{1, 0, 1}, ForkIP: 0x40, Ops: 1, Outcome: "HALT(1)"},
+			{ID: tracer.MachID{1, 0, 1}, Ops: 3, Outcome: "HALT(1)"},
+			// a node whose parent is missing, e.g. from a partial log, is a root
+			{ID: tracer.MachID{2, 5, 6}, Parent: tracer.MachID{2, 0, 5}, ForkIP: 0x40, Ops: 1, Outcome: "HALT(3)"},
+		} {
+			g.Add(node)
+		}
+		var buf bytes.Buffer
+		require.NoError(t, g.WriteDOT(&buf), "unexpected write error")
+		return buf.String()
+	}
+
+	for _, tc := range []struct {
+		name      string
+		configure func(*tracer.Graph)
+		out       []string
+	}{
+		{"full", func(*tracer.Graph) {}, []string{
+			`"1(0:1)" [label="1(0:1)\n3 ops\nHALT(1)"];`,
+			`"1(0:1)" -> "1(1:2)" [label="@0x0040"];`,
+			`"1(1:2)" [label="1(1:2)\n1 ops\nHALT(1)"];`,
+			`"1(0:1)" -> "1(1:3)" [label="@0x0044"];`,
+			`"1(1:3)" [label="1(1:3)\n2 ops\nHALT(2)"];`,
+			`"1(1:3)" -> "1(3:4)" [label="@0x0048"];`,
+			`"1(3:4)" [label="1(3:4)\n1 ops\nHALT(2)"];`,
+			`"2(5:6)" [label="2(5:6)\n1 ops\nHALT(3)"];`,
+		}},
+		{"depth", func(g *tracer.Graph) { g.MaxDepth = 1 }, []string{
+			`"1(0:1)" [label="1(0:1)\n3 ops\nHALT(1)"];`,
+			`"1(0:1)" -> "1(1:2)" [label="@0x0040"];`,
+			`"1(1:2)" [label="1(1:2)\n1 ops\nHALT(1)"];`,
+			`"1(0:1)" -> "1(1:3)" [label="@0x0044"];`,
+			`"1(1:3)" [label="1(1:3)\n2 ops\nHALT(2)"];`,
+			`"1(1:3)+" [label="1 more machines\n1× HALT(2)", style=dashed];`,
+			`"1(1:3)" -> "1(1:3)+";`,
+			`"2(5:6)" [label="2(5:6)\n1 ops\nHALT(3)"];`,
+		}},
+		{"outcomes", func(g *tracer.Graph) { g.CollapseOutcomes = true }, []string{
+			`"1(0:1)" [label="1(0:1)\n3 ops\nHALT(1)"];`,
+			`"1(0:1)" -> "1(1:2)" [label="@0x0040"];`,
+			`"1(1:2)" [label="1(1:2)\n1 ops\nHALT(1)"];`,
+			`"1(0:1)" -> "1(1:3)" [label="@0x0044"];`,
+			`"1(1:3)" [label="1(1:3)\n2 machines\nHALT(2)", style=dashed];`,
+			`"2(5:6)" [label="2(5:6)\n1 ops\nHALT(3)"];`,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := "digraph stackvm {\n\tnode [shape=box, fontname=monospace];\n"
+			for _, line := range tc.out {
+				want += "\t" + line + "\n"
+			}
+			want += "}\n"
+			assert.Equal(t, want, build(t, tc.configure), "expected DOT output")
+		})
+	}
+}
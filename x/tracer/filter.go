@@ -5,49 +5,60 @@ import (
 	"github.com/jcorbin/stackvm/x/action"
 )
 
-// Filtered returns a tracer that calls the given tracer's methods only if the
-// given predicate tests true. Context simply passes through.
-func Filtered(t stackvm.Tracer, p action.Predicate) stackvm.Tracer {
-	return filter{t, p}
+// Filtered returns an observer that calls the given observer's methods only if
+// the given predicate tests true; it's only also a tracer if the given observer
+// is, in which case Before() and After() are filtered too. Context simply
+// passes through.
+func Filtered(o stackvm.Observer, p action.Predicate) stackvm.Observer {
+	f := filter{o, p}
+	if t, ok := o.(stackvm.Tracer); ok {
+		return filterTracer{f, t}
+	}
+	return f
 }
 
 type filter struct {
-	stackvm.Tracer
+	stackvm.Observer
 	action.Predicate
 }
 
+type filterTracer struct {
+	filter
+	t stackvm.Tracer
+}
+
 func (f filter) Begin(m *stackvm.Mach) {
-	if f.Test(action.TraceBegin, 0, stackvm.Op{}) {
-		f.Tracer.Begin(m)
+	if f.Test(m, action.TraceBegin, 0, stackvm.Op{}) {
+		f.Observer.Begin(m)
 	}
 }
 
 func (f filter) End(m *stackvm.Mach) {
-	if f.Test(action.TraceEnd, 0, stackvm.Op{}) {
-		f.Tracer.End(m)
+	if f.Test(m, action.TraceEnd, 0, stackvm.Op{}) {
+		f.Observer.End(m)
 	}
 }
 
-func (f filter) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
-	if f.Test(action.TraceBefore, ip, op) {
-		f.Tracer.Before(m, ip, op)
+func (f filterTracer) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	if f.Test(m, action.TraceBefore, ip, op) {
+		f.t.Before(m, ip, op)
 	}
 }
 
-func (f filter) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
-	if f.Test(action.TraceAfter, ip, op) {
-		f.Tracer.After(m, ip, op)
+func (f filterTracer) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	if f.Test(m, action.TraceAfter, ip, op) {
+		f.t.After(m, ip, op)
 	}
 }
 
 func (f filter) Queue(m, n *stackvm.Mach) {
-	if f.Test(action.TraceQueue, 0, stackvm.Op{}) {
-		f.Tracer.Queue(m, n)
+	if f.Test(m, action.TraceQueue, 0, stackvm.Op{}) {
+		f.Observer.Queue(m, n)
 	}
 }
 
 func (f filter) Handle(m *stackvm.Mach, err error) {
-	if f.Test(action.TraceHandle, 0, stackvm.Op{}) {
-		f.Tracer.Handle(m, err)
+	if f.Test(m, action.TraceHandle, 0, stackvm.Op{}) {
+		f.Observer.Handle(m, err)
 	}
 }
@@ -0,0 +1,36 @@
+package tracer_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/action"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestFiltered(t *testing.T) {
+	p, err := action.ParsePredicate("before:halt || handle")
+	require.NoError(t, err, "unexpected predicate error")
+	var log []string
+
+	o := tracer.Filtered(recorder{"a", &log}, p)
+	_, isTracer := o.(stackvm.Tracer)
+	assert.False(t, isTracer, "expected no tracer")
+	val, _ := o.Context(nil, "a")
+	assert.Equal(t, "a", val, "expected context to pass through")
+	run(t, o)
+	assert.Equal(t, []string{"a handle", "a handle"}, log, "expected only handles")
+
+	log = nil
+	o = tracer.Filtered(traceRecorder{recorder{"a", &log}}, p)
+	_, isTracer = o.(stackvm.Tracer)
+	assert.True(t, isTracer, "expected a tracer")
+	run(t, o)
+	assert.Equal(t, []string{
+		"a before halt", "a handle",
+		"a before halt", "a handle",
+	}, log, "expected only halts and handles")
+}
@@ -21,8 +21,8 @@ func (mid MachID) String() string {
 	return fmt.Sprintf("%d(%d:%d)", mid[0], mid[1], mid[2])
 }
 
-// NewIDTracer creates a tracer that assigns MachIDs to machines.
-func NewIDTracer() stackvm.Tracer {
+// NewIDTracer creates an observer that assigns MachIDs to machines.
+func NewIDTracer() stackvm.Observer {
 	return &idTracer{
 		ids: make(map[*stackvm.Mach]MachID),
 	}
@@ -50,12 +50,6 @@ func (it *idTracer) Begin(m *stackvm.Mach) {
 	}
 }
 
-func (it *idTracer) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
-}
-
-func (it *idTracer) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
-}
-
 func (it *idTracer) Queue(m, n *stackvm.Mach) {
 	delete(it.ids, n)
 	if mid, def := it.ids[m]; def {
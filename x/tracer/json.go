@@ -0,0 +1,127 @@
+package tracer
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/internal/errors"
+)
+
+// JSONEvent is a single trace event, as written by a JSON tracer.
+type JSONEvent struct {
+	ID     MachID     `json:"id"`
+	Parent MachID     `json:"parent"` // zero for machines that weren't queued
+	Count  int        `json:"count"`
+	Action string     `json:"action"` // begin, queue, before, after, end, or handle
+	IP     uint32     `json:"ip"`
+	Op     string     `json:"op,omitempty"`
+	Arg    *uint32    `json:"arg,omitempty"`
+	PS     []uint32   `json:"ps,omitempty"`
+	CS     []uint32   `json:"cs,omitempty"`
+	Values [][]uint32 `json:"values,omitempty"`
+	Err    string     `json:"err,omitempty"`
+}
+
+// NewJSONTracer creates a tracer that writes one JSON object, a JSONEvent, per
+// line for every trace event. Machine ids and counts are taken from the "id"
+// and "count" context keys, like NewLogTracer; the first write error stops
+// all further output.
+func NewJSONTracer(w io.Writer) stackvm.Tracer {
+	return &jsonTracer{
+		enc:     json.NewEncoder(w),
+		parents: make(map[*stackvm.Mach]MachID),
+	}
+}
+
+type jsonTracer struct {
+	enc     *json.Encoder
+	err     error
+	parents map[*stackvm.Mach]MachID
+}
+
+func (jt *jsonTracer) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	return nil, false
+}
+
+func (jt *jsonTracer) Begin(m *stackvm.Mach) {
+	ev := jt.event(m, "begin")
+	jt.stacks(m, &ev)
+	jt.write(ev)
+}
+
+func (jt *jsonTracer) Queue(m, n *stackvm.Mach) {
+	mid, _ := m.Observer().Context(m, "id")
+	if id, ok := mid.(MachID); ok {
+		jt.parents[n] = id
+	}
+	jt.write(jt.event(n, "queue"))
+}
+
+func (jt *jsonTracer) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	ev := jt.event(m, "before")
+	ev.Op = op.Name()
+	if op.Have {
+		arg := op.Arg
+		ev.Arg = &arg
+	}
+	jt.stacks(m, &ev)
+	jt.write(ev)
+}
+
+func (jt *jsonTracer) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	ev := jt.event(m, "after")
+	jt.stacks(m, &ev)
+	jt.write(ev)
+}
+
+func (jt *jsonTracer) End(m *stackvm.Mach) {
+	ev := jt.event(m, "end")
+	if err := m.Err(); err != nil {
+		ev.Err = errors.Cause(err).Error()
+	} else if vs, err := m.Values(); err != nil {
+		ev.Err = err.Error()
+	} else {
+		ev.Values = vs
+	}
+	jt.write(ev)
+}
+
+func (jt *jsonTracer) Handle(m *stackvm.Mach, err error) {
+	ev := jt.event(m, "handle")
+	if err != nil {
+		ev.Err = err.Error()
+	}
+	jt.write(ev)
+	delete(jt.parents, m)
+}
+
+func (jt *jsonTracer) event(m *stackvm.Mach, action string) JSONEvent {
+	ev := JSONEvent{
+		Parent: jt.parents[m],
+		Action: action,
+		IP:     m.IP(),
+	}
+	if mid, _ := m.Observer().Context(m, "id"); mid != nil {
+		ev.ID, _ = mid.(MachID)
+	}
+	if count, _ := m.Observer().Context(m, "count"); count != nil {
+		ev.Count, _ = count.(int)
+	}
+	return ev
+}
+
+func (jt *jsonTracer) stacks(m *stackvm.Mach, ev *JSONEvent) {
+	ps, cs, err := m.Stacks()
+	if err != nil {
+		ev.Err = err.Error()
+		return
+	}
+	ev.PS, ev.CS = ps, cs
+}
+
+func (jt *jsonTracer) write(ev JSONEvent) {
+	if jt.err == nil {
+		jt.err = jt.enc.Encode(ev)
+	}
+}
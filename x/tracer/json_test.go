@@ -0,0 +1,48 @@
+package tracer_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestJSONTracer(t *testing.T) {
+	var buf bytes.Buffer
+	run(t, tracer.Multi(
+		tracer.NewIDTracer(),
+		tracer.NewCountTracer(),
+		tracer.NewJSONTracer(&buf),
+	))
+
+	var evs []tracer.JSONEvent
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var ev tracer.JSONEvent
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &ev), "invalid event %q", sc.Bytes())
+		evs = append(evs, ev)
+	}
+	require.NoError(t, sc.Err())
+
+	arg := func(n uint32) *uint32 { return &n }
+	parent := tracer.MachID{1, 0, 1}
+	child := tracer.MachID{1, 1, 2}
+	assert.Equal(t, []tracer.JSONEvent{
+		{ID: parent, Action: "begin", IP: 0x40},
+		{ID: parent, Count: 1, Action: "before", IP: 0x40, Op: "fork", Arg: arg(4)},
+		{ID: child, Parent: parent, Count: 1, Action: "queue", IP: 0x44},
+		{ID: parent, Count: 1, Action: "after", IP: 0x42},
+		{ID: parent, Count: 2, Action: "before", IP: 0x42, Op: "halt", Arg: arg(1)},
+		{ID: parent, Count: 2, Action: "end", IP: 0x44, Err: "HALT(1)"},
+		{ID: parent, Count: 2, Action: "handle", IP: 0x44},
+		{ID: child, Parent: parent, Count: 1, Action: "begin", IP: 0x44},
+		{ID: child, Parent: parent, Count: 2, Action: "before", IP: 0x44, Op: "halt", Arg: arg(2)},
+		{ID: child, Parent: parent, Count: 2, Action: "end", IP: 0x46, Err: "HALT(2)"},
+		{ID: child, Parent: parent, Count: 2, Action: "handle", IP: 0x46},
+	}, evs, "expected events")
+}
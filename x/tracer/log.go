@@ -21,7 +21,7 @@ func (lf logfTracer) Context(m *stackvm.Mach, key string) (interface{}, bool) {
 	if key != "logf" {
 		return nil, false
 	}
-	mid, _ := m.Tracer().Context(m, "id")
+	mid, _ := m.Observer().Context(m, "id")
 	pfx := fmt.Sprintf("%v       ... ", mid)
 	return func(format string, args ...interface{}) {
 		lf(pfx+format, args...)
@@ -43,7 +43,7 @@ func (lf logfTracer) End(m *stackvm.Mach) {
 }
 
 func (lf logfTracer) Queue(m, n *stackvm.Mach) {
-	mid, _ := m.Tracer().Context(m, "id")
+	mid, _ := m.Observer().Context(m, "id")
 	lf.note(n, "+++", fmt.Sprintf("%v copy", mid))
 }
 
@@ -74,9 +74,9 @@ func (lf logfTracer) note(m *stackvm.Mach, mark string, note interface{}, args .
 	var format string
 	var parts []interface{}
 
-	mid, _ := m.Tracer().Context(m, "id")
+	mid, _ := m.Observer().Context(m, "id")
 
-	if count, _ := m.Tracer().Context(m, "count"); count != nil {
+	if count, _ := m.Observer().Context(m, "count"); count != nil {
 		format = "%v #% 4d %s % *v @0x%04x"
 		parts = []interface{}{mid, count, mark, noteWidth, note, m.IP()}
 	} else {
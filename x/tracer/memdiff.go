@@ -0,0 +1,72 @@
+package tracer
+
+import "github.com/jcorbin/stackvm"
+
+// NewMemDiffTracer creates a tracer that logs every memory word changed by
+// each op, by diffing a snapshot of memory taken before the op with memory
+// after it. Like NewLogTracer, machine ids and counts are taken from the "id"
+// and "count" context keys. Since snapshots share pages copy-on-write, every
+// page written to while tracing gets copied, which inflates the run's
+// PageCopies stat (see stackvm.MemSnapshot).
+func NewMemDiffTracer(f func(string, ...interface{})) stackvm.Tracer {
+	return &memDiffTracer{
+		f:     f,
+		snaps: make(map[*stackvm.Mach]memSnap),
+	}
+}
+
+type memDiffTracer struct {
+	f     func(string, ...interface{})
+	snaps map[*stackvm.Mach]memSnap
+}
+
+// memSnap is a snapshot taken before an op.
+type memSnap struct {
+	*stackvm.MemSnapshot
+	ip uint32
+	op stackvm.Op
+}
+
+func (mt *memDiffTracer) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	return nil, false
+}
+
+func (mt *memDiffTracer) Begin(m *stackvm.Mach)    {}
+func (mt *memDiffTracer) Queue(m, n *stackvm.Mach) {}
+
+func (mt *memDiffTracer) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	mt.release(m)
+	mt.snaps[m] = memSnap{m.MemSnapshot(), ip, op}
+}
+
+func (mt *memDiffTracer) After(m *stackvm.Mach, _ uint32, _ stackvm.Op) {
+	snap, ok := mt.snaps[m]
+	if !ok {
+		return
+	}
+	delete(mt.snaps, m)
+	diffs := snap.Diff(m)
+	snap.Release()
+	if len(diffs) == 0 {
+		return
+	}
+	mid, _ := m.Observer().Context(m, "id")
+	count, _ := m.Observer().Context(m, "count")
+	for _, wd := range diffs {
+		mt.f("%v #% 4v @%#04x %v [%#04x] %d -> %d", mid, count, snap.ip, snap.op, wd.Addr, wd.A, wd.B)
+	}
+}
+
+func (mt *memDiffTracer) End(m *stackvm.Mach) {
+	// the last op doesn't get an After
+	mt.release(m)
+}
+
+func (mt *memDiffTracer) Handle(m *stackvm.Mach, err error) {}
+
+func (mt *memDiffTracer) release(m *stackvm.Mach) {
+	if snap, ok := mt.snaps[m]; ok {
+		snap.Release()
+		delete(mt.snaps, m)
+	}
+}
@@ -2,63 +2,88 @@ package tracer
 
 import "github.com/jcorbin/stackvm"
 
-// Multi returns a tracer that calls each of the given tracers in sequence.
-// Handle() is propagated in reverse order. Context() returns the
-// first result with a true flag.
-func Multi(ts ...stackvm.Tracer) stackvm.Tracer {
-	switch len(ts) {
+// Multi returns an observer that calls each of the given observers in
+// sequence; it's only also a tracer if any of them are, in which case
+// Before() and After() are only called on those that are also tracers.
+// Handle() is propagated in reverse order. Context() returns the first result
+// with a true flag.
+func Multi(os ...stackvm.Observer) stackvm.Observer {
+	switch len(os) {
 	case 0:
 		return nil
 	case 1:
-		return ts[0]
-	default:
-		return tracers(ts)
+		return os[0]
 	}
+	var ts []stackvm.Tracer
+	for _, o := range os {
+		if t, ok := o.(stackvm.Tracer); ok {
+			ts = append(ts, t)
+		}
+	}
+	if len(ts) == 0 {
+		return observers(os)
+	}
+	return tracers{observers(os), ts}
+}
+
+// Run runs the machine under the given observer: with (*stackvm.Mach).Trace
+// if it's also a tracer, or else with (*stackvm.Mach).Observe, which does no
+// work per operation.
+func Run(m *stackvm.Mach, o stackvm.Observer) error {
+	if t, ok := o.(stackvm.Tracer); ok {
+		return m.Trace(t)
+	}
+	return m.Observe(o)
 }
 
-type tracers []stackvm.Tracer
+type observers []stackvm.Observer
 
-func (ts tracers) Context(m *stackvm.Mach, key string) (interface{}, bool) {
-	for i := range ts {
-		if val, def := ts[i].Context(m, key); def {
+type tracers struct {
+	observers
+	ts []stackvm.Tracer
+}
+
+func (os observers) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	for i := range os {
+		if val, def := os[i].Context(m, key); def {
 			return val, def
 		}
 	}
 	return nil, false
 }
 
-func (ts tracers) Begin(m *stackvm.Mach) {
-	for i := range ts {
-		ts[i].Begin(m)
+func (os observers) Begin(m *stackvm.Mach) {
+	for i := range os {
+		os[i].Begin(m)
 	}
 }
 
-func (ts tracers) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
-	for i := range ts {
-		ts[i].Before(m, ip, op)
+func (os observers) Queue(m, n *stackvm.Mach) {
+	for i := range os {
+		os[i].Queue(m, n)
 	}
 }
 
-func (ts tracers) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
-	for i := range ts {
-		ts[i].After(m, ip, op)
+func (os observers) End(m *stackvm.Mach) {
+	for i := range os {
+		os[i].End(m)
 	}
 }
 
-func (ts tracers) Queue(m, n *stackvm.Mach) {
-	for i := range ts {
-		ts[i].Queue(m, n)
+func (os observers) Handle(m *stackvm.Mach, err error) {
+	for i := len(os) - 1; i >= 0; i-- {
+		os[i].Handle(m, err)
 	}
 }
 
-func (ts tracers) End(m *stackvm.Mach) {
-	for i := range ts {
-		ts[i].End(m)
+func (ts tracers) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	for i := range ts.ts {
+		ts.ts[i].Before(m, ip, op)
 	}
 }
 
-func (ts tracers) Handle(m *stackvm.Mach, err error) {
-	for i := len(ts) - 1; i >= 0; i-- {
-		ts[i].Handle(m, err)
+func (ts tracers) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	for i := range ts.ts {
+		ts.ts[i].After(m, ip, op)
 	}
 }
@@ -0,0 +1,106 @@
+package tracer_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+var forkProg = MustAssemble(
+	0x40,
+	":kid", "fork",
+	1, "halt",
+	"kid:",
+	2, "halt",
+)
+
+// run runs the fork program under an observer, handling every machine.
+func run(t *testing.T, o stackvm.Observer) {
+	m, err := stackvm.New(forkProg)
+	require.NoError(t, err, "unexpected load error")
+	m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+	require.NoError(t, tracer.Run(m, o), "unexpected run error")
+}
+
+// recorder is an observer that logs every call, and returns its name for
+// either its own name or the "any" context key.
+type recorder struct {
+	name string
+	log  *[]string
+}
+
+func (r recorder) printf(format string, args ...interface{}) {
+	*r.log = append(*r.log, r.name+" "+fmt.Sprintf(format, args...))
+}
+
+func (r recorder) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	if key == r.name || key == "any" {
+		return r.name, true
+	}
+	return nil, false
+}
+
+func (r recorder) Begin(m *stackvm.Mach)             { r.printf("begin") }
+func (r recorder) Queue(m, n *stackvm.Mach)          { r.printf("queue") }
+func (r recorder) End(m *stackvm.Mach)               { r.printf("end") }
+func (r recorder) Handle(m *stackvm.Mach, err error) { r.printf("handle") }
+
+// traceRecorder is a recorder that also logs per-op calls.
+type traceRecorder struct{ recorder }
+
+func (r traceRecorder) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	r.printf("before %s", op.Name())
+}
+
+func (r traceRecorder) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	r.printf("after %s", op.Name())
+}
+
+func TestMulti(t *testing.T) {
+	assert.Nil(t, tracer.Multi(), "expected no observer")
+	var log []string
+	a := recorder{"a", &log}
+	assert.Equal(t, a, tracer.Multi(a), "expected a lone observer back")
+
+	t.Run("observers", func(t *testing.T) {
+		log = nil
+		o := tracer.Multi(a, recorder{"b", &log})
+		_, isTracer := o.(stackvm.Tracer)
+		assert.False(t, isTracer, "expected no tracer")
+
+		val, ok := o.Context(nil, "any")
+		assert.True(t, ok, "expected a context value")
+		assert.Equal(t, "a", val, "expected the first context value")
+		val, _ = o.Context(nil, "b")
+		assert.Equal(t, "b", val, "expected a later context value")
+		_, ok = o.Context(nil, "c")
+		assert.False(t, ok, "expected no context value")
+
+		run(t, o)
+		assert.Equal(t, []string{
+			"a begin", "b begin", "a queue", "b queue", "a end", "b end", "b handle", "a handle",
+			"a begin", "b begin", "a end", "b end", "b handle", "a handle",
+		}, log, "expected calls in order, but handles in reverse")
+	})
+
+	t.Run("tracers", func(t *testing.T) {
+		log = nil
+		o := tracer.Multi(a, traceRecorder{recorder{"b", &log}})
+		_, isTracer := o.(stackvm.Tracer)
+		assert.True(t, isTracer, "expected a tracer")
+		run(t, o)
+		assert.Equal(t, []string{
+			"a begin", "b begin",
+			"b before fork", "a queue", "b queue", "b after fork",
+			"b before halt", "a end", "b end", "b handle", "a handle",
+			"a begin", "b begin",
+			"b before halt", "a end", "b end", "b handle", "a handle",
+		}, log, "expected per-op calls only on the tracer")
+	})
+}
@@ -0,0 +1,74 @@
+package tracer
+
+import "github.com/jcorbin/stackvm"
+
+// PathTracer is an observer that records each machine's ForkPath: the path of
+// a queued machine extends its parent's. Paths are keyed by the MachID taken
+// from the "id" context key, so it should be combined with, and come after,
+// NewIDTracer; that way any machine id printed by a trace, e.g. by
+// tools/tracelog, may be looked up with Path, and the path passed to
+// (*stackvm.Mach).SetReplay to run only that machine's lineage.
+type PathTracer struct {
+	paths map[MachID]stackvm.ForkPath
+}
+
+// NewPathTracer creates a new, empty, path tracer.
+func NewPathTracer() *PathTracer {
+	return &PathTracer{
+		paths: make(map[MachID]stackvm.ForkPath),
+	}
+}
+
+// Path returns the path recorded for the machine with the given id, if any;
+// paths are kept after their machines have been handled.
+func (pt *PathTracer) Path(id MachID) (stackvm.ForkPath, bool) {
+	fp, def := pt.paths[id]
+	return fp, def
+}
+
+// Context returns the machine's path for the "path" key.
+func (pt *PathTracer) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	if key != "path" {
+		return nil, false
+	}
+	mid, _ := m.Observer().Context(m, "id")
+	id, ok := mid.(MachID)
+	if !ok {
+		return nil, true
+	}
+	return pt.paths[id], true
+}
+
+// Begin starts an empty path for any machine that wasn't queued.
+func (pt *PathTracer) Begin(m *stackvm.Mach) {
+	mid, _ := m.Observer().Context(m, "id")
+	if id, ok := mid.(MachID); ok {
+		if _, def := pt.paths[id]; !def {
+			pt.paths[id] = nil
+		}
+	}
+}
+
+// Queue extends the parent's path with the fork decision that each of the
+// parent and the queued machine took.
+func (pt *PathTracer) Queue(m, n *stackvm.Mach) {
+	mid, _ := m.Observer().Context(m, "id")
+	nid, _ := n.Observer().Context(n, "id")
+	pid, ok := mid.(MachID)
+	if !ok {
+		return
+	}
+	cid, ok := nid.(MachID)
+	if !ok {
+		return
+	}
+	fp := pt.paths[pid]
+	pt.paths[cid] = append(fp[:len(fp):len(fp)], true)
+	pt.paths[pid] = append(fp, false)
+}
+
+// End does nothing.
+func (pt *PathTracer) End(m *stackvm.Mach) {}
+
+// Handle does nothing; paths are kept so that they may be looked up later.
+func (pt *PathTracer) Handle(m *stackvm.Mach, err error) {}
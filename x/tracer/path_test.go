@@ -0,0 +1,49 @@
+package tracer_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestPathTracer(t *testing.T) {
+	pt := tracer.NewPathTracer()
+	m, err := stackvm.New(forkProg)
+	require.NoError(t, err, "unexpected load error")
+	paths := make(map[uint32]stackvm.ForkPath)
+	m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error {
+		code, _ := m.HaltCode()
+		path, ok := m.Observer().Context(m, "path")
+		if assert.True(t, ok, "expected a path context value") {
+			paths[code] = path.(stackvm.ForkPath)
+		}
+		return nil
+	}))
+	require.NoError(t, tracer.Run(m, tracer.Multi(tracer.NewIDTracer(), pt)), "unexpected run error")
+
+	assert.Equal(t, map[uint32]stackvm.ForkPath{
+		1: {false},
+		2: {true},
+	}, paths, "expected the parent and child paths")
+	for id, want := range map[tracer.MachID]stackvm.ForkPath{
+		{1, 0, 1}: {false},
+		{1, 1, 2}: {true},
+	} {
+		path, ok := pt.Path(id)
+		if assert.True(t, ok, "expected a path for %v", id) {
+			assert.Equal(t, want, path, "expected path for %v", id)
+		}
+	}
+	_, ok := pt.Path(tracer.MachID{1, 2, 3})
+	assert.False(t, ok, "expected no path for an unknown machine")
+
+	// without machine ids, there's nothing to key paths by
+	pt = tracer.NewPathTracer()
+	run(t, pt)
+	_, ok = pt.Path(tracer.MachID{1, 0, 1})
+	assert.False(t, ok, "expected no paths without ids")
+}
@@ -0,0 +1,193 @@
+package tracer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+)
+
+// WriteTo writes a gzipped pprof profile, as understood by `go tool pprof`,
+// with "ops" and "forks" sample values, defaulting to "ops". Each ip is a location, within a
+// function named by its label (see ByLabel); its line number is its offset
+// from that label.
+func (p *Profiler) WriteTo(w io.Writer) (int64, error) {
+	var pb pprofBuilder
+	pb.str("")
+
+	// sample types, and a single mapping covering all of memory, which has
+	// functions so that pprof won't try to symbolize it
+	pb.valueType(1, "ops", "count")
+	pb.valueType(1, "forks", "count")
+	pb.msg(3, func(m *protoBuf) {
+		m.uint(1, 1)
+		m.uint(3, 1<<32)
+		m.uint(5, uint64(pb.str("stackvm")))
+		m.bool(7, true)
+	})
+
+	keys := make([]string, 0, len(p.samples))
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	locs := make(map[uint32]uint64)
+	for _, key := range keys {
+		for _, ip := range p.samples[key].stack {
+			locs[ip] = 0
+		}
+	}
+	ips := make([]uint32, 0, len(locs))
+	for ip := range locs {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i] < ips[j] })
+
+	funcs := make(map[string]uint64)
+	for i, ip := range ips {
+		id := uint64(i + 1)
+		locs[ip] = id
+		name := p.label(ip)
+		fid, def := funcs[name]
+		if !def {
+			fid = uint64(len(funcs) + 1)
+			funcs[name] = fid
+			nameStr := pb.str(name)
+			fileStr := pb.str("stackvm")
+			pb.msg(5, func(m *protoBuf) {
+				m.uint(1, fid)
+				m.uint(2, uint64(nameStr))
+				m.uint(3, uint64(nameStr))
+				m.uint(4, uint64(fileStr))
+			})
+		}
+		line := int64(0)
+		if sym, ok := p.syms.Lookup(ip); ok {
+			line = int64(ip - sym.Addr)
+		}
+		pb.msg(4, func(m *protoBuf) {
+			m.uint(1, id)
+			m.uint(2, 1)
+			m.uint(3, uint64(ip))
+			m.msg(4, func(m *protoBuf) {
+				m.uint(1, fid)
+				m.uint(2, uint64(line))
+			})
+		})
+	}
+
+	for _, key := range keys {
+		s := p.samples[key]
+		pb.msg(2, func(m *protoBuf) {
+			ids := make([]uint64, len(s.stack))
+			for i, ip := range s.stack {
+				ids[i] = locs[ip]
+			}
+			m.packed(1, ids...)
+			m.packed(2, uint64(s.Ops), uint64(s.Forks))
+		})
+	}
+
+	pb.valueType(11, "ops", "count")
+	pb.uint(12, 1)
+	pb.uint(14, uint64(pb.str("ops"))) // default sample type
+
+	for _, s := range pb.strs {
+		pb.bytes(6, []byte(s))
+	}
+
+	cw := countWriter{w: w}
+	gz := gzip.NewWriter(&cw)
+	if _, err := gz.Write(pb.Bytes()); err != nil {
+		return cw.n, err
+	}
+	err := gz.Close()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// pprofBuilder builds a pprof Profile message, collecting its string table.
+type pprofBuilder struct {
+	protoBuf
+	strs   []string
+	strIDs map[string]int
+}
+
+func (pb *pprofBuilder) str(s string) int {
+	if id, def := pb.strIDs[s]; def {
+		return id
+	}
+	if pb.strIDs == nil {
+		pb.strIDs = make(map[string]int)
+	}
+	id := len(pb.strs)
+	pb.strs = append(pb.strs, s)
+	pb.strIDs[s] = id
+	return id
+}
+
+func (pb *pprofBuilder) valueType(field int, typ, unit string) {
+	typID, unitID := pb.str(typ), pb.str(unit)
+	pb.msg(field, func(m *protoBuf) {
+		m.uint(1, uint64(typID))
+		m.uint(2, uint64(unitID))
+	})
+}
+
+// protoBuf encodes just enough of the protocol buffer wire format to write a
+// pprof profile.
+type protoBuf struct{ bytes.Buffer }
+
+func (pb *protoBuf) varint(n uint64) {
+	for n >= 0x80 {
+		pb.WriteByte(byte(n) | 0x80)
+		n >>= 7
+	}
+	pb.WriteByte(byte(n))
+}
+
+func (pb *protoBuf) tag(field, wireType int) { pb.varint(uint64(field<<3 | wireType)) }
+
+func (pb *protoBuf) uint(field int, n uint64) {
+	if n != 0 {
+		pb.tag(field, 0)
+		pb.varint(n)
+	}
+}
+
+func (pb *protoBuf) bool(field int, b bool) {
+	if b {
+		pb.uint(field, 1)
+	}
+}
+
+func (pb *protoBuf) bytes(field int, p []byte) {
+	pb.tag(field, 2)
+	pb.varint(uint64(len(p)))
+	pb.Write(p)
+}
+
+func (pb *protoBuf) packed(field int, ns ...uint64) {
+	var sub protoBuf
+	for _, n := range ns {
+		sub.varint(n)
+	}
+	pb.bytes(field, sub.Bytes())
+}
+
+func (pb *protoBuf) msg(field int, f func(m *protoBuf)) {
+	var sub protoBuf
+	f(&sub)
+	pb.bytes(field, sub.Bytes())
+}
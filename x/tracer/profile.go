@@ -0,0 +1,150 @@
+package tracer
+
+import (
+	"fmt"
+
+	"github.com/jcorbin/stackvm"
+)
+
+// ProfileCount counts the operations executed, and machines queued by fork or
+// branch operations, at some point in a program.
+type ProfileCount struct {
+	Ops   int64
+	Forks int64
+}
+
+// Profiler is a tracer that counts executed operations, and forks, by ip and
+// call stack. The call stack is tracked by following call and ret operations,
+// rather than by trusting the machine's control stack, which programs are
+// free to use for data.
+type Profiler struct {
+	syms    stackvm.Symbols
+	stacks  map[*stackvm.Mach][]uint32 // call sites, outermost first
+	last    map[*stackvm.Mach]uint32   // ip of the last op started
+	samples map[string]*profSample     // keyed by ip and call stack
+	key     []byte
+}
+
+type profSample struct {
+	stack []uint32 // ip, then call sites, innermost first
+	ProfileCount
+}
+
+// NewProfiler creates a new profiling tracer; symbols are taken from the first
+// machine that it sees.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		stacks:  make(map[*stackvm.Mach][]uint32),
+		last:    make(map[*stackvm.Mach]uint32),
+		samples: make(map[string]*profSample),
+	}
+}
+
+// Context returns the profiler itself for the "profiler" key.
+func (p *Profiler) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	if key != "profiler" {
+		return nil, false
+	}
+	return p, true
+}
+
+// Begin notes the machine's symbols, if none have been seen yet.
+func (p *Profiler) Begin(m *stackvm.Mach) {
+	if p.syms == nil {
+		p.syms = m.Symbols()
+	}
+}
+
+// End does nothing.
+func (p *Profiler) End(m *stackvm.Mach) {}
+
+// Before counts the operation, and tracks calls and returns.
+func (p *Profiler) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	stack := p.stacks[m]
+	p.sample(ip, stack).Ops++
+	p.last[m] = ip
+	switch op.Name() {
+	case "call":
+		p.stacks[m] = append(stack, ip)
+	case "ret":
+		if len(stack) > 0 {
+			p.stacks[m] = stack[:len(stack)-1]
+		}
+	}
+}
+
+// After does nothing.
+func (p *Profiler) After(m *stackvm.Mach, ip uint32, op stackvm.Op) {}
+
+// Queue counts a fork at the parent's current operation, and copies its call
+// stack to the child.
+func (p *Profiler) Queue(m, n *stackvm.Mach) {
+	stack := p.stacks[m]
+	if ip, def := p.last[m]; def {
+		p.sample(ip, stack).Forks++
+		p.last[n] = ip
+	}
+	p.stacks[n] = append([]uint32(nil), stack...)
+}
+
+// Handle forgets the machine.
+func (p *Profiler) Handle(m *stackvm.Mach, err error) {
+	delete(p.stacks, m)
+	delete(p.last, m)
+}
+
+func (p *Profiler) sample(ip uint32, stack []uint32) *profSample {
+	key := p.key[:0]
+	key = appendUint32(key, ip)
+	for i := len(stack) - 1; i >= 0; i-- {
+		key = appendUint32(key, stack[i])
+	}
+	p.key = key
+	if s, def := p.samples[string(key)]; def {
+		return s
+	}
+	s := &profSample{stack: make([]uint32, 0, len(stack)+1)}
+	s.stack = append(s.stack, ip)
+	for i := len(stack) - 1; i >= 0; i-- {
+		s.stack = append(s.stack, stack[i])
+	}
+	p.samples[string(key)] = s
+	return s
+}
+
+// ByIP returns flat counts for each ip.
+func (p *Profiler) ByIP() map[uint32]ProfileCount {
+	r := make(map[uint32]ProfileCount)
+	for _, s := range p.samples {
+		c := r[s.stack[0]]
+		c.Ops += s.Ops
+		c.Forks += s.Forks
+		r[s.stack[0]] = c
+	}
+	return r
+}
+
+// ByLabel returns flat counts for each label; an ip is attributed to the
+// nearest symbol at or before it, or to its hex address if there is none.
+func (p *Profiler) ByLabel() map[string]ProfileCount {
+	r := make(map[string]ProfileCount)
+	for ip, c := range p.ByIP() {
+		name := p.label(ip)
+		lc := r[name]
+		lc.Ops += c.Ops
+		lc.Forks += c.Forks
+		r[name] = lc
+	}
+	return r
+}
+
+func (p *Profiler) label(ip uint32) string {
+	if sym, ok := p.syms.Lookup(ip); ok {
+		return sym.Name
+	}
+	return fmt.Sprintf("@0x%04x", ip)
+}
+
+func appendUint32(p []byte, n uint32) []byte {
+	return append(p, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
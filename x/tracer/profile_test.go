@@ -0,0 +1,49 @@
+package tracer_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcorbin/stackvm"
+	. "github.com/jcorbin/stackvm/x"
+	"github.com/jcorbin/stackvm/x/tracer"
+)
+
+func TestProfiler(t *testing.T) {
+	m, err := stackvm.New(MustAssemble(
+		0x40,
+		":work", "call",
+		0, "halt",
+		"work:",
+		":more", "fork",
+		"ret",
+		"more:",
+		1, "push", "pop",
+		"ret",
+	))
+	require.NoError(t, err, "unexpected load error")
+	m.SetHandler(10, stackvm.HandlerFunc(func(m *stackvm.Mach) error { return nil }))
+	prof := tracer.NewProfiler()
+	require.NoError(t, tracer.Run(m, prof), "unexpected run error")
+
+	assert.Equal(t, map[uint32]tracer.ProfileCount{
+		0x40: {Ops: 1},
+		0x42: {Ops: 2}, // halt, by each machine
+		0x44: {Ops: 1, Forks: 1},
+		0x46: {Ops: 1},
+		0x47: {Ops: 1},
+		0x49: {Ops: 1},
+		0x4a: {Ops: 1},
+	}, prof.ByIP(), "expected counts by ip")
+	assert.Equal(t, map[string]tracer.ProfileCount{
+		"@0x0040": {Ops: 1},
+		"@0x0042": {Ops: 2},
+		"work":    {Ops: 2, Forks: 1},
+		"more":    {Ops: 3},
+	}, prof.ByLabel(), "expected counts by label")
+	val, ok := prof.Context(m, "profiler")
+	assert.True(t, ok, "expected a profiler context value")
+	assert.Equal(t, prof, val, "expected the profiler itself")
+}
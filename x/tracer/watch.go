@@ -0,0 +1,95 @@
+package tracer
+
+import (
+	"fmt"
+
+	"github.com/jcorbin/stackvm"
+	"github.com/jcorbin/stackvm/x/action"
+)
+
+// WatchEvent is a watched memory access; Old and New are the same for reads,
+// and for unchanged writes.
+type WatchEvent struct {
+	ID       MachID
+	IP       uint32
+	Op       stackvm.Op
+	Cond     action.WatchCond // the conditions that the access met
+	Addr     uint32
+	Old, New uint32
+}
+
+func (ev WatchEvent) String() string {
+	return fmt.Sprintf("%v @%#04x %v %v [%#04x] %d -> %d", ev.ID, ev.IP, ev.Op, ev.Cond, ev.Addr, ev.Old, ev.New)
+}
+
+// LogWatch returns a watch callback that logs every event to a log
+// formatting function.
+func LogWatch(f func(string, ...interface{})) func(WatchEvent) {
+	return func(ev WatchEvent) { f("%v", ev) }
+}
+
+// NewWatchTracer creates a tracer that calls f with every memory access made
+// by a fetch, store, or storeTo op that the given predicate matches before the
+// op; watch terms, like "watch(mem[0x140]:write)", select accesses to watched
+// memory, while any other terms, like "id=1(*:*)" or "@0x40..0x80", narrow
+// them down (see action.ParsePredicate). Machine ids are taken from the "id"
+// context key.
+//
+// Only those three ops are watched: a watched word changed any other way, such
+// as by an op pushing onto a stack that overlaps it, or by a handler, isn't
+// reported.
+func NewWatchTracer(f func(WatchEvent), p action.Predicate) stackvm.Tracer {
+	return &watchTracer{
+		f:       f,
+		p:       p,
+		pending: make(map[*stackvm.Mach]WatchEvent),
+	}
+}
+
+type watchTracer struct {
+	f       func(WatchEvent)
+	p       action.Predicate
+	pending map[*stackvm.Mach]WatchEvent
+}
+
+func (wt *watchTracer) Context(m *stackvm.Mach, key string) (interface{}, bool) {
+	return nil, false
+}
+
+func (wt *watchTracer) Begin(m *stackvm.Mach)             {}
+func (wt *watchTracer) Queue(m, n *stackvm.Mach)          {}
+func (wt *watchTracer) Handle(m *stackvm.Mach, err error) {}
+
+func (wt *watchTracer) Before(m *stackvm.Mach, ip uint32, op stackvm.Op) {
+	delete(wt.pending, m)
+	if !wt.p.Test(m, action.TraceBefore, ip, op) {
+		return
+	}
+	if acc, ok := action.Access(m, op); ok {
+		wt.pending[m] = WatchEvent{IP: ip, Op: op, Addr: acc.Addr, Old: acc.Old}
+	}
+}
+
+func (wt *watchTracer) After(m *stackvm.Mach, _ uint32, _ stackvm.Op) {
+	ev, ok := wt.pending[m]
+	if !ok {
+		return
+	}
+	delete(wt.pending, m)
+	if mid, _ := m.Observer().Context(m, "id"); mid != nil {
+		ev.ID, _ = mid.(MachID)
+	}
+	ev.New, _ = m.Fetch(ev.Addr)
+	ev.Cond = action.MemAccess{
+		Addr:  ev.Addr,
+		Write: ev.Op.Name() != "fetch",
+		Old:   ev.Old,
+		New:   ev.New,
+	}.Cond()
+	wt.f(ev)
+}
+
+func (wt *watchTracer) End(m *stackvm.Mach) {
+	// the last op doesn't get an After
+	delete(wt.pending, m)
+}